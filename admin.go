@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Admin endpoints need the admin-token as bearer token.
+// Without an admin-token set they are disabled.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := SETTINGS.Get("admin-token")
+	if token == "" {
+		ErrorResponse(w, "Admin API is disabled, set admin-token", http.StatusForbidden)
+		return false
+	}
+	if !hasAdminToken(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		ErrorResponse(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func hasAdminToken(r *http.Request) bool {
+	token := SETTINGS.Get("admin-token")
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Versioned REST API, the unversioned routes are kept as aliases.
+// The OpenAPI document is generated from apiEndpoints, so a route
+// is documented by adding it here. The response shapes of v1 are in apiv1.go.
+const apiPrefix = "/api/v1"
+
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Required    bool
+	Multiple    bool
+}
+
+type apiResponse struct {
+	Status      int
+	Description string
+	// Defaults to application/json
+	ContentType string
+	// Value of the type send as body, nil for no body
+	Body interface{}
+	// Answered with an ErrorMsg as well
+	Problem bool
+}
+
+type apiOperation struct {
+	Method      string
+	Summary     string
+	Params      []apiParam
+	RequestType string
+	RequestBody interface{}
+	Responses   []apiResponse
+	Admin       bool
+}
+
+type apiEndpoint struct {
+	Route      string
+	Path       string
+	Handler    http.HandlerFunc
+	Operations []apiOperation
+}
+
+var pathParam = apiParam{Name: "path", In: "path", Type: "string", Required: true,
+	Description: "Path relative to base, may contain slashes"}
+
+var listParams = []apiParam{
+	{Name: "filter", In: "query", Type: "string", Multiple: true, Description: "Only paths containing all filters"},
+	{Name: "exclude", In: "query", Type: "string", Multiple: true, Description: "Leave out paths containing any of these"},
+	{Name: "dirs", In: "query", Type: "string", Multiple: true, Description: "Only files within these directories"},
+	{Name: "typeahead", In: "query", Type: "string", Description: "Names starting with"},
+	{Name: "orderby", In: "query", Type: "string", Description: "name, size, date or taken, prefix - to reverse"},
+	{Name: "limit", In: "query", Type: "integer"},
+	{Name: "page", In: "query", Type: "integer"},
+	{Name: "pagesize", In: "query", Type: "integer"},
+	{Name: "taken_after", In: "query", Type: "string", Description: "Unix time or date, of the EXIF capture date"},
+	{Name: "taken_before", In: "query", Type: "string", Description: "Unix time or date, of the EXIF capture date"},
+	{Name: "camera", In: "query", Type: "string", Multiple: true, Description: "Camera make or model"},
+}
+
+func errorResponses(statuses ...int) []apiResponse {
+	responses := []apiResponse{}
+	for _, status := range statuses {
+		responses = append(responses, apiResponse{Status: status, Description: http.StatusText(status), Body: ErrorMsg{}})
+	}
+	return responses
+}
+
+// Failed uploads have the status of the most severe failure
+func uploadResponses() []apiResponse {
+	responses := []apiResponse{
+		{Status: 201, Body: []UploadSuccesResponse{}},
+		{Status: 207, Description: "Some files failed", Body: []UploadSuccesResponse{}},
+		{Status: 400, Description: "No file uploaded or all failed", Body: []UploadSuccesResponse{}, Problem: true},
+	}
+	for _, code := range []errorCode{codePermission, codeExists, codeTooLarge, codeUnsupportedType, codeInternal, codeNoSpace} {
+		responses = append(responses, apiResponse{Status: code.Status, Description: "All files failed", Body: []UploadSuccesResponse{}})
+	}
+	return responses
+}
+
+func responses(ok ...apiResponse) func(errors ...int) []apiResponse {
+	return func(errors ...int) []apiResponse {
+		return append(ok, errorResponses(errors...)...)
+	}
+}
+
+var apiEndpoints = []apiEndpoint{
+	{Route: "/list/group/", Path: "/list/group/", Handler: listGroupedRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Files grouped per directory", Params: listParams,
+			Responses: responses(apiResponse{Status: 200, Body: ListFileGrouped{}}, apiResponse{Status: 304})(400)},
+	}},
+	{Route: "/list/", Path: "/list/", Handler: listRest, Operations: []apiOperation{
+		{Method: "get", Summary: "List files", Params: listParams,
+			Responses: responses(apiResponse{Status: 200, Body: []ListFile{}}, apiResponse{Status: 304})(400)},
+	}},
+	{Route: "/detail/", Path: "/detail/{path}", Handler: detailRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Detail of a file, archives include their members", Params: []apiParam{pathParam},
+			Responses: responses(apiResponse{Status: 200, Body: ListFile{}}, apiResponse{Status: 304})(404)},
+	}},
+	{Route: "/content/", Path: "/content/{path}", Handler: contentRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Content of a file, supports range requests", Params: []apiParam{pathParam},
+			Responses: responses(apiResponse{Status: 200, ContentType: "application/octet-stream", Body: []byte{}},
+				apiResponse{Status: 206, ContentType: "application/octet-stream", Body: []byte{}},
+				apiResponse{Status: 304})(404)},
+		{Method: "delete", Summary: "Delete a file", Params: []apiParam{pathParam},
+			Responses: responses(apiResponse{Status: 204})(404, 405)},
+	}},
+	{Route: "/delete/", Path: "/delete/{path}", Handler: deleteRest, Operations: []apiOperation{
+		{Method: "delete", Summary: "Delete a file", Params: []apiParam{pathParam},
+			Responses: responses(apiResponse{Status: 204})(404, 405)},
+	}},
+	{Route: "/upload/", Path: "/upload/", Handler: uploadRest, Operations: []apiOperation{
+		{Method: "post", Summary: "Upload files, dirs[] fields go before the files they apply to",
+			Params:      []apiParam{{Name: "extract", In: "query", Type: "boolean", Description: "Extract uploaded zip and tar archives"}},
+			RequestType: "multipart/form-data",
+			RequestBody: struct {
+				Dirs       []string `json:"dirs[]"`
+				Uploadfile []byte
+			}{},
+			Responses: uploadResponses()},
+	}},
+	{Route: "/archive/", Path: "/archive/{path}", Handler: archiveRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Download a directory as archive",
+			Params:    append([]apiParam{pathParam, {Name: "format", In: "query", Type: "string", Description: "zip, tar or tar.gz"}}, listParams...),
+			Responses: responses(apiResponse{Status: 200, ContentType: "application/octet-stream", Body: []byte{}})(400, 404)},
+		{Method: "post", Summary: "Download the posted paths as archive, narrowed down with filter and exclude",
+			// filter and exclude, the first of listParams
+			Params:      append([]apiParam{pathParam, {Name: "format", In: "query", Type: "string", Description: "zip, tar or tar.gz"}}, listParams[:2]...),
+			RequestType: "application/json", RequestBody: []string{},
+			Responses: responses(apiResponse{Status: 200, ContentType: "application/octet-stream", Body: []byte{}})(400, 413)},
+	}},
+	{Route: "/move/", Path: "/move/{path}", Handler: moveRest, Operations: []apiOperation{
+		{Method: "post", Summary: "Move or rename a file or directory", Params: []apiParam{pathParam},
+			RequestType: "application/x-www-form-urlencoded", RequestBody: struct{ To string }{},
+			Responses: responses(apiResponse{Status: 200, Body: ListFile{}})(400, 404, 405, 409, 500)},
+	}},
+	{Route: "/thumb/", Path: "/thumb/{path}", Handler: thumbRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Thumbnail of an image",
+			Params:    []apiParam{pathParam, {Name: "w", In: "query", Type: "integer"}, {Name: "h", In: "query", Type: "integer"}},
+			Responses: responses(apiResponse{Status: 200, ContentType: "image/jpeg", Body: []byte{}})(404, 413, 415, 500)},
+	}},
+	{Route: "/stream/", Path: "/stream/{path}", Handler: streamRest, Operations: []apiOperation{
+		{Method: "get", Summary: "HLS playlist of an MP4, also at {path}/index.m3u8, remuxed files have {path}/init.mp4 and {path}/seg{n}.m4s", Params: []apiParam{pathParam},
+			Responses: responses(apiResponse{Status: 200, ContentType: "application/vnd.apple.mpegurl", Body: ""})(404, 415, 422)},
+	}},
+	{Route: "/cycle/", Path: "/cycle/", Handler: cycleRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Last cache update, use as since for /changes/",
+			Responses: responses(apiResponse{Status: 200, Body: ""})()},
+	}},
+	{Route: "/changes/", Path: "/changes/", Handler: changesRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Files added, modified and removed since a cycle",
+			Params: []apiParam{{Name: "since", In: "query", Type: "integer", Required: true, Description: "Value of /cycle/ or Cycle of the previous response"},
+				{Name: "dirs", In: "query", Type: "string", Multiple: true}},
+			Responses: responses(apiResponse{Status: 200, Body: ChangesResponse{}}, apiResponse{Status: 304})(400, 410)},
+	}},
+	{Route: "/events/", Path: "/events/", Handler: eventsRest, Operations: []apiOperation{
+		{Method: "get", Summary: "File events as Server-Sent Events, or WebSocket on upgrade",
+			Params: []apiParam{{Name: "dirs", In: "query", Type: "string", Multiple: true},
+				{Name: "Last-Event-ID", In: "header", Type: "integer"}},
+			Responses: responses(apiResponse{Status: 200, ContentType: "text/event-stream", Body: FileEvent{}})()},
+	}},
+	{Route: "/admin/reload", Path: "/admin/reload", Handler: reloadRest, Operations: []apiOperation{
+		{Method: "post", Summary: "Reload settings from config file, environment and flags", Admin: true,
+			Responses: responses(apiResponse{Status: 200, Body: ReloadResult{}})(401, 403, 405, 422)},
+	}},
+	{Route: "/healthz", Path: "/healthz", Handler: healthzRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Liveness, the process is running",
+			Responses: responses(apiResponse{Status: 200, Body: HealthResponse{}})()},
+	}},
+	{Route: "/readyz", Path: "/readyz", Handler: readyzRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Readiness, the first sync finished and base is readable and writable",
+			Responses: responses(apiResponse{Status: 200, Body: ReadyResponse{}},
+				apiResponse{Status: 503, Description: "Not ready", Body: ReadyResponse{}})()},
+	}},
+	{Route: "/status", Path: "/status", Handler: statusRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Version, uptime, settings, cache, last sync and disk space", Admin: true,
+			Responses: responses(apiResponse{Status: 200, Body: StatusResponse{}})(401, 403)},
+	}},
+	{Route: "/metrics", Path: "/metrics", Handler: metricsRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Metrics in the Prometheus text format",
+			Responses: responses(apiResponse{Status: 200, ContentType: "text/plain", Body: ""})()},
+	}},
+	{Route: "/problems/", Path: "/problems/", Handler: problemsRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Error codes, the type of every problem links here",
+			Responses: responses(apiResponse{Status: 200, Body: []errorCode{}})()},
+	}},
+	{Route: "", Path: "/problems/{code}", Handler: problemsRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Description of an error code",
+			Params:    []apiParam{{Name: "code", In: "path", Type: "string", Required: true}},
+			Responses: responses(apiResponse{Status: 200, Body: errorCode{}})(404)},
+	}},
+	{Route: "/webhooks/", Path: "/webhooks/", Handler: webhooksRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Registered webhooks", Admin: true,
+			Responses: responses(apiResponse{Status: 200, Body: []Webhook{}})(401, 403)},
+		{Method: "post", Summary: "Register a webhook", Admin: true,
+			RequestType: "application/json", RequestBody: Webhook{},
+			Responses: responses(apiResponse{Status: 201, Body: Webhook{}})(400, 401, 403)},
+	}},
+	{Route: "", Path: "/webhooks/{id}", Handler: webhooksRest, Operations: []apiOperation{
+		{Method: "delete", Summary: "Remove a webhook", Admin: true,
+			Params:    []apiParam{{Name: "id", In: "path", Type: "string", Required: true}},
+			Responses: responses(apiResponse{Status: 204})(401, 403, 404)},
+	}},
+	{Route: "", Path: "/webhooks/deliveries/", Handler: webhooksRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Delivery log of all webhooks", Admin: true,
+			Responses: responses(apiResponse{Status: 200, Body: []Delivery{}})(401, 403)},
+	}},
+	{Route: "", Path: "/webhooks/{id}/deliveries/", Handler: webhooksRest, Operations: []apiOperation{
+		{Method: "get", Summary: "Delivery log of a webhook", Admin: true,
+			Params:    []apiParam{{Name: "id", In: "path", Type: "string", Required: true}},
+			Responses: responses(apiResponse{Status: 200, Body: []Delivery{}})(401, 403)},
+	}},
+}
+
+// Register every route of the API, unversioned and under apiPrefix
+func routes(mux *http.ServeMux) {
+	for _, endpoint := range apiEndpoints {
+		if endpoint.Route == "" {
+			// Documented path served by the handler of another route
+			continue
+		}
+		mux.HandleFunc(endpoint.Route, endpoint.Handler)
+		mux.Handle(apiPrefix+endpoint.Route, v1Handler(endpoint.Handler))
+	}
+	mux.HandleFunc(apiPrefix+"/openapi.json", openAPIRest)
+
+	// Vue view
+	mux.HandleFunc("/", indexView)
+
+	//HTML Views
+	mux.HandleFunc("/items", itemsView)
+	mux.HandleFunc("/view/", viewView)
+	mux.HandleFunc("/video/", videoView)
+	mux.HandleFunc("/add/", addView)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Responses under apiPrefix have snake_case field names, sizes as numbers
+// and URLs on the versioned paths. The unversioned routes share the handlers
+// and keep the Go style field names of the structs.
+//
+// A field is renamed in v1 with a `v1:"name"` tag, left out with `v1:"-"`,
+// and a string holding a number is encoded as integer with `v1:",int"`.
+
+// Routes served under apiPrefix, URLs in responses starting with one are prefixed
+var v1Routes []string
+
+func init() {
+	for _, endpoint := range apiEndpoints {
+		if endpoint.Route != "" {
+			v1Routes = append(v1Routes, endpoint.Route)
+		}
+	}
+}
+
+// Marks the response of a request under apiPrefix. Flush, Hijack and
+// ReadFrom are passed on for the event stream, websockets and sendfile.
+type v1Writer struct {
+	http.ResponseWriter
+}
+
+func (w *v1Writer) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *v1Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *v1Writer) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *v1Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Serve a handler under apiPrefix with the v1 response shapes
+func v1Handler(handler http.HandlerFunc) http.Handler {
+	return http.StripPrefix(apiPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(&v1Writer{w}, r)
+	}))
+}
+
+func isV1(w http.ResponseWriter) bool {
+	_, ok := w.(*v1Writer)
+	return ok
+}
+
+// JSON of v in the response shape of the API version of w
+func apiJSON(w http.ResponseWriter, v interface{}) ([]byte, error) {
+	if isV1(w) {
+		return json.Marshal(v1Value(reflect.ValueOf(v)))
+	}
+	return json.Marshal(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := apiJSON(w, v)
+	if err != nil {
+		return
+	}
+	w.Write(append(data, '\n'))
+}
+
+// Decode a request body send in the shape of the API version of w
+func readJSON(w http.ResponseWriter, body io.Reader, v interface{}) error {
+	if !isV1(w) {
+		return json.NewDecoder(body).Decode(v)
+	}
+	var value interface{}
+	if err := json.NewDecoder(body).Decode(&value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v1Input(value, reflect.TypeOf(v)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// DetailURL is detail_url, HTTPStatus is http_status
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Name of a struct field in v1, empty when the field is left out
+func v1FieldName(field reflect.StructField) (name string, omitEmpty bool, asInt bool) {
+	if field.PkgPath != "" {
+		return "", false, false
+	}
+	jsonName, jsonOptions, _ := strings.Cut(field.Tag.Get("json"), ",")
+	v1Name, v1Options, _ := strings.Cut(field.Tag.Get("v1"), ",")
+	if jsonName == "-" || v1Name == "-" {
+		return "", false, false
+	}
+	name = v1Name
+	if name == "" {
+		name = jsonName
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return snakeCase(name), strings.Contains(jsonOptions, "omitempty"), v1Options == "int"
+}
+
+// Empty as omitempty of encoding/json sees it
+func emptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func v1URL(u string) string {
+	for _, route := range v1Routes {
+		if strings.HasPrefix(u, route) {
+			return apiPrefix + u
+		}
+	}
+	return u
+}
+
+// Value of v with the v1 field names, encoded by encoding/json
+func v1Value(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return v1Value(v.Elem())
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, omitEmpty, asInt := v1FieldName(field)
+			value := v.Field(i)
+			if name == "" || omitEmpty && emptyValue(value) {
+				continue
+			}
+			switch {
+			case asInt:
+				n, _ := strconv.ParseInt(value.String(), 10, 64)
+				fields[name] = n
+			case value.Kind() == reflect.String && strings.HasSuffix(field.Name, "URL"):
+				fields[name] = v1URL(value.String())
+			default:
+				fields[name] = v1Value(value)
+			}
+		}
+		return fields
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = v1Value(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		// Keys are data, such as setting names, and kept
+		items := map[string]interface{}{}
+		iter := v.MapRange()
+		for iter.Next() {
+			items[fmt.Sprint(iter.Key().Interface())] = v1Value(iter.Value())
+		}
+		return items
+	}
+	return v.Interface()
+}
+
+// Decoded v1 JSON with the field names of t, for encoding/json to decode into t
+func v1Input(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		fields := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, asInt := v1FieldName(field)
+			v, found := object[name]
+			if name == "" || !found {
+				continue
+			}
+			if n, ok := v.(float64); ok && asInt {
+				v = strconv.FormatInt(int64(n), 10)
+			}
+			goName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if goName == "" {
+				goName = field.Name
+			}
+			fields[goName] = v1Input(v, field.Type)
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		converted := make([]interface{}, len(items))
+		for i, item := range items {
+			converted[i] = v1Input(item, t.Elem())
+		}
+		return converted
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		converted := map[string]interface{}{}
+		for key, item := range object {
+			converted[key] = v1Input(item, t.Elem())
+		}
+		return converted
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnakeCase(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected string
+	}{
+		{"Name", "name"},
+		{"SizeBytes", "size_bytes"},
+		{"DetailURL", "detail_url"},
+		{"HTTPStatus", "http_status"},
+		{"ID", "id"},
+		{"WebhookID", "webhook_id"},
+		{"LastSyncMs", "last_sync_ms"},
+		{"type", "type"},
+		{"dirs[]", "dirs[]"},
+	}
+	for tcNumber, test := range testcases {
+		result := snakeCase(test.name)
+		if result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+	}
+}
+
+func TestV1Responses(t *testing.T) {
+	setupArchiveBase(t)
+	defer func(token string) {
+		SETTINGS.VarString["admin-token"] = token
+	}(SETTINGS.Get("admin-token"))
+	SETTINGS.VarString["admin-token"] = "secret"
+
+	mux := http.NewServeMux()
+	routes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) map[string]interface{} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body
+	}
+
+	testcases := []struct {
+		path     string
+		key      string
+		expected interface{}
+	}{
+		{apiPrefix + "/detail/docs/b.txt", "size_bytes", float64(5)},
+		{apiPrefix + "/detail/docs/b.txt", "content_url", apiPrefix + "/content/%2Fdocs%2Fb.txt"},
+		{apiPrefix + "/detail/docs/b.txt", "view_url", "/view/%2Fdocs%2Fb.txt"},
+		{apiPrefix + "/detail/docs/b.txt", "is_dir", false},
+		{apiPrefix + "/detail/docs/b.txt", "SizeBytes", nil},
+		{apiPrefix + "/detail/missing.txt", "code", "not-found"},
+		{apiPrefix + "/detail/missing.txt", "Reason", nil},
+		{apiPrefix + "/detail/missing.txt", "HTTPStatus", nil},
+		{"/detail/docs/b.txt", "SizeBytes", "5"},
+		{"/detail/docs/b.txt", "ContentURL", "/content/%2Fdocs%2Fb.txt"},
+		{"/detail/missing.txt", "HTTPStatus", float64(404)},
+	}
+	for tcNumber, test := range testcases {
+		result := get(test.path)[test.key]
+		if result != test.expected {
+			t.Error("testcase", tcNumber, test.path, test.key, "expected", test.expected, "!=", result)
+		}
+	}
+
+	// Request bodies use the v1 names as well
+	req, _ := http.NewRequest("POST", server.URL+apiPrefix+"/webhooks/",
+		strings.NewReader(`{"url":"http://127.0.0.1:1/hook","content_types":["image/"]}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	created := map[string]interface{}{}
+	json.Unmarshal(body, &created)
+	defer Webhooks.Remove(created["id"].(string))
+	expected := []interface{}{"image/"}
+	if resp.StatusCode != http.StatusCreated || !reflect.DeepEqual(created["content_types"], expected) {
+		t.Error("expected webhook created with content_types", expected, "!=", resp.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Writes files into an archive stream.
+type archiveWriter interface {
+	Add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+// zip.Writer switches to ZIP64 by itself for large files
+func (a *zipArchive) Add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	if isCompressedContent(name) {
+		header.Method = zip.Store
+	}
+	fw, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+}
+
+func (a *tarArchive) Add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// File could have grown since stat, never write more than the header says.
+	_, err = io.CopyN(a.tw, r, info.Size())
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gw != nil {
+		return a.gw.Close()
+	}
+	return nil
+}
+
+var archiveFormats = map[string]struct {
+	extension   string
+	contentType string
+}{
+	"zip":    {".zip", "application/zip"},
+	"tar":    {".tar", "application/x-tar"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+}
+
+func newArchiveWriter(w io.Writer, format string) archiveWriter {
+	switch format {
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		gw := gzip.NewWriter(w)
+		return &tarArchive{tw: tar.NewWriter(gw), gw: gw}
+	default:
+		return &zipArchive{zw: zip.NewWriter(w)}
+	}
+}
+
+// Media and archives are compressed already, deflating them only costs cpu.
+func isCompressedContent(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp",
+		".mp4", ".mkv", ".webm", ".avi", ".mov", ".mp3", ".ogg", ".flac",
+		".zip", ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar":
+		return true
+	}
+	return false
+}
+
+// Largest posted list of paths
+const archiveMaxSelection = 1 << 20
+
+// Files selected by a posted JSON list of paths.
+// Directories in the list include everything below them.
+func archiveSelection(c *CacheFiles, paths []string) []*File {
+	files := []*File{}
+	seen := make(map[string]bool)
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	for _, p := range paths {
+		p = "/" + strings.Join(cleanRelativePath(p), "/")
+		for key, file := range c.Items {
+			if seen[key] || file.IsDir || file.Archive != "" {
+				continue
+			}
+			if key == p || strings.HasPrefix(key, strings.TrimSuffix(p, "/")+"/") {
+				seen[key] = true
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// Files with names matching filter and not exclude, as on /list/
+func filterArchiveFiles(files []*File, query url.Values) []*File {
+	filters, excludes := query["filter"], query["exclude"]
+	kept := []*File{}
+	for _, file := range files {
+		if notContains(file.Name, filters) && !contains(file.Name, excludes) {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// Files selected by the directory in the URL, narrowed down with
+// the same query parameters as /list/. False when a parameter is invalid.
+func archiveListing(w http.ResponseWriter, r *http.Request, dir string) ([]*File, bool) {
+	files := []*File{}
+	listItems, ok := handleParameters(w, r)
+	if !ok {
+		return nil, false
+	}
+	items := filterDirs(listItems, removeEmpty(strings.Split(dir, "/")))
+	for _, item := range items {
+		if item.IsDir {
+			continue
+		}
+		if file, found := Cache.Get(item.cacheKey()); found && file.Archive == "" {
+			files = append(files, file)
+		}
+	}
+	return files, true
+}
+
+func archiveRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	dir, err := url.PathUnescape(r.URL.Path[len("/archive"):])
+	if err != nil {
+		ErrorResponse(w, "Unable to parse URL", http.StatusBadRequest)
+		return
+	}
+	dir = stripTrailingSlash(dir)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	archiveFormat, ok := archiveFormats[format]
+	if !ok {
+		ErrorResponse(w, "Unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	var files []*File
+	switch r.Method {
+	case http.MethodPost:
+		paths := []string{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, archiveMaxSelection)).Decode(&paths)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ProblemResponse(w, codeTooLarge, "List of paths is too large")
+			return
+		}
+		if err != nil {
+			ErrorResponse(w, "Unable to parse list of paths", http.StatusBadRequest)
+			return
+		}
+		// narrowed down with filter and exclude like a directory
+		files = filterArchiveFiles(archiveSelection(Cache, paths), r.URL.Query())
+	default:
+		if dir != "" {
+			if file, found := Cache.Get(dir); !found || !file.IsDir {
+				ErrorResponse(w, "Directory not found", http.StatusNotFound)
+				return
+			}
+		}
+		if files, ok = archiveListing(w, r, dir); !ok {
+			return
+		}
+	}
+
+	name := path.Base(dir)
+	if name == "." || name == "/" {
+		name = "silo"
+	}
+	w.Header().Set("Content-Type", archiveFormat.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+cleanFilename(name)+archiveFormat.extension+"\"")
+	w.WriteHeader(http.StatusOK)
+
+	// The status is send, errors can only abort the stream from here on.
+	archive := newArchiveWriter(w, format)
+	for _, file := range files {
+		if err := addFileToArchive(r.Context(), archive, file); err != nil {
+			log.Println("archive", file.relativePath(), err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Println("archive", err)
+	}
+}
+
+func addFileToArchive(ctx context.Context, archive archiveWriter, file *File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Removed or replaced since the listing, nothing of it is written yet
+	// so the rest of the archive can still be send.
+	osFile, err := os.Open(file.fullPath())
+	if err != nil {
+		log.Println("archive skipping", file.relativePath(), err)
+		return nil
+	}
+	defer osFile.Close()
+	info, err := osFile.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		log.Println("archive skipping", file.relativePath(), err)
+		return nil
+	}
+	return archive.Add(strings.TrimPrefix(file.relativePath(), "/"), info, contextReader{ctx, osFile})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Names and contents of the files in a streamed archive
+func readTestArchive(t *testing.T, format string, data []byte) map[string]string {
+	files := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range zr.File {
+			rc, err := entry.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(entry.Name, err)
+			}
+			method := "deflate"
+			if entry.Method == zip.Store {
+				method = "store"
+			}
+			files[entry.Name] = method + ":" + string(content)
+		}
+		return files
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if format == "tar.gz" {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+}
+
+func sortedNames(files map[string]string) []string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Cache filled with a walk of a temporary base
+func setupArchiveBase(t *testing.T) {
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "docs", "sub"), 0755)
+	os.WriteFile(filepath.Join(base, "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(base, "docs", "b.txt"), []byte("world"), 0644)
+	os.WriteFile(filepath.Join(base, "docs", "c.jpg"), []byte("jpeg"), 0644)
+	os.WriteFile(filepath.Join(base, "docs", "sub", "d.txt"), []byte("deep"), 0644)
+
+	oldBase, oldItems := SETTINGS.Get("base"), Cache.Items
+	t.Cleanup(func() {
+		SETTINGS.VarString["base"] = oldBase
+		Cache.Update(oldItems)
+	})
+	SETTINGS.VarString["base"] = base
+	fileChan := make(chan *File, 100)
+	go func() {
+		DirWalk(context.Background(), base, fileChan)
+		close(fileChan)
+	}()
+	items := CacheMap{}
+	for file := range fileChan {
+		items[file.relativePath()] = file
+	}
+	Cache.Update(items)
+}
+
+func TestArchiveRest(t *testing.T) {
+	setupArchiveBase(t)
+
+	testcases := []struct {
+		method      string
+		path        string
+		body        string
+		format      string
+		expected    []string
+		disposition string
+	}{
+		{"GET", "/archive/docs", "", "zip",
+			[]string{"docs/b.txt=deflate:world", "docs/c.jpg=store:jpeg", "docs/sub/d.txt=deflate:deep"}, "docs.zip"},
+		{"GET", "/archive/docs?format=tar", "", "tar",
+			[]string{"docs/b.txt=world", "docs/c.jpg=jpeg", "docs/sub/d.txt=deep"}, "docs.tar"},
+		{"GET", "/archive/docs/?format=tar.gz", "", "tar.gz",
+			[]string{"docs/b.txt=world", "docs/c.jpg=jpeg", "docs/sub/d.txt=deep"}, "docs.tar.gz"},
+		{"GET", "/archive/?format=tar", "", "tar",
+			[]string{"a.txt=hello", "docs/b.txt=world", "docs/c.jpg=jpeg", "docs/sub/d.txt=deep"}, "silo.tar"},
+		// narrowed down like /list/
+		{"GET", "/archive/docs?format=tar&filter=b", "", "tar", []string{"docs/b.txt=world"}, "docs.tar"},
+		{"GET", "/archive/docs?format=tar&exclude=jpg", "", "tar",
+			[]string{"docs/b.txt=world", "docs/sub/d.txt=deep"}, "docs.tar"},
+		// selections, directories include everything below them
+		{"POST", "/archive/?format=tar", `["/a.txt", "docs/sub"]`, "tar",
+			[]string{"a.txt=hello", "docs/sub/d.txt=deep"}, "silo.tar"},
+		{"POST", "/archive/?format=tar", `["docs", "docs/b.txt", "../a.txt"]`, "tar",
+			[]string{"a.txt=hello", "docs/b.txt=world", "docs/c.jpg=jpeg", "docs/sub/d.txt=deep"}, "silo.tar"},
+		{"POST", "/archive/?format=zip", `["missing", "do"]`, "zip", []string{}, "silo.zip"},
+		{"POST", "/archive/?format=tar&filter=b", `["docs"]`, "tar", []string{"docs/b.txt=world"}, "silo.tar"},
+		{"POST", "/archive/?format=tar&exclude=jpg", `["docs"]`, "tar",
+			[]string{"docs/b.txt=world", "docs/sub/d.txt=deep"}, "silo.tar"},
+	}
+
+	for tcNumber, testcase := range testcases {
+		w := httptest.NewRecorder()
+		archiveRest(w, httptest.NewRequest(testcase.method, testcase.path, strings.NewReader(testcase.body)))
+		if w.Code != 200 || !strings.Contains(w.Header().Get("Content-Disposition"), `"`+testcase.disposition+`"`) {
+			t.Error("testcase", tcNumber, "expected", testcase.disposition, "!=", w.Code, w.Header())
+			continue
+		}
+		files := readTestArchive(t, testcase.format, w.Body.Bytes())
+		result := []string{}
+		for _, name := range sortedNames(files) {
+			result = append(result, name+"="+files[name])
+		}
+		if strings.Join(result, ",") != strings.Join(testcase.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+
+	errors := []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"GET", "/archive/docs?format=rar", "", 400},
+		{"GET", "/archive/missing", "", 404},
+		{"GET", "/archive/a.txt", "", 404},
+		{"POST", "/archive/", "not json", 400},
+		{"POST", "/archive/", `["` + strings.Repeat("a", archiveMaxSelection) + `"]`, 413},
+	}
+	for tcNumber, testcase := range errors {
+		w := httptest.NewRecorder()
+		archiveRest(w, httptest.NewRequest(testcase.method, testcase.path, strings.NewReader(testcase.body)))
+		if w.Code != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", w.Code)
+		}
+	}
+
+	// removed after the listing, the rest is still archived
+	os.Remove(filepath.Join(SETTINGS.Get("base"), "docs", "c.jpg"))
+	w := httptest.NewRecorder()
+	archiveRest(w, httptest.NewRequest("GET", "/archive/docs?format=tar", nil))
+	files := readTestArchive(t, "tar", w.Body.Bytes())
+	if names := sortedNames(files); strings.Join(names, ",") != "docs/b.txt,docs/sub/d.txt" {
+		t.Error("expected the removed file to be skipped !=", names)
+	}
+}
+
+func TestArchiveSelection(t *testing.T) {
+	setupArchiveBase(t)
+	testcases := []struct {
+		paths    []string
+		expected []string
+	}{
+		{[]string{"a.txt"}, []string{"/a.txt"}},
+		{[]string{"/docs/"}, []string{"/docs/b.txt", "/docs/c.jpg", "/docs/sub/d.txt"}},
+		{[]string{"docs/sub", "docs/sub/d.txt"}, []string{"/docs/sub/d.txt"}},
+		// no prefix matches on names
+		{[]string{"doc", "docs/b"}, []string{}},
+		{[]string{"../../docs/sub"}, []string{"/docs/sub/d.txt"}},
+		{[]string{}, []string{}},
+	}
+	for tcNumber, testcase := range testcases {
+		result := []string{}
+		for _, file := range archiveSelection(Cache, testcase.paths) {
+			result = append(result, file.relativePath())
+		}
+		sort.Strings(result)
+		if strings.Join(result, ",") != strings.Join(testcase.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+// Keeps the count and the last bytes written
+type tailWriter struct {
+	n    int64
+	tail []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > 1<<16 {
+		w.tail = w.tail[len(w.tail)-1<<16:]
+	}
+	return len(p), nil
+}
+
+// A file over 4GB needs the ZIP64 records, the sparse file is
+// streamed but only the end of the archive is kept.
+func TestZipArchiveZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 4GB")
+	}
+	fp := filepath.Join(t.TempDir(), "large.mp4")
+	size := int64(1<<32 + 10)
+	f, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Skip("no sparse files", err)
+	}
+	f.Close()
+
+	w := &tailWriter{}
+	archive := newArchiveWriter(w, "zip")
+	file := &File{Name: "large.mp4", AbsPath: filepath.Dir(fp), RelPath: "/"}
+	start := time.Now()
+	if err := addFileToArchive(context.Background(), archive, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.n < size {
+		t.Fatal("archive smaller than the file", w.n)
+	}
+	// zip64 end of central directory record and locator
+	if !bytes.Contains(w.tail, []byte{0x50, 0x4b, 0x06, 0x06}) || !bytes.Contains(w.tail, []byte{0x50, 0x4b, 0x06, 0x07}) {
+		t.Error("expected ZIP64 end records")
+	}
+	// the central directory entry has the real size in its zip64 extra field
+	i := bytes.Index(w.tail, []byte{0x50, 0x4b, 0x01, 0x02})
+	if i < 0 {
+		t.Fatal("central directory not found")
+	}
+	entry := w.tail[i:]
+	nameLength := int(binary.LittleEndian.Uint16(entry[28:]))
+	extraLength := int(binary.LittleEndian.Uint16(entry[30:]))
+	extra := entry[46+nameLength : 46+nameLength+extraLength]
+	zip64Size := int64(0)
+	for len(extra) >= 4 {
+		id, length := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if id == 0x0001 && length >= 8 {
+			zip64Size = int64(binary.LittleEndian.Uint64(extra[4:]))
+		}
+		if len(extra) < 4+length {
+			break
+		}
+		extra = extra[4+length:]
+	}
+	if string(entry[46:46+nameLength]) != "large.mp4" || zip64Size != size {
+		t.Error("expected a zip64 extra field with size", size, "!=", zip64Size)
+	}
+	t.Log("streamed in", time.Since(start))
+}
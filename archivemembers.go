@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Separates the archive path from the member path in URLs,
+// /content/photos/shoot.zip!/day1/img.jpg
+const archiveSeparator = "!/"
+
+var errMemberNotFound = errors.New("Archive member not found")
+
+type archiveMember struct {
+	Name    string
+	Size    int64
+	ModDate int64
+	ModNano int64
+	IsDir   bool
+}
+
+func isArchiveName(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".zip") ||
+		strings.HasSuffix(lower, ".tar") ||
+		strings.HasSuffix(lower, ".tar.gz") ||
+		strings.HasSuffix(lower, ".tgz")
+}
+
+// Reader for tar and tar.gz archives, closing it closes the file.
+type tarFile struct {
+	*tar.Reader
+	closers []io.Closer
+}
+
+func (t *tarFile) Close() error {
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		t.closers[i].Close()
+	}
+	return nil
+}
+
+func openTar(fullPath string) (*tarFile, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	t := &tarFile{closers: []io.Closer{f}}
+	var r io.Reader = f
+	lower := strings.ToLower(fullPath)
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.closers = append(t.closers, gr)
+		r = gr
+	}
+	t.Reader = tar.NewReader(r)
+	return t, nil
+}
+
+// List the members of a zip or tar(.gz) archive.
+// zip only reads the central directory, tar has to read the whole archive.
+func readArchiveMembers(fullPath string) ([]archiveMember, error) {
+	members := []archiveMember{}
+	if strings.HasSuffix(strings.ToLower(fullPath), ".zip") {
+		zr, err := zip.OpenReader(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, entry := range zr.File {
+			members = append(members, archiveMember{
+				Name:    entry.Name,
+				Size:    int64(entry.UncompressedSize64),
+				ModDate: entry.Modified.Unix(),
+				ModNano: entry.Modified.UnixNano(),
+				IsDir:   entry.Mode().IsDir(),
+			})
+		}
+		return members, nil
+	}
+
+	tr, err := openTar(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return members, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			continue
+		}
+		members = append(members, archiveMember{
+			Name:    header.Name,
+			Size:    header.Size,
+			ModDate: header.ModTime.Unix(),
+			ModNano: header.ModTime.UnixNano(),
+			IsDir:   header.Typeflag == tar.TypeDir,
+		})
+	}
+}
+
+// Open a single member, the caller has to close the reader.
+func openArchiveMember(fullPath, member string) (io.ReadCloser, int64, error) {
+	if strings.HasSuffix(strings.ToLower(fullPath), ".zip") {
+		zr, err := zip.OpenReader(fullPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, entry := range zr.File {
+			if memberPath(entry.Name) != member || entry.Mode().IsDir() {
+				continue
+			}
+			rc, err := entry.Open()
+			if err != nil {
+				zr.Close()
+				return nil, 0, err
+			}
+			return &multiCloser{Reader: rc, closers: []io.Closer{rc, zr}}, int64(entry.UncompressedSize64), nil
+		}
+		zr.Close()
+		return nil, 0, errMemberNotFound
+	}
+
+	tr, err := openTar(fullPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			tr.Close()
+			if err == io.EOF {
+				return nil, 0, errMemberNotFound
+			}
+			return nil, 0, err
+		}
+		if header.Typeflag == tar.TypeReg && memberPath(header.Name) == member {
+			return tr, header.Size, nil
+		}
+	}
+}
+
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	for _, c := range m.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// Normalized member path without leading slash, used in urls and keys.
+// Names with ../ are resolved inside the archive root.
+func memberPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Virtual File for a member of the archive.
+func archiveMemberFile(archive *File, member archiveMember) *File {
+	dir, name := path.Split(memberPath(member.Name))
+	return &File{
+		Name:        name,
+		Size:        member.Size,
+		ModDate:     member.ModDate,
+		ModNano:     member.ModNano,
+		RelPath:     archive.relativePath() + archiveSeparator + dir,
+		IsDir:       member.IsDir,
+		ContentType: detectContentType(nil, name),
+		Archive:     archive.fullPath(),
+		Member:      memberPath(member.Name),
+	}
+}
+
+// Members of recently used archives, listing a tar reads all of it
+var archiveIndexes = newIndexCache[[]*File](64)
+
+// Virtual Files for all members of the archive, read again once the
+// archive changed. Copies are returned, so the cached index is not
+// modified by callers.
+func archiveMemberFiles(archive *File) []*File {
+	index, err := archiveIndexes.get(archive, func() ([]*File, error) {
+		return readArchiveMemberFiles(archive)
+	})
+	if err != nil {
+		return nil
+	}
+	files := make([]*File, len(index))
+	for i, file := range index {
+		member := *file
+		files[i] = &member
+	}
+	return files
+}
+
+// Directories that are implied by member paths are added as well,
+// so the grouped listing can nest them.
+func readArchiveMemberFiles(archive *File) ([]*File, error) {
+	members, err := readArchiveMembers(archive.fullPath())
+	if err != nil {
+		return nil, err
+	}
+	files := []*File{}
+	seenDirs := make(map[string]bool)
+	for _, member := range members {
+		p := memberPath(member.Name)
+		if p == "" || (member.IsDir && seenDirs[p]) {
+			continue
+		}
+		for dir := path.Dir(p); dir != "." && !seenDirs[dir]; dir = path.Dir(dir) {
+			seenDirs[dir] = true
+			files = append(files, archiveMemberFile(archive, archiveMember{Name: dir, ModDate: member.ModDate, ModNano: member.ModNano, IsDir: true}))
+		}
+		if member.IsDir {
+			seenDirs[p] = true
+		}
+		files = append(files, archiveMemberFile(archive, member))
+	}
+	return files, nil
+}
+
+// Find a file by its relative path, including members of archives
+// addressed as archive!/member when they are not in the cache.
+func lookupFile(filename string) (*File, bool) {
+	if file, found := Cache.Get(filename); found {
+		return file, true
+	}
+	i := strings.Index(filename, archiveSeparator)
+	if i == -1 {
+		return nil, false
+	}
+	archive, found := Cache.Get(filename[:i])
+	if !found || archive.IsDir || !isArchiveName(archive.Name) {
+		return nil, false
+	}
+	member := memberPath(filename[i+len(archiveSeparator):])
+	for _, file := range archiveMemberFiles(archive) {
+		if file.Member == member {
+			return file, true
+		}
+	}
+	return nil, false
+}
+
+func serveArchiveMember(w http.ResponseWriter, r *http.Request, file *File) {
+	rc, size, err := openArchiveMember(file.Archive, file.Member)
+	if err != nil {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	if checkConditional(w, r, fileETag(file), time.Unix(file.ModDate, 0)) {
+		return
+	}
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, rc)
+}
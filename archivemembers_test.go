@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testTarGz(entries []testEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(testTar(entries))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestMemberPath(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected string
+	}{
+		{"a/b.txt", "a/b.txt"},
+		{"/a/b.txt", "a/b.txt"},
+		{"a/./b/", "a/b"},
+		{"a//b.txt", "a/b.txt"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"a/../../b.txt", "b.txt"},
+		{"..", ""},
+		{"", ""},
+		{"a\\..\\b", "a\\..\\b"},
+	}
+	for tcNumber, testcase := range testcases {
+		result := memberPath(testcase.name)
+		if result != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+func TestReadArchiveMembers(t *testing.T) {
+	dir := t.TempDir()
+	entries := []testEntry{
+		{name: "d/", data: ""},
+		{name: "d/a.txt", data: "hello"},
+		{name: "../b.txt", data: "world!"},
+		{name: "link", link: "d/a.txt"},
+	}
+	tarEntries := []testEntry{entries[1], entries[2], entries[3]}
+
+	testcases := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		// symlinks are kept out of tar listings, zip lists them as files
+		{"a.zip", testZip(entries), "d/ dir,d/a.txt 5,../b.txt 6,link 7"},
+		{"a.tar", testTar(tarEntries), "d/a.txt 5,../b.txt 6"},
+		{"a.tar.gz", testTarGz(tarEntries), "d/a.txt 5,../b.txt 6"},
+		{"a.tgz", testTarGz(tarEntries), "d/a.txt 5,../b.txt 6"},
+	}
+	for tcNumber, testcase := range testcases {
+		fp := filepath.Join(dir, testcase.name)
+		os.WriteFile(fp, testcase.data, 0644)
+		members, err := readArchiveMembers(fp)
+		result := []string{}
+		for _, member := range members {
+			if member.IsDir {
+				result = append(result, member.Name+" dir")
+			} else {
+				result = append(result, member.Name+" "+strconv.FormatInt(member.Size, 10))
+			}
+		}
+		if err != nil || strings.Join(result, ",") != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result, err)
+		}
+	}
+
+	// corrupt archives are errors
+	for _, name := range []string{"bad.zip", "bad.tar.gz"} {
+		fp := filepath.Join(dir, name)
+		os.WriteFile(fp, []byte("not an archive"), 0644)
+		if _, err := readArchiveMembers(fp); err == nil {
+			t.Error("expected an error for", name)
+		}
+	}
+}
+
+func TestOpenArchiveMember(t *testing.T) {
+	dir := t.TempDir()
+	entries := []testEntry{
+		{name: "d/a.txt", data: "hello"},
+		{name: "../b.txt", data: "world!"},
+	}
+	os.WriteFile(filepath.Join(dir, "a.zip"), testZip(append(entries, testEntry{name: "d/", data: ""})), 0644)
+	os.WriteFile(filepath.Join(dir, "a.tar.gz"), testTarGz(entries), 0644)
+
+	testcases := []struct {
+		archive  string
+		member   string
+		expected string
+		err      error
+	}{
+		{"a.zip", "d/a.txt", "hello", nil},
+		{"a.zip", "b.txt", "world!", nil},
+		{"a.zip", "d", "", errMemberNotFound},
+		{"a.zip", "missing.txt", "", errMemberNotFound},
+		{"a.tar.gz", "d/a.txt", "hello", nil},
+		{"a.tar.gz", "b.txt", "world!", nil},
+		{"a.tar.gz", "../b.txt", "", errMemberNotFound},
+		{"a.tar.gz", "missing.txt", "", errMemberNotFound},
+	}
+	for tcNumber, testcase := range testcases {
+		rc, size, err := openArchiveMember(filepath.Join(dir, testcase.archive), testcase.member)
+		result := ""
+		if err == nil {
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			result = string(data)
+		}
+		if err != testcase.err || result != testcase.expected || (err == nil && size != int64(len(result))) {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, testcase.err, "!=", result, size, err)
+		}
+	}
+}
+
+func TestArchiveMemberFilesCache(t *testing.T) {
+	base := t.TempDir()
+	fp := filepath.Join(base, "a.tar")
+	os.WriteFile(fp, testTar([]testEntry{{name: "x/y/a.txt", data: "hello"}}), 0644)
+	archive := &File{Name: "a.tar", AbsPath: base, RelPath: "/", Size: 1, ModDate: 1}
+
+	files := archiveMemberFiles(archive)
+	result := []string{}
+	for _, file := range files {
+		result = append(result, file.Member)
+	}
+	// implied directories come first, the deepest first
+	if strings.Join(result, ",") != "x/y,x,x/y/a.txt" || files[2].RelPath != "/a.tar!/x/y/" {
+		t.Fatal("unexpected members", result, files)
+	}
+	// callers get copies of the cached index
+	files[2].Name = "changed"
+	if archiveMemberFiles(archive)[2].Name != "a.txt" {
+		t.Error("cached index was modified")
+	}
+
+	// the same size and modification time is served from the cache
+	os.WriteFile(fp, testTar([]testEntry{{name: "b.txt", data: "world"}}), 0644)
+	if files := archiveMemberFiles(archive); len(files) != 3 {
+		t.Error("expected the cached index", files)
+	}
+	archive.ModDate = 2
+	if files := archiveMemberFiles(archive); len(files) != 1 || files[0].Member != "b.txt" {
+		t.Error("expected the archive to be read again", files)
+	}
+
+	// unreadable archives are not cached
+	archive.ModDate = 3
+	os.Remove(fp)
+	if files := archiveMemberFiles(archive); len(files) != 0 {
+		t.Error("expected no members", files)
+	}
+	os.WriteFile(fp, testTar([]testEntry{{name: "c.txt", data: "again"}}), 0644)
+	if files := archiveMemberFiles(archive); len(files) != 1 || files[0].Member != "c.txt" {
+		t.Error("expected the archive to be read after an error", files)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Number of changes kept, older generations are dropped first.
+const journalMaxChanges = 10000
+
+type journalEntry struct {
+	Cycle   int64
+	Changes []Change
+}
+
+// Bounded list of changes per cache generation.
+// Start is the oldest cycle changes are known from, callers hold the cache lock.
+type ChangeJournal struct {
+	start   int64
+	size    int
+	entries []journalEntry
+}
+
+func (j *ChangeJournal) Started() bool {
+	return j.start != 0
+}
+
+func (j *ChangeJournal) Start(cycle int64) {
+	j.start = cycle
+}
+
+func (j *ChangeJournal) Record(cycle int64, changes []Change) {
+	if !j.Started() || len(changes) == 0 {
+		return
+	}
+	j.entries = append(j.entries, journalEntry{Cycle: cycle, Changes: changes})
+	j.size += len(changes)
+	for j.size > journalMaxChanges && len(j.entries) > 1 {
+		j.start = j.entries[0].Cycle
+		j.size -= len(j.entries[0].Changes)
+		j.entries = j.entries[1:]
+	}
+}
+
+// Cycles below this are in the milliseconds of /cycle/,
+// cycles returned by /changes/ are in nanoseconds.
+const fullCycleMin = 1e15
+
+// Changes after cycle. Cycle is the full resolution Cycle of an earlier
+// /changes/ response, or the value of /cycle/, in which case the changes
+// made within that millisecond are returned again.
+func (j *ChangeJournal) Since(cycle int64) ([]Change, bool) {
+	if !j.Started() {
+		return nil, false
+	}
+	if cycle < fullCycleMin {
+		if cycle < j.start/1000000 {
+			return nil, false
+		}
+		cycle = max(cycle*1000000-1, j.start)
+	}
+	if cycle < j.start {
+		return nil, false
+	}
+	changes := []Change{}
+	for _, entry := range j.entries {
+		if entry.Cycle > cycle {
+			changes = append(changes, entry.Changes...)
+		}
+	}
+	return changes, true
+}
+
+type ChangesResponse struct {
+	Since    int64
+	Cycle    int64
+	Added    []ListFile
+	Modified []ListFile
+	Removed  []ListFile
+}
+
+// Reduce a sequence of changes to the net result per path,
+// a file added and removed again within the window is left out.
+func collapseChanges(changes []Change) (added, modified, removed []ListFile) {
+	const (
+		stateAdded = iota + 1
+		stateModified
+		stateRemoved
+	)
+	states := make(map[string]int)
+	files := make(map[string]*File)
+	apply := func(typ string, file *File) {
+		key := file.relativePath()
+		previous := states[key]
+		switch typ {
+		case EventCreated:
+			if previous == stateRemoved {
+				states[key] = stateModified
+			} else {
+				states[key] = stateAdded
+			}
+		case EventModified:
+			if previous != stateAdded {
+				states[key] = stateModified
+			}
+		case EventDeleted:
+			if previous == stateAdded {
+				delete(states, key)
+			} else {
+				states[key] = stateRemoved
+			}
+		}
+		files[key] = file
+	}
+	for _, change := range changes {
+		if change.Type == EventMoved {
+			apply(EventDeleted, change.From)
+			apply(EventCreated, change.File)
+			continue
+		}
+		apply(change.Type, change.File)
+	}
+
+	keys := make([]string, 0, len(states))
+	for key := range states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	added, modified, removed = []ListFile{}, []ListFile{}, []ListFile{}
+	for _, key := range keys {
+		switch states[key] {
+		case stateAdded:
+			added = append(added, files[key].ListFile())
+		case stateModified:
+			modified = append(modified, files[key].ListFile())
+		case stateRemoved:
+			removed = append(removed, files[key].ListFile())
+		}
+	}
+	return added, modified, removed
+}
+
+// Changes since the cycle given by /cycle/ or the Cycle of the previous
+// response, clients mirroring the listing apply these instead of
+// refetching /list/.
+// 410 Gone when the journal no longer reaches back to since.
+func changesRest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	setHeader(w)
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		ErrorResponse(w, "since is required, use the value of /cycle/", http.StatusBadRequest)
+		return
+	}
+	if checkListConditional(w, r) {
+		return
+	}
+	changes, cycle, ok := Cache.ChangesSince(since)
+	if !ok {
+		ErrorResponse(w, "Changes since cycle no longer available, refetch /list/", http.StatusGone)
+		return
+	}
+
+	added, modified, removed := collapseChanges(changes)
+	if dirs, dirsGiven := r.URL.Query()["dirs"]; dirsGiven {
+		added = filterDirs(added, dirs)
+		modified = filterDirs(modified, dirs)
+		removed = filterDirs(removed, dirs)
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, ChangesResponse{
+		Since:    since,
+		Cycle:    cycle,
+		Added:    added,
+		Modified: modified,
+		Removed:  removed,
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCollapseChanges(t *testing.T) {
+	a := &File{Name: "a.txt", RelPath: "/"}
+	b := &File{Name: "b.txt", RelPath: "/"}
+	c := &File{Name: "c.txt", RelPath: "/"}
+	d := &File{Name: "d.txt", RelPath: "/"}
+	moved := &File{Name: "d.txt", RelPath: "/moved/"}
+	changes := []Change{
+		{Type: EventCreated, File: a},
+		{Type: EventModified, File: a},
+		{Type: EventModified, File: b},
+		{Type: EventCreated, File: c},
+		{Type: EventDeleted, File: c},
+		{Type: EventMoved, File: moved, From: d},
+	}
+
+	added, modified, removed := collapseChanges(changes)
+	if len(added) != 2 || added[0].Name != "a.txt" || added[1].Directories[0] != "moved" {
+		t.Error("unexpected added", added)
+	}
+	if len(modified) != 1 || modified[0].Name != "b.txt" {
+		t.Error("unexpected modified", modified)
+	}
+	if len(removed) != 1 || removed[0].Name != "d.txt" {
+		t.Error("unexpected removed", removed)
+	}
+}
+
+func TestChangeJournal(t *testing.T) {
+	// nanoseconds as recorded by the cache, 2020-09-13T12:26:40Z
+	const ms = int64(1000000)
+	const start = 1600000000000 * ms
+	j := ChangeJournal{}
+	file := &File{Name: "a.txt", RelPath: "/"}
+	j.Record(start, []Change{{Type: EventCreated, File: file}})
+	if _, ok := j.Since(0); ok {
+		t.Error("journal that is not started has no changes")
+	}
+
+	j.Start(start)
+	for i := int64(2); i <= 4; i++ {
+		j.Record(start+i*ms, []Change{{Type: EventModified, File: file}})
+	}
+	// a change within the same millisecond as the previous one
+	j.Record(start+4*ms+1, []Change{{Type: EventDeleted, File: file}})
+
+	testcases := []struct {
+		since     int64
+		expected  int
+		available bool
+	}{
+		{start, 4, true},
+		{start + 2*ms, 3, true},
+		{start + 4*ms, 1, true},
+		{start + 4*ms + 1, 0, true},
+		{start - 1, 0, false},
+		// milliseconds of /cycle/ include the changes within that millisecond
+		{start / ms, 4, true},
+		{start/ms + 4, 2, true},
+		{start/ms + 5, 0, true},
+		{start/ms - 1, 0, false},
+	}
+	for tcNumber, testcase := range testcases {
+		changes, ok := j.Since(testcase.since)
+		if len(changes) != testcase.expected || ok != testcase.available {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, testcase.available, "!=", len(changes), ok)
+		}
+	}
+
+	j.Record(start+5*ms, make([]Change, journalMaxChanges))
+	if _, ok := j.Since(start + 3*ms); ok {
+		t.Error("trimmed changes should not be available")
+	}
+	if changes, ok := j.Since(start + 4*ms + 1); !ok || len(changes) != journalMaxChanges {
+		t.Error("expected latest changes after trimming", len(changes), ok)
+	}
+}
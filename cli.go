@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Attumm/silo/client"
+)
+
+// Flags shared by the client commands
+type cliOptions struct {
+	server  *string
+	token   *string
+	json    *bool
+	flags   *flag.FlagSet
+	client  *client.Client
+	ctx     context.Context
+	usage   string
+	minArgs int
+	// SILO_TOKEN and SILO_TOKEN_FILE both set, or an unreadable file
+	tokenErr error
+}
+
+func newCLI(name, usage string, minArgs int) *cliOptions {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := os.Getenv("SILO_SERVER")
+	if server == "" {
+		server = "http://localhost:8000"
+	}
+	token, _, _, tokenErr := LookupEnvSecret("SILO_TOKEN")
+	o := &cliOptions{
+		server:   flags.String("server", server, "silo server url, or SILO_SERVER"),
+		token:    flags.String("token", token, "bearer token, or SILO_TOKEN or SILO_TOKEN_FILE"),
+		json:     flags.Bool("json", false, "print JSON instead of a table"),
+		flags:    flags,
+		usage:    usage,
+		minArgs:  minArgs,
+		tokenErr: tokenErr,
+	}
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: silo "+name+" [flags] "+usage)
+		flags.PrintDefaults()
+	}
+	return o
+}
+
+// Parse the arguments and connect, false on invalid input
+func (o *cliOptions) parse(args []string) bool {
+	if err := o.flags.Parse(args); err != nil {
+		return false
+	}
+	if o.flags.NArg() < o.minArgs {
+		o.flags.Usage()
+		return false
+	}
+	if o.tokenErr != nil {
+		fmt.Fprintln(os.Stderr, o.tokenErr)
+		return false
+	}
+	c, err := client.New(*o.server, client.Options{Token: *o.token})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	o.client = c
+	o.ctx = context.Background()
+	return true
+}
+
+func printItems(items []client.ListFile, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(items)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tSIZE\tMODIFIED\tPATH")
+	for _, item := range items {
+		kind := item.ContentType
+		size := humanBytes(item.SizeBytes)
+		if item.IsDir {
+			kind, size = "dir", "-"
+		}
+		modified := time.Unix(item.ModDate, 0).Format("2006-01-02 15:04")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", strings.Split(kind, ";")[0], size, modified, item.Path())
+	}
+	tw.Flush()
+}
+
+func humanBytes(s string) string {
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return s
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// Remote files matching the pattern, a plain path matches itself.
+func matchRemote(ctx context.Context, c *client.Client, pattern string) ([]client.ListFile, error) {
+	pattern = strings.Trim(pattern, "/")
+	options := client.ListOptions{}
+	for _, dir := range removeEmpty(strings.Split(path.Dir(pattern), "/")) {
+		if isGlob(dir) {
+			break
+		}
+		options.Dirs = append(options.Dirs, dir)
+	}
+	items, err := c.List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	matched := []client.ListFile{}
+	for _, item := range items {
+		if ok, _ := path.Match(pattern, item.Path()); ok {
+			matched = append(matched, item)
+		}
+	}
+	return matched, nil
+}
+
+// Progress bar on stderr, only drawn when stderr is a terminal
+type progressBar struct {
+	name    string
+	total   int64
+	done    int64
+	drawn   time.Time
+	enabled bool
+}
+
+func newProgressBar(name string, total int64) *progressBar {
+	info, err := os.Stderr.Stat()
+	return &progressBar{
+		name:    name,
+		total:   total,
+		enabled: err == nil && info.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+func (p *progressBar) draw() {
+	if !p.enabled {
+		return
+	}
+	p.drawn = time.Now()
+	const width = 30
+	filled := width
+	percent := 100
+	if p.total > 0 {
+		filled = int(p.done * width / p.total)
+		percent = int(p.done * 100 / p.total)
+	}
+	if filled > width {
+		filled = width
+	}
+	fmt.Fprintf(os.Stderr, "\r%-30.30s [%s%s] %3d%% %s",
+		p.name, strings.Repeat("#", filled), strings.Repeat(" ", width-filled), percent,
+		humanBytes(strconv.FormatInt(p.done, 10)))
+}
+
+func (p *progressBar) finish() {
+	if !p.enabled {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+// silo ls [dir]
+func lsCommand(args []string) int {
+	o := newCLI("ls", "[dir]", 0)
+	recursive := o.flags.Bool("r", false, "list recursively")
+	if !o.parse(args) {
+		return 2
+	}
+	dirs := removeEmpty(strings.Split(o.flags.Arg(0), "/"))
+	items, err := o.client.List(o.ctx, client.ListOptions{Dirs: dirs, OrderBy: "name"})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*recursive {
+		direct := []client.ListFile{}
+		for _, item := range items {
+			if len(item.Directories) == len(dirs) {
+				direct = append(direct, item)
+			}
+		}
+		items = direct
+	}
+	printItems(items, *o.json)
+	return 0
+}
+
+// silo find <term>
+func findCommand(args []string) int {
+	o := newCLI("find", "<term>", 1)
+	contentType := o.flags.String("type", "", "only files with a content type starting with this, image/")
+	if !o.parse(args) {
+		return 2
+	}
+	items, err := o.client.List(o.ctx, client.ListOptions{Filter: o.flags.Args(), OrderBy: "name"})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	found := []client.ListFile{}
+	for _, item := range items {
+		if strings.HasPrefix(item.ContentType, *contentType) {
+			found = append(found, item)
+		}
+	}
+	printItems(found, *o.json)
+	return 0
+}
+
+// silo get <remote path or glob>...
+func getCommand(args []string) int {
+	o := newCLI("get", "<remote path or glob>...", 1)
+	output := o.flags.String("o", ".", "local directory to store the files in")
+	if !o.parse(args) {
+		return 2
+	}
+	failed := 0
+	// Files are stored by name only, a second file with the same name
+	// from another directory is refused instead of overwriting the first.
+	taken := make(map[string]string)
+	for _, pattern := range o.flags.Args() {
+		items, err := matchRemote(o.ctx, o.client, pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(items) == 0 {
+			fmt.Fprintln(os.Stderr, "no such file", pattern)
+			failed++
+		}
+		for _, item := range items {
+			if item.IsDir {
+				fmt.Fprintln(os.Stderr, item.Path(), "is a directory, use silo sync")
+				continue
+			}
+			// The name comes from the server, it must stay within output
+			fp, ok := mirrorPath(*output, client.ListFile{Name: item.Name})
+			if !ok {
+				fmt.Fprintf(os.Stderr, "%s has an invalid name %q\n", item.Path(), item.Name)
+				failed++
+				continue
+			}
+			if other, found := taken[fp]; found {
+				if other != item.Path() {
+					fmt.Fprintln(os.Stderr, item.Path(), "has the same name as", other+", not stored")
+					failed++
+				}
+				continue
+			}
+			taken[fp] = item.Path()
+			if err := getFile(o.ctx, o.client, item, fp); err != nil {
+				fmt.Fprintln(os.Stderr, item.Path(), err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func getFile(ctx context.Context, c *client.Client, item client.ListFile, fp string) error {
+	content, err := c.OpenFrom(ctx, item.Path(), 0, "")
+	if err != nil {
+		return err
+	}
+	defer content.Body.Close()
+	f, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	bar := newProgressBar(item.Name, content.Size)
+	_, err = io.Copy(io.MultiWriter(f, bar), content.Body)
+	bar.finish()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Local files to upload with their relative name, directories are
+// walked when recursive is set.
+func uploadFiles(args []string, recursive bool) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			matches = []string{arg}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				files[match] = filepath.Base(match)
+				continue
+			}
+			if !recursive {
+				return nil, fmt.Errorf("%s is a directory, use -r", match)
+			}
+			parent := filepath.Dir(filepath.Clean(match))
+			err = filepath.Walk(match, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(parent, p)
+				files[p] = filepath.ToSlash(rel)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// silo put [-dirs a/b] <local files>...
+func putCommand(args []string) int {
+	o := newCLI("put", "<local file or glob>...", 1)
+	dirs := o.flags.String("dirs", "", "remote directory to upload into, a/b")
+	recursive := o.flags.Bool("r", false, "upload directories recursively")
+	if !o.parse(args) {
+		return 2
+	}
+	files, err := uploadFiles(o.flags.Args(), *recursive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// When every file failed the results tell why per file
+	responses, err := putFiles(o.ctx, o.client, files, removeEmpty(strings.Split(*dirs, "/")))
+	if err != nil && len(responses) == 0 {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	failed := 0
+	if *o.json {
+		json.NewEncoder(os.Stdout).Encode(responses)
+	}
+	for _, response := range responses {
+		if response.Error != "" {
+			fmt.Fprintln(os.Stderr, response.Filename, response.Error)
+			failed++
+		} else if !*o.json {
+			fmt.Println(strings.Join(append(response.Directories, response.Filename), "/"))
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Upload all files in one streamed multipart request
+func putFiles(ctx context.Context, c *client.Client, files map[string]string, dirs []string) ([]client.UploadResult, error) {
+	total := int64(0)
+	for local := range files {
+		if info, err := os.Stat(local); err == nil {
+			total += info.Size()
+		}
+	}
+	bar := newProgressBar("upload", total)
+	uploads := []client.UploadFile{}
+	for local, name := range files {
+		uploads = append(uploads, client.UploadFile{Name: name, Reader: &localFile{path: local, progress: bar}})
+	}
+	results, err := c.Upload(ctx, dirs, uploads...)
+	bar.finish()
+	return results, err
+}
+
+// Local file opened on the first read and closed at the end,
+// so a large upload does not hold every file open.
+type localFile struct {
+	path     string
+	progress io.Writer
+	f        *os.File
+}
+
+func (l *localFile) Read(p []byte) (int, error) {
+	if l.f == nil {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return 0, err
+		}
+		l.f = f
+	}
+	n, err := l.f.Read(p)
+	l.progress.Write(p[:n])
+	if err != nil {
+		l.f.Close()
+	}
+	return n, err
+}
+
+// silo rm <remote path or glob>...
+func rmCommand(args []string) int {
+	o := newCLI("rm", "<remote path or glob>...", 1)
+	if !o.parse(args) {
+		return 2
+	}
+	failed := 0
+	for _, pattern := range o.flags.Args() {
+		items, err := matchRemote(o.ctx, o.client, pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(items) == 0 {
+			fmt.Fprintln(os.Stderr, "no such file", pattern)
+			failed++
+		}
+		for _, item := range items {
+			if err := o.client.Delete(o.ctx, item.Path()); err != nil {
+				fmt.Fprintln(os.Stderr, item.Path(), err)
+				failed++
+				continue
+			}
+			fmt.Println("removed", item.Path())
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// silo mv <from> <to>
+func mvCommand(args []string) int {
+	o := newCLI("mv", "<from> <to>", 2)
+	if !o.parse(args) {
+		return 2
+	}
+	item, err := o.client.Move(o.ctx, o.flags.Arg(0), o.flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if item != nil {
+		printItems([]client.ListFile{*item}, *o.json)
+	}
+	return 0
+}
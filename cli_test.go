@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Attumm/silo/client"
+)
+
+// Stands in for a silo server, the listing is served as given and
+// every request is recorded.
+type fakeSilo struct {
+	items []ListFile
+
+	mu       sync.Mutex
+	requests []string
+	uploaded map[string]string
+}
+
+func (f *fakeSilo) record(r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+}
+
+func (f *fakeSilo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.record(r)
+	switch {
+	case r.URL.Path == "/list/":
+		json.NewEncoder(w).Encode(f.items)
+	case strings.HasPrefix(r.URL.Path, "/content/"):
+		io.WriteString(w, "data of "+strings.TrimPrefix(r.URL.Path, "/content/"))
+	case strings.HasPrefix(r.URL.Path, "/delete/") && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/move/") && r.Method == http.MethodPost:
+		to := removeEmpty(strings.Split(r.FormValue("to"), "/"))
+		json.NewEncoder(w).Encode(ListFile{Name: to[len(to)-1], Directories: to[:len(to)-1]})
+	case r.URL.Path == "/upload/" && r.Method == http.MethodPost:
+		reader, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dirs := []string{}
+		responses := []UploadSuccesResponse{}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			if part.FormName() == "dirs[]" {
+				dirs = append(dirs, string(data))
+				continue
+			}
+			f.mu.Lock()
+			f.uploaded[strings.Join(append(append([]string{}, dirs...), part.FileName()), "/")] = string(data)
+			f.mu.Unlock()
+			responses = append(responses, UploadSuccesResponse{Filename: part.FileName(), Directories: dirs})
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(responses)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorMsg{Reason: "not found"})
+	}
+}
+
+// Stdout of fn, the commands print their results
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-done
+}
+
+func TestCLICommands(t *testing.T) {
+	silo := &fakeSilo{
+		items: []ListFile{
+			{Name: "a", IsDir: true, Directories: []string{}},
+			{Name: "b", IsDir: true, Directories: []string{}},
+			{Name: "p.jpg", ContentType: "image/jpeg", Directories: []string{"a"}},
+			{Name: "p.jpg", ContentType: "image/jpeg", Directories: []string{"b"}},
+			{Name: "q.txt", ContentType: "text/plain", Directories: []string{"a"}},
+			{Name: "top.txt", ContentType: "text/plain", Directories: []string{}},
+			{Name: "..", Directories: []string{"evil"}},
+			{Name: `x\..\..\y`, Directories: []string{"evil"}},
+		},
+		uploaded: make(map[string]string),
+	}
+	server := httptest.NewServer(silo)
+	defer server.Close()
+
+	local := t.TempDir()
+	os.WriteFile(filepath.Join(local, "up.txt"), []byte("uploaded"), 0644)
+
+	testcases := []struct {
+		command  func([]string) int
+		args     []string
+		exit     int
+		stdout   []string
+		requests []string
+		files    []string
+	}{
+		// ls lists the direct children, -r everything below
+		{lsCommand, []string{"a"}, 0, []string{"a/p.jpg", "a/q.txt"}, []string{"GET /list/"}, nil},
+		{lsCommand, []string{"-r"}, 0, []string{"a/p.jpg", "b/p.jpg", "top.txt"}, []string{"GET /list/"}, nil},
+		{findCommand, []string{"-type", "text/", "txt"}, 0, []string{"a/q.txt", "top.txt"}, []string{"GET /list/"}, nil},
+		// glob within a directory
+		{getCommand, []string{"a/*.txt"}, 0, nil,
+			[]string{"GET /list/", "GET /content/a/q.txt"}, []string{"q.txt"}},
+		{getCommand, []string{"top.txt"}, 0, nil,
+			[]string{"GET /list/", "GET /content/top.txt"}, []string{"top.txt"}},
+		{getCommand, []string{"missing.txt"}, 1, nil, []string{"GET /list/"}, []string{}},
+		// the second p.jpg would overwrite the first
+		{getCommand, []string{"*/p.jpg"}, 1, nil,
+			[]string{"GET /list/", "GET /content/a/p.jpg"}, []string{"p.jpg"}},
+		// the same file twice is stored once
+		{getCommand, []string{"a/q.txt", "a/*.txt"}, 0, nil,
+			[]string{"GET /list/", "GET /content/a/q.txt", "GET /list/"}, []string{"q.txt"}},
+		// names from the server must stay within the output directory
+		{getCommand, []string{"evil/*"}, 1, nil, []string{"GET /list/"}, []string{}},
+		{rmCommand, []string{"a/*"}, 0, []string{"removed a/p.jpg", "removed a/q.txt"},
+			[]string{"GET /list/", "DELETE /delete/a/p.jpg", "DELETE /delete/a/q.txt"}, nil},
+		{mvCommand, []string{"top.txt", "b/moved.txt"}, 0, []string{"b/moved.txt"},
+			[]string{"POST /move/top.txt"}, nil},
+		{putCommand, []string{"-dirs", "x/y", filepath.Join(local, "up.txt")}, 0, []string{"x/y/up.txt"},
+			[]string{"POST /upload/"}, nil},
+		// missing arguments
+		{mvCommand, []string{"top.txt"}, 2, nil, nil, nil},
+	}
+
+	for tcNumber, testcase := range testcases {
+		silo.requests = nil
+		output := t.TempDir()
+		args := append([]string{"-server", server.URL}, testcase.args...)
+		if testcase.files != nil {
+			args = append([]string{"-o", output}, args...)
+		}
+		exit := 0
+		stdout := captureStdout(t, func() {
+			exit = testcase.command(args)
+		})
+		if exit != testcase.exit {
+			t.Error("testcase", tcNumber, "expected exit", testcase.exit, "!=", exit)
+		}
+		for _, line := range testcase.stdout {
+			if !strings.Contains(stdout, line) {
+				t.Error("testcase", tcNumber, "expected", line, "in", stdout)
+			}
+		}
+		if strings.Join(silo.requests, ",") != strings.Join(testcase.requests, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.requests, "!=", silo.requests)
+		}
+		files := testFiles(output)
+		sort.Strings(testcase.files)
+		if strings.Join(files, ",") != strings.Join(testcase.files, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.files, "!=", files)
+		}
+		for _, name := range files {
+			data, _ := os.ReadFile(filepath.Join(output, name))
+			if !strings.HasPrefix(string(data), "data of ") {
+				t.Error("testcase", tcNumber, "unexpected content", string(data))
+			}
+		}
+	}
+	if silo.uploaded["x/y/up.txt"] != "uploaded" {
+		t.Error("upload not received", silo.uploaded)
+	}
+	// nothing escaped the temporary directories
+	if _, err := os.Stat(filepath.Join(filepath.Dir(local), "y")); err == nil {
+		t.Error("file written outside of the output directory")
+	}
+}
+
+func TestRemoteMatch(t *testing.T) {
+	silo := &fakeSilo{items: []ListFile{
+		{Name: "a.jpg", Directories: []string{"x"}},
+		{Name: "b.png", Directories: []string{"x"}},
+		{Name: "a.jpg", Directories: []string{"x", "y"}},
+		{Name: "a.jpg", Directories: []string{}},
+	}}
+	server := httptest.NewServer(silo)
+	defer server.Close()
+	c, _ := client.New(server.URL, client.Options{})
+
+	testcases := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"x/a.jpg", []string{"x/a.jpg"}},
+		{"/x/a.jpg/", []string{"x/a.jpg"}},
+		{"x/*", []string{"x/a.jpg", "x/b.png"}},
+		{"*/a.jpg", []string{"x/a.jpg"}},
+		{"*/*/a.jpg", []string{"x/y/a.jpg"}},
+		{"x/[ab].*", []string{"x/a.jpg", "x/b.png"}},
+		{"*.jpg", []string{"a.jpg"}},
+		{"z/*", []string{}},
+	}
+
+	for tcNumber, testcase := range testcases {
+		items, err := matchRemote(context.Background(), c, testcase.pattern)
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.Path())
+		}
+		if err != nil || strings.Join(result, ",") != strings.Join(testcase.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result, err)
+		}
+	}
+}
+
+// Real responses decode into the client types without unknown fields,
+// so the client can not drift from the server.
+func TestClientTypes(t *testing.T) {
+	setupArchiveBase(t)
+	mux := http.NewServeMux()
+	routes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	upload, uploadType := multipartBody("docs", "e.txt", "upload")
+	failed, failedType := multipartBody("docs", "..", "upload")
+	testcases := []struct {
+		method      string
+		path        string
+		body        io.Reader
+		contentType string
+		into        interface{}
+		status      int
+	}{
+		{"GET", "/list/", nil, "", &[]client.ListFile{}, 200},
+		{"GET", "/detail/docs/b.txt", nil, "", &client.ListFile{}, 200},
+		{"GET", "/changes/?since=" + strconv.FormatInt(Cache.LastCycle(), 10), nil, "", &client.Changes{}, 200},
+		{"POST", "/upload/", upload, uploadType, &[]client.UploadResult{}, 201},
+		{"POST", "/upload/", failed, failedType, &[]client.UploadResult{}, 400},
+	}
+
+	for tcNumber, testcase := range testcases {
+		req, _ := http.NewRequest(testcase.method, server.URL+testcase.path, testcase.body)
+		if testcase.contentType != "" {
+			req.Header.Set("Content-Type", testcase.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("testcase", tcNumber, err)
+		}
+		dec := json.NewDecoder(resp.Body)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(testcase.into)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != testcase.status {
+			t.Error("testcase", tcNumber, "expected", testcase.status, "!=", resp.StatusCode, err)
+		}
+	}
+
+	// When every file fails the results come with an error
+	c, _ := client.New(server.URL, client.Options{})
+	results, err := c.Upload(context.Background(), []string{"docs"}, client.UploadFile{Name: "..", Reader: strings.NewReader("x")})
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != 400 || e.Code != "bad-request" {
+		t.Error("expected a bad-request error !=", err)
+	}
+	if len(results) != 1 || results[0].Status != 400 || results[0].Code != "bad-request" {
+		t.Error("expected the failed file in the results !=", results)
+	}
+}
+
+func TestCLITokenFromEnv(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(fp, []byte("from-file\n"), 0600)
+	defer os.Unsetenv("SILO_TOKEN")
+	defer os.Unsetenv("SILO_TOKEN_FILE")
+
+	testcases := []struct {
+		env      map[string]string
+		expected string
+		ok       bool
+	}{
+		{map[string]string{}, "", true},
+		{map[string]string{"SILO_TOKEN": "from-env"}, "from-env", true},
+		{map[string]string{"SILO_TOKEN_FILE": fp}, "from-file", true},
+		{map[string]string{"SILO_TOKEN": "from-env", "SILO_TOKEN_FILE": fp}, "", false},
+		{map[string]string{"SILO_TOKEN_FILE": fp + "-missing"}, "", false},
+	}
+	for tcNumber, test := range testcases {
+		os.Unsetenv("SILO_TOKEN")
+		os.Unsetenv("SILO_TOKEN_FILE")
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+		o := newCLI("ls", "", 0)
+		ok := o.parse([]string{"-server", "http://localhost:1"})
+		if ok != test.ok || *o.token != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, test.ok, "!=", *o.token, ok)
+		}
+	}
+}
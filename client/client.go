@@ -0,0 +1,372 @@
+// Package client talks to a silo server over its REST API.
+//
+//	c, err := client.New("http://localhost:8000", client.Options{})
+//	files, err := c.List(ctx, client.ListOptions{Dirs: []string{"photos"}})
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// Send as bearer token
+	Token string
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Retries of idempotent requests on network errors and 5xx responses
+	Retries int
+	// Delay before the first retry, doubled for every next retry
+	RetryDelay time.Duration
+}
+
+type Client struct {
+	base    string
+	options Options
+	http    *http.Client
+}
+
+func New(baseURL string, options Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("silo: invalid base url %q", baseURL)
+	}
+	if options.RetryDelay == 0 {
+		options.RetryDelay = 200 * time.Millisecond
+	}
+	c := &Client{
+		base:    strings.TrimRight(baseURL, "/"),
+		options: options,
+		http:    options.HTTPClient,
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c, nil
+}
+
+// URL of an endpoint for a path, each segment is escaped
+func (c *Client) fileURL(endpoint, path string) string {
+	segments := []string{}
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, url.PathEscape(segment))
+		}
+	}
+	return c.base + "/" + endpoint + "/" + strings.Join(segments, "/")
+}
+
+func decodeError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	return errorFromBody(resp.StatusCode, body)
+}
+
+func errorFromBody(statusCode int, body []byte) error {
+	msg := errorMsg{}
+	json.Unmarshal(body, &msg)
+	if msg.Detail != "" {
+		msg.Reason = msg.Detail
+	}
+	return &Error{StatusCode: statusCode, Code: msg.Code, Reason: msg.Reason}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// Do a request without body, retried when idempotent.
+// The caller closes the body of a successful response.
+func (c *Client) do(ctx context.Context, method, u string, header http.Header) (*http.Response, error) {
+	idempotent := method == http.MethodGet || method == http.MethodHead || method == http.MethodDelete
+	delay := c.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := c.send(req)
+		if !idempotent || attempt >= c.options.Retries || !retryable(resp, err) {
+			return c.checkResponse(resp, err)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+	return c.http.Do(req)
+}
+
+func (c *Client) checkResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Query parameters of /list/, empty fields are left out
+type ListOptions struct {
+	Filter   []string
+	Exclude  []string
+	Dirs     []string
+	OrderBy  string
+	Limit    int
+	Page     int
+	PageSize int
+}
+
+func (o ListOptions) values() url.Values {
+	query := url.Values{}
+	query["filter"] = o.Filter
+	query["exclude"] = o.Exclude
+	query["dirs"] = o.Dirs
+	if o.OrderBy != "" {
+		query.Set("orderby", o.OrderBy)
+	}
+	for key, n := range map[string]int{"limit": o.Limit, "page": o.Page, "pagesize": o.PageSize} {
+		if n > 0 {
+			query.Set(key, strconv.Itoa(n))
+		}
+	}
+	for key, values := range query {
+		if len(values) == 0 {
+			delete(query, key)
+		}
+	}
+	return query
+}
+
+func (c *Client) List(ctx context.Context, options ListOptions) ([]ListFile, error) {
+	files := []ListFile{}
+	err := c.getJSON(ctx, c.base+"/list/?"+options.values().Encode(), &files)
+	return files, err
+}
+
+// Detail of a file, archives include their members
+func (c *Client) Detail(ctx context.Context, path string) (*ListFile, error) {
+	file := &ListFile{}
+	if err := c.getJSON(ctx, c.fileURL("detail", path), file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Current cycle of the server, to use with Changes
+func (c *Client) Cycle(ctx context.Context) (int64, error) {
+	cycle := ""
+	if err := c.getJSON(ctx, c.base+"/cycle/", &cycle); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(cycle, 10, 64)
+}
+
+// Changes since a cycle, continue with the Cycle of the result.
+// ErrGone when the server no longer has them
+func (c *Client) Changes(ctx context.Context, since int64) (*Changes, error) {
+	changes := &Changes{}
+	if err := c.getJSON(ctx, c.base+"/changes/?since="+strconv.FormatInt(since, 10), changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// An error when the server is not ready to serve its listing, such as
+// during the first sync. Servers without /readyz are taken as ready.
+func (c *Client) Ready(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, c.base+"/readyz", nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open the content of a file, the caller closes the reader
+func (c *Client) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	content, err := c.OpenFrom(ctx, path, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return content.Body, nil
+}
+
+// Content of a file, Body starts at Offset within the file
+type Content struct {
+	Body io.ReadCloser
+	// Length of Body, -1 when unknown
+	Size   int64
+	Offset int64
+	ETag   string
+}
+
+// Open the content of a file from offset on, to resume a download.
+// The whole file is returned, with Offset 0, when its ETag is no
+// longer etag. The caller closes the Body.
+func (c *Client) OpenFrom(ctx context.Context, path string, offset int64, etag string) (*Content, error) {
+	header := http.Header{}
+	if offset > 0 && etag != "" {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		header.Set("If-Range", etag)
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.fileURL("content", path), header)
+	if err != nil {
+		return nil, err
+	}
+	content := &Content{Body: resp.Body, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	if resp.StatusCode == http.StatusPartialContent {
+		content.Offset = offset
+	}
+	return content, nil
+}
+
+// Download the content of a file into w, returns the bytes written
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) (int64, error) {
+	body, err := c.Open(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return io.Copy(w, body)
+}
+
+func (c *Client) Delete(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.fileURL("delete", path), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move or rename a file or directory, to is relative to the server base.
+// Returns the moved file, nil when the server does not send it.
+func (c *Client) Move(ctx context.Context, path, to string) (*ListFile, error) {
+	form := url.Values{"to": {to}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.fileURL("move", path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.checkResponse(c.send(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	file := &ListFile{}
+	if err := json.NewDecoder(resp.Body).Decode(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// File to upload, Name may contain a relative path, a/b.txt
+type UploadFile struct {
+	Name   string
+	Reader io.Reader
+}
+
+// Upload files into dirs in one streamed request.
+// Uploads are not retried, the readers can only be read once.
+// Failures of single files are reported in the results, when every
+// file failed the results are returned together with an *Error.
+func (c *Client) Upload(ctx context.Context, dirs []string, files ...UploadFile) ([]UploadResult, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			for _, dir := range dirs {
+				if err := mw.WriteField("dirs[]", dir); err != nil {
+					return err
+				}
+			}
+			for _, file := range files {
+				part, err := mw.CreateFormFile("uploadfile", file.Name)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(part, file.Reader); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/upload/", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.send(req)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	results := []UploadResult{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		if resp.StatusCode >= 400 {
+			return nil, errorFromBody(resp.StatusCode, body)
+		}
+		return nil, &Error{StatusCode: resp.StatusCode}
+	}
+	if resp.StatusCode >= 400 {
+		e := &Error{StatusCode: resp.StatusCode}
+		if len(results) > 0 {
+			e.Code, e.Reason = results[0].Code, results[0].Error
+		}
+		return results, e
+	}
+	return results, nil
+}
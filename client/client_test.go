@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListOptionsValues(t *testing.T) {
+	tests := []struct {
+		options  ListOptions
+		expected string
+	}{
+		{ListOptions{}, ""},
+		{ListOptions{Dirs: []string{"a", "b"}}, "dirs=a&dirs=b"},
+		{ListOptions{OrderBy: "-size", Limit: 5}, "limit=5&orderby=-size"},
+		{ListOptions{Filter: []string{"name:x"}, Page: 2, PageSize: 10}, "filter=name%3Ax&page=2&pagesize=10"},
+	}
+	for tcNumber, test := range tests {
+		result := test.options.values().Encode()
+		if result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"type":"/api/v1/problems/not-found","title":"Not found","status":404,"detail":"File not found","code":"not-found"}`))
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{})
+	_, err := c.Detail(context.Background(), "missing.txt")
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound != ", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Reason != "File not found" || e.Code != "not-found" {
+		t.Error("expected reason File not found !=", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode([]ListFile{{Name: "a.txt", Directories: []string{"x"}}})
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{Retries: 2, RetryDelay: time.Millisecond})
+	files, err := c.List(context.Background(), ListOptions{})
+	if err != nil || len(files) != 1 || files[0].Path() != "x/a.txt" {
+		t.Error("expected x/a.txt !=", files, err)
+	}
+	if calls != 3 {
+		t.Error("expected 3 calls !=", calls)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	stored := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/upload/":
+			reader, _ := r.MultipartReader()
+			dir := ""
+			results := []UploadResult{}
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				content, _ := io.ReadAll(part)
+				if part.FormName() == "dirs[]" {
+					dir = string(content)
+					continue
+				}
+				stored["/content/"+dir+"/"+part.FileName()] = string(content)
+				results = append(results, UploadResult{Message: "Upload successful", Filename: part.FileName()})
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(results)
+		case r.Method == http.MethodGet:
+			fmt.Fprint(w, stored[r.URL.Path])
+		}
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{})
+	results, err := c.Upload(context.Background(), []string{"docs"}, UploadFile{"a b.txt", strings.NewReader("hello")})
+	if err != nil || len(results) != 1 || results[0].Filename != "a b.txt" {
+		t.Error("expected upload of a b.txt !=", results, err)
+	}
+	buf := &bytes.Buffer{}
+	n, err := c.Download(context.Background(), "docs/a b.txt", buf)
+	if err != nil || n != 5 || buf.String() != "hello" {
+		t.Error("expected hello !=", buf.String(), err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if r.Header.Get("Last-Event-ID") == "" {
+			fmt.Fprint(w, ": heartbeat\n\n")
+			fmt.Fprint(w, "id: 1\nevent: created\ndata: {\"ID\":1,\"Type\":\"created\",\"File\":{\"Name\":\"a.txt\"}}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, Options{RetryDelay: time.Millisecond})
+	events := []Event{}
+	stop := errors.New("stop")
+	err := c.Watch(context.Background(), WatchOptions{}, func(event Event) error {
+		events = append(events, event)
+		if len(events) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Error("expected stop !=", err)
+	}
+	if len(events) != 2 || events[0].File.Name != "a.txt" || events[1].Type != EventReset {
+		t.Error("expected created and reset !=", events)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Watch(ctx, WatchOptions{}, func(Event) error { return nil }); err != context.Canceled {
+		t.Error("expected context.Canceled !=", err)
+	}
+}
+
+func TestMoveReadyAndResume(t *testing.T) {
+	ready := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/readyz":
+			w.WriteHeader(ready)
+		case r.URL.Path == "/move/a.txt":
+			r.ParseForm()
+			json.NewEncoder(w).Encode(ListFile{Name: "b.txt", Directories: strings.Split(r.Form.Get("to"), "/")[:1]})
+		case r.URL.Path == "/content/a.txt":
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader("hello world"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	c, _ := New(server.URL, Options{})
+	ctx := context.Background()
+
+	if err := c.Ready(ctx); !errors.Is(err, &Error{StatusCode: http.StatusServiceUnavailable}) {
+		t.Error("expected 503 !=", err)
+	}
+	ready = http.StatusOK
+	if err := c.Ready(ctx); err != nil {
+		t.Error("expected ready !=", err)
+	}
+
+	file, err := c.Move(ctx, "a.txt", "x/b.txt")
+	if err != nil || file.Path() != "x/b.txt" {
+		t.Error("expected x/b.txt !=", file, err)
+	}
+	if _, err := c.Move(ctx, "missing.txt", "b.txt"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound !=", err)
+	}
+
+	tests := []struct {
+		offset   int64
+		etag     string
+		expected string
+		start    int64
+	}{
+		{0, "", "hello world", 0},
+		{6, `"v1"`, "world", 6},
+		// changed since, the whole file is sent
+		{6, `"v0"`, "hello world", 0},
+	}
+	for tcNumber, test := range tests {
+		content, err := c.OpenFrom(ctx, "a.txt", test.offset, test.etag)
+		if err != nil {
+			t.Fatal("testcase", tcNumber, err)
+		}
+		data, _ := io.ReadAll(content.Body)
+		content.Body.Close()
+		if string(data) != test.expected || content.Offset != test.start || content.ETag != `"v1"` {
+			t.Error("testcase", tcNumber, "expected", test.expected, test.start, "!=", string(data), content.Offset)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error returned for non successful responses, with the reason the server gave.
+// Use errors.Is with the sentinel errors to check the kind,
+// or Code for the error code of the server, such as no-space.
+type Error struct {
+	StatusCode int
+	Code       string
+	Reason     string
+}
+
+func (e *Error) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("silo: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("silo: %d %s", e.StatusCode, e.Reason)
+}
+
+// Matches sentinel errors on status code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Reason == "" && t.Code == "" && t.StatusCode == e.StatusCode
+}
+
+var (
+	ErrBadRequest   = &Error{StatusCode: http.StatusBadRequest}
+	ErrUnauthorized = &Error{StatusCode: http.StatusUnauthorized}
+	ErrForbidden    = &Error{StatusCode: http.StatusForbidden}
+	ErrNotFound     = &Error{StatusCode: http.StatusNotFound}
+	ErrConflict     = &Error{StatusCode: http.StatusConflict}
+	// Changes since the cycle are no longer available, List again
+	ErrGone = &Error{StatusCode: http.StatusGone}
+	// Disk of the server is full
+	ErrNoSpace = &Error{StatusCode: http.StatusInsufficientStorage}
+)
@@ -0,0 +1,100 @@
+package client
+
+// Types mirror the JSON of the server, field names are kept identical.
+
+type ImageMeta struct {
+	TakenAt     int64
+	CameraMake  string
+	CameraModel string
+	Orientation int
+	Width       int
+	Height      int
+	GPS         *GPSCoordinates `json:",omitempty"`
+}
+
+type GPSCoordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+type MediaMeta struct {
+	Container  string
+	Duration   float64
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	Fragmented bool
+}
+
+type ListFile struct {
+	Name        string
+	ModDate     int64
+	SizeBytes   string
+	IsDir       bool
+	ContentType string
+	Directories []string
+	DetailURL   string
+	ContentURL  string
+	VideoURL    string
+	ViewURL     string
+	ThumbURL    string
+	StreamURL   string
+	IsArchive   bool
+	Image       *ImageMeta `json:",omitempty"`
+	Media       *MediaMeta `json:",omitempty"`
+	Members     []ListFile `json:",omitempty"`
+}
+
+// Path of the file relative to the server base, without leading slash
+func (f ListFile) Path() string {
+	p := ""
+	for _, dir := range f.Directories {
+		p += dir + "/"
+	}
+	return p + f.Name
+}
+
+type UploadResult struct {
+	Message     string
+	Filename    string
+	ContentURL  string
+	Directories []string
+	// Set when the file failed, Code and Status as in Error
+	Error  string `json:",omitempty"`
+	Code   string `json:",omitempty"`
+	Status int    `json:",omitempty"`
+}
+
+type Changes struct {
+	Since    int64
+	Cycle    int64
+	Added    []ListFile
+	Modified []ListFile
+	Removed  []ListFile
+}
+
+// Event types, and Reset when events were missed and the listing
+// should be fetched again.
+const (
+	EventCreated  = "created"
+	EventModified = "modified"
+	EventDeleted  = "deleted"
+	EventMoved    = "moved"
+	EventReset    = "reset"
+)
+
+type Event struct {
+	ID   int64
+	Type string
+	Time int64
+	File ListFile
+	From *ListFile `json:",omitempty"`
+}
+
+// RFC 7807 problem, servers before problems only send Reason
+type errorMsg struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+	Reason string
+}
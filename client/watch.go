@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type WatchOptions struct {
+	// Only events of files within these directories
+	Dirs []string
+	// Resume after this event id, 0 for new events only
+	LastEventID int64
+}
+
+// Watch file events until ctx is done or fn returns an error.
+// Dropped connections are resumed from the last received event,
+// when the server no longer has the missed events fn gets an EventReset.
+func (c *Client) Watch(ctx context.Context, options WatchOptions, fn func(Event) error) error {
+	lastID := options.LastEventID
+	delay := c.options.RetryDelay
+	for {
+		err := c.watchOnce(ctx, options.Dirs, &lastID, fn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, stop := err.(stopError); stop {
+			return err.(stopError).err
+		}
+		if e, ok := err.(*Error); ok && e.StatusCode < 500 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Error returned by the callback, ends the watch
+type stopError struct {
+	err error
+}
+
+func (e stopError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) watchOnce(ctx context.Context, dirs []string, lastID *int64, fn func(Event) error) error {
+	query := url.Values{"dirs": dirs}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/events/?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*lastID, 10))
+	}
+	resp, err := c.checkResponse(c.send(req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	eventType, data := "", ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if eventType == "" && data == "" {
+				continue
+			}
+			event := Event{Type: eventType}
+			if eventType != EventReset {
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					eventType, data = "", ""
+					continue
+				}
+				*lastID = event.ID
+			}
+			if err := fn(event); err != nil {
+				return stopError{err}
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(line[len("data:"):])
+		}
+	}
+	return scanner.Err()
+}
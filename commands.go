@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Subcommands of the binary, without a subcommand the server runs.
+// Each gets the arguments after its name and returns the exit code.
+var commands = map[string]func([]string) int{
+	"sync":   syncCommand,
+	"ls":     lsCommand,
+	"get":    getCommand,
+	"put":    putCommand,
+	"rm":     rmCommand,
+	"mv":     mvCommand,
+	"find":   findCommand,
+	"config": configCommand,
+}
+
+func commandUsage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage: silo [flags] to run the server, or silo <command> [flags]")
+	fmt.Fprintln(os.Stderr, "Commands:", strings.Join(names, ", "))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag of a listing, the cache generation combined with the
+// path and query, so every filter gets its own tag.
+func listETag(r *http.Request, cycle int64) string {
+	h := fnv.New64a()
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{'?'})
+	// Encode sorts by key, the order of parameters does not matter
+	h.Write([]byte(r.URL.Query().Encode()))
+	return fmt.Sprintf("\"%x-%x\"", cycle, h.Sum64())
+}
+
+// ETag of a single file, changes when the size or modification time does.
+// The time is in nanoseconds, a rewrite within the same second changes it.
+func fileETag(f *File) string {
+	return fmt.Sprintf("\"%x-%x\"", f.Size, f.ModNano)
+}
+
+// Weak comparison of the If-None-Match header against etag.
+func etagMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Set ETag and Last-Modified, and respond 304 Not Modified when the
+// client has a fresh copy. Returns true when the response is written.
+// If-Modified-Since is only used without If-None-Match.
+func checkConditional(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatch(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			notModified = !modified.Truncate(time.Second).After(t)
+		}
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// Conditional check for listings, based on the cache generation.
+// Last-Modified is left out before the first sync.
+func checkListConditional(w http.ResponseWriter, r *http.Request) bool {
+	cycle := Cache.LastCycle()
+	modified := time.Time{}
+	if cycle > 0 {
+		modified = time.Unix(0, cycle)
+	}
+	return checkConditional(w, r, listETag(r, cycle), modified)
+}
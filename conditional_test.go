@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatch(t *testing.T) {
+	testcases := []struct {
+		header   string
+		etag     string
+		expected bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		{``, `"a"`, false},
+	}
+
+	for tcNumber, testcase := range testcases {
+		if result := etagMatch(testcase.header, testcase.etag); result != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+func TestCheckConditional(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 12, 0, 0, 500, time.UTC)
+	testcases := []struct {
+		headers  map[string]string
+		expected bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"If-None-Match": `"tag"`}, true},
+		{map[string]string{"If-None-Match": `"other"`}, false},
+		{map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+		{map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		// If-None-Match takes precedence
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modified.Format(http.TimeFormat)}, false},
+	}
+
+	for tcNumber, testcase := range testcases {
+		r := httptest.NewRequest(http.MethodGet, "/list/", nil)
+		for key, value := range testcase.headers {
+			r.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		result := checkConditional(w, r, `"tag"`, modified)
+		if result != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+		if result && w.Code != http.StatusNotModified {
+			t.Error("testcase", tcNumber, "expected status 304 !=", w.Code)
+		}
+	}
+}
+
+func TestListETag(t *testing.T) {
+	a := listETag(httptest.NewRequest(http.MethodGet, "/list/?filter=a&orderby=name", nil), 1)
+	b := listETag(httptest.NewRequest(http.MethodGet, "/list/?orderby=name&filter=a", nil), 1)
+	c := listETag(httptest.NewRequest(http.MethodGet, "/list/?orderby=name&filter=a", nil), 2)
+	d := listETag(httptest.NewRequest(http.MethodGet, "/list/group/?orderby=name&filter=a", nil), 1)
+	if a != b {
+		t.Error("parameter order should not change the etag", a, b)
+	}
+	if a == c || a == d {
+		t.Error("cycle and path should change the etag", a, c, d)
+	}
+}
+
+func TestFileETag(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	file := &File{Size: 5, ModDate: modified.Unix(), ModNano: modified.UnixNano()}
+	// Rewritten within the same second, with the same size
+	rewritten := &File{Size: 5, ModDate: modified.Unix(), ModNano: modified.Add(time.Millisecond).UnixNano()}
+	if fileETag(file) == fileETag(rewritten) {
+		t.Error("a rewrite within the same second should change the etag", fileETag(file))
+	}
+	if fileETag(file) != fileETag(&File{Size: 5, ModDate: modified.Unix(), ModNano: modified.UnixNano()}) {
+		t.Error("the same size and modification time should keep the etag")
+	}
+}
+
+func TestCheckListConditionalBeforeSync(t *testing.T) {
+	Cache.Mu.Lock()
+	oldCycle := Cache.Cycle
+	Cache.Cycle = 0
+	Cache.Mu.Unlock()
+	defer func() {
+		Cache.Mu.Lock()
+		Cache.Cycle = oldCycle
+		Cache.Mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	checkListConditional(w, httptest.NewRequest(http.MethodGet, "/list/", nil))
+	if modified := w.Header().Get("Last-Modified"); modified != "" || w.Header().Get("ETag") == "" {
+		t.Error("expected an etag and no Last-Modified before the first sync !=", modified)
+	}
+
+	Cache.Mu.Lock()
+	Cache.Cycle = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+	Cache.Mu.Unlock()
+	w = httptest.NewRecorder()
+	checkListConditional(w, httptest.NewRequest(http.MethodGet, "/list/", nil))
+	if modified := w.Header().Get("Last-Modified"); modified != "Wed, 01 Jan 2020 12:00:00 GMT" {
+		t.Error("expected Last-Modified of the cycle !=", modified)
+	}
+}
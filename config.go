@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+// silo config print [server flags]
+// Shows the effective value of every setting and where it came from,
+// read the same way the server reads them, with the environment
+// variable each setting is read from.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: silo config print [-config file] [server flags]")
+		return 2
+	}
+	err := SETTINGS.Parse(args[1:])
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tENV\tVALUE\tSOURCE")
+	for _, key := range SETTINGS.Keys() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", key, envName(key), redactedSetting(key), SETTINGS.Source(key))
+	}
+	tw.Flush()
+
+	for _, warning := range SETTINGS.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid settings:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func redactedSetting(key string) string {
+	value := SETTINGS.String(key)
+	if SETTINGS.IsSecret(key) && value != "" {
+		return "<redacted>"
+	}
+	return value
+}
+
+func validateBase(s *Settings) error {
+	info, err := os.Stat(s.Get("base"))
+	if err != nil {
+		return fmt.Errorf("%q does not exist", s.Get("base"))
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", s.Get("base"))
+	}
+	return nil
+}
+
+func validateHost(s *Settings) error {
+	if _, _, err := net.SplitHostPort(s.Get("host")); err != nil {
+		return fmt.Errorf("%q is not host:port", s.Get("host"))
+	}
+	return nil
+}
+
+func validatePositive(key string) func(*Settings) error {
+	return func(s *Settings) error {
+		if s.GetInt(key) < 0 || s.GetDuration(key) < 0 || s.GetBytes(key) < 0 ||
+			(s.GetInt(key) == 0 && s.GetDuration(key) == 0 && s.GetBytes(key) == 0) {
+			return errors.New("must be larger than 0")
+		}
+		return nil
+	}
+}
+
+func validateWebhookURLs(s *Settings) error {
+	for _, u := range s.GetList("webhooks") {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%q is not an http url", u)
+		}
+	}
+	return nil
+}
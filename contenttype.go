@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Magic number signature, prefix found at offset
+type signature struct {
+	offset      int
+	prefix      []byte
+	contentType string
+}
+
+// Formats http.DetectContentType does not know, or reports as a generic type.
+// Checked in order, the first match wins.
+var signatures = []signature{
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{4, []byte("ftypM4A "), "audio/mp4"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypmif1"), "image/heif"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{8, []byte("AVI "), "video/x-msvideo"},
+	{8, []byte("WAVE"), "audio/wav"},
+	{8, []byte("WEBP"), "image/webp"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("OggS"), "audio/ogg"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("\x1F\x8B"), "application/gzip"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("Rar!\x1A\x07"), "application/vnd.rar"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"), "application/x-ole-storage"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+}
+
+// Extension mapping, used when the content is ambiguous.
+// Same result on every OS, unlike mime.TypeByExtension.
+var extensionTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".tar":  "application/x-tar",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".json": "application/json",
+	".csv":  "text/csv; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".srt":  "text/plain; charset=utf-8",
+	".vtt":  "text/vtt; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".epub": "application/epub+zip",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".ppt":  "application/vnd.ms-powerpoint",
+}
+
+// Containers that hold many formats, the extension tells which one.
+var containerTypes = map[string]bool{
+	"application/zip":           true,
+	"application/x-ole-storage": true,
+	"application/octet-stream":  true,
+	"text/plain; charset=utf-8": true,
+}
+
+// Parsed overrides, parsed again when the setting is reloaded
+var contentTypeOverrides struct {
+	mu        sync.Mutex
+	setting   string
+	overrides map[string]string
+}
+
+// Overrides from the content-types setting, ".ext=type,.ext=type"
+func parseContentTypeOverrides(s string) map[string]string {
+	overrides := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ext := strings.ToLower(strings.TrimSpace(parts[0]))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		overrides[ext] = strings.TrimSpace(parts[1])
+	}
+	return overrides
+}
+
+func overrideContentType(ext string) (string, bool) {
+	setting := SETTINGS.Get("content-types")
+	contentTypeOverrides.mu.Lock()
+	defer contentTypeOverrides.mu.Unlock()
+	if contentTypeOverrides.overrides == nil || contentTypeOverrides.setting != setting {
+		contentTypeOverrides.setting = setting
+		contentTypeOverrides.overrides = parseContentTypeOverrides(setting)
+	}
+	contentType, found := contentTypeOverrides.overrides[ext]
+	return contentType, found
+}
+
+func matchSignature(head []byte) string {
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.prefix) && bytes.Equal(head[sig.offset:sig.offset+len(sig.prefix)], sig.prefix) {
+			return sig.contentType
+		}
+	}
+	return ""
+}
+
+// Matroska and WebM share the EBML header, the DocType tells them apart
+func matchEbml(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("\x1A\x45\xDF\xA3")) {
+		return ""
+	}
+	if bytes.Contains(head, []byte("webm")) {
+		return "video/webm"
+	}
+	return "video/x-matroska"
+}
+
+func extensionContentType(ext string) string {
+	if contentType, found := extensionTypes[ext]; found {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Content type from the first bytes of the file and its name.
+// Settings overrides win, then magic numbers, then the extension
+// for content that only has a generic type.
+func detectContentType(head []byte, name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if contentType, found := overrideContentType(ext); found {
+		return contentType
+	}
+
+	contentType := matchSignature(head)
+	if contentType == "" {
+		contentType = matchEbml(head)
+	}
+	if contentType == "" && len(head) > 0 {
+		contentType = http.DetectContentType(head)
+	}
+	if contentType == "" || containerTypes[contentType] {
+		if byExtension := extensionContentType(ext); byExtension != "" {
+			return byExtension
+		}
+	}
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	testcases := []struct {
+		head     string
+		name     string
+		expected string
+	}{
+		{"\x00\x00\x00\x18ftypisom", "a.mp4", "video/mp4"},
+		{"\x00\x00\x00\x18ftypisom", "noext", "video/mp4"},
+		{"\x00\x00\x00\x14ftypqt  ", "a.mov", "video/quicktime"},
+		{"\x1A\x45\xDF\xA3\x01\x00\x00\x00B\x82\x84webm", "a.webm", "video/webm"},
+		{"\x1A\x45\xDF\xA3\x01\x00\x00\x00B\x82\x88matroska", "a.mkv", "video/x-matroska"},
+		{"ID3\x03\x00", "a.mp3", "audio/mpeg"},
+		{"fLaC", "a.flac", "audio/flac"},
+		{"PK\x03\x04", "a.zip", "application/zip"},
+		{"PK\x03\x04", "a.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1", "a.xls", "application/vnd.ms-excel"},
+		{"\x89PNG\r\n\x1a\n", "a.jpg", "image/png"},
+		{"hello", "a.txt", "text/plain; charset=utf-8"},
+		{"hello", "a.srt", "text/plain; charset=utf-8"},
+		{"a,b\n1,2", "a.csv", "text/csv; charset=utf-8"},
+		{"", "a.json", "application/json"},
+		{"", "noext", "application/octet-stream"},
+	}
+
+	for tcNumber, testcase := range testcases {
+		result := detectContentType([]byte(testcase.head), testcase.name)
+		if result != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+func TestParseContentTypeOverrides(t *testing.T) {
+	overrides := parseContentTypeOverrides(".RAW=image/x-raw, nef=image/x-nikon-nef,broken")
+	if overrides[".raw"] != "image/x-raw" || overrides[".nef"] != "image/x-nikon-nef" || len(overrides) != 2 {
+		t.Error("unexpected overrides", overrides)
+	}
+}
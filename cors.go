@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Response headers the browser may read from cross-origin responses
+var corsExposedHeaders = []string{"Last-Update", "Total-Items", "Page", "ETag", "Content-Range", "X-Request-ID"}
+
+// Origin patterns are full origins, https://app.example.com, with a * as
+// first label for any subdomain, https://*.example.com, or * for any origin.
+// Patterns without scheme match on host only.
+func originAllowed(origin string, patterns []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	host := strings.ToLower(u.Host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+		target := origin
+		if !strings.Contains(pattern, "://") {
+			target = host
+		}
+		switch {
+		case pattern == "*":
+			return true
+		case pattern == target:
+			return true
+		case strings.Contains(pattern, "*."):
+			prefix, suffix, _ := strings.Cut(pattern, "*.")
+			if strings.HasPrefix(target, prefix) && strings.HasSuffix(target, "."+suffix) &&
+				len(target) > len(prefix)+len(suffix)+1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Answers preflight requests and adds the CORS headers for allowed origins.
+// Settings are read per request, so they can be reloaded.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		patterns := SETTINGS.GetList("cors")
+		if len(patterns) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !originAllowed(origin, patterns) {
+			if preflight {
+				ErrorResponse(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credentials := SETTINGS.GetBool("cors-credentials")
+		if containsString(patterns, "*") && !credentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(SETTINGS.GetList("cors-methods"), ", "))
+		headers := SETTINGS.GetList("cors-headers")
+		if containsString(headers, "*") {
+			// Wildcards are not allowed with credentials, echo the request
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		} else {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(SETTINGS.GetDuration("cors-max-age").Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin   string
+		patterns []string
+		expected bool
+	}{
+		{"https://app.example.com", []string{"https://app.example.com"}, true},
+		{"https://App.Example.com", []string{"https://app.example.com/"}, true},
+		{"http://app.example.com", []string{"https://app.example.com"}, false},
+		{"https://a.example.com", []string{"https://*.example.com"}, true},
+		{"https://a.b.example.com:8080", []string{"https://*.example.com:8080"}, true},
+		{"https://example.com", []string{"https://*.example.com"}, false},
+		{"https://evilexample.com", []string{"https://*.example.com"}, false},
+		{"http://a.example.com", []string{"*.example.com"}, true},
+		{"https://any.org", []string{"*"}, true},
+		{"null", []string{"https://app.example.com"}, false},
+	}
+	for tcNumber, test := range tests {
+		result := originAllowed(test.origin, test.patterns)
+		if result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+	}
+}
+
+func TestCorsMiddleware(t *testing.T) {
+	defer func(cors []string, credentials bool) {
+		SETTINGS.VarList["cors"] = cors
+		SETTINGS.VarBool["cors-credentials"] = credentials
+	}(SETTINGS.GetList("cors"), SETTINGS.GetBool("cors-credentials"))
+	SETTINGS.VarList["cors"] = []string{"https://*.example.com"}
+	SETTINGS.VarBool["cors-credentials"] = true
+
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		method      string
+		origin      string
+		preflight   bool
+		status      int
+		allowOrigin string
+	}{
+		{"GET", "https://app.example.com", false, 200, "https://app.example.com"},
+		{"GET", "https://other.org", false, 200, ""},
+		{"GET", "", false, 200, ""},
+		{"OPTIONS", "https://app.example.com", true, 204, "https://app.example.com"},
+		{"OPTIONS", "https://other.org", true, 403, ""},
+		{"OPTIONS", "https://app.example.com", false, 200, "https://app.example.com"},
+	}
+	for tcNumber, test := range tests {
+		r := httptest.NewRequest(test.method, "/list/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.preflight {
+			r.Header.Set("Access-Control-Request-Method", "DELETE")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || w.Header().Get("Access-Control-Allow-Origin") != test.allowOrigin {
+			t.Error("testcase", tcNumber, "expected", test.status, test.allowOrigin, "!=", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Error("testcase", tcNumber, "expected Vary: Origin !=", w.Header()["Vary"])
+		}
+	}
+
+	r := httptest.NewRequest("OPTIONS", "/delete/a.txt", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	expected := map[string]string{
+		"Access-Control-Allow-Methods":     "GET, HEAD, POST, PUT, DELETE, OPTIONS",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	}
+	for header, value := range expected {
+		if w.Header().Get(header) != value {
+			t.Error("expected", header, value, "!=", w.Header().Get(header))
+		}
+	}
+}
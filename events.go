@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change types of file events
+const (
+	EventCreated  = "created"
+	EventModified = "modified"
+	EventDeleted  = "deleted"
+	EventMoved    = "moved"
+)
+
+// A change to a cached file, From is set for moved files.
+type Change struct {
+	Type string
+	File *File
+	From *File
+}
+
+type FileEvent struct {
+	ID   int64
+	Type string
+	Time int64
+	File ListFile
+	From *ListFile `json:",omitempty"`
+}
+
+// Changes between two cache generations, sorted on path.
+// A deleted and created file with the same size and modification
+// date is reported as moved.
+func diffCacheMaps(oldItems, newItems CacheMap) []Change {
+	changes := []Change{}
+	deleted := []*File{}
+	for key, file := range oldItems {
+		if _, found := newItems[key]; !found {
+			deleted = append(deleted, file)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].relativePath() < deleted[j].relativePath() })
+
+	keys := make([]string, 0, len(newItems))
+	for key := range newItems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		file := newItems[key]
+		oldFile, found := oldItems[key]
+		switch {
+		case !found:
+			if from := takeMoved(&deleted, file); from != nil {
+				changes = append(changes, Change{Type: EventMoved, File: file, From: from})
+			} else {
+				changes = append(changes, Change{Type: EventCreated, File: file})
+			}
+		case oldFile.ModDate != file.ModDate || oldFile.ModNano != file.ModNano || oldFile.Size != file.Size:
+			changes = append(changes, Change{Type: EventModified, File: file})
+		}
+	}
+	for _, file := range deleted {
+		changes = append(changes, Change{Type: EventDeleted, File: file})
+	}
+	return changes
+}
+
+// Remove and return the deleted file that file was moved from
+func takeMoved(deleted *[]*File, file *File) *File {
+	if file.IsDir {
+		return nil
+	}
+	for i, candidate := range *deleted {
+		if !candidate.IsDir && candidate.Size == file.Size && candidate.ModDate == file.ModDate {
+			*deleted = append((*deleted)[:i], (*deleted)[i+1:]...)
+			return candidate
+		}
+	}
+	return nil
+}
+
+// Number of events kept for clients that resume with Last-Event-ID
+const eventHistorySize = 1024
+
+// Fans out file events to subscribed clients and keeps a short history.
+type EventBroker struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     []FileEvent
+	subscribers map[chan FileEvent]struct{}
+}
+
+var Events = newEventBroker()
+
+// IDs start at the start time in microseconds, so they keep increasing over
+// restarts and a client resuming with an ID of an earlier process gets a reset.
+func newEventBroker() *EventBroker {
+	return &EventBroker{
+		lastID:      time.Now().UnixMicro(),
+		subscribers: make(map[chan FileEvent]struct{}),
+	}
+}
+
+func (b *EventBroker) Publish(changes []Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, change := range changes {
+		b.lastID++
+		event := FileEvent{
+			ID:   b.lastID,
+			Type: change.Type,
+			Time: time.Now().Unix(),
+			File: change.File.ListFile(),
+		}
+		if change.From != nil {
+			from := change.From.ListFile()
+			event.From = &from
+		}
+		b.history = append(b.history, event)
+		if len(b.history) > eventHistorySize {
+			b.history = b.history[len(b.history)-eventHistorySize:]
+		}
+		for sub := range b.subscribers {
+			select {
+			case sub <- event:
+			default:
+				// Slow client, it will miss events and has to resume
+				close(sub)
+				delete(b.subscribers, sub)
+			}
+		}
+	}
+}
+
+// Subscribe to new events, with the events after lastID from history.
+// complete is false when events after lastID are no longer in history,
+// or lastID was never given out by this broker.
+func (b *EventBroker) Subscribe(lastID int64) (sub chan FileEvent, backlog []FileEvent, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub = make(chan FileEvent, 256)
+	b.subscribers[sub] = struct{}{}
+	complete = true
+	if lastID <= 0 {
+		return sub, nil, complete
+	}
+	switch {
+	case lastID > b.lastID:
+		complete = false
+	case len(b.history) > 0 && b.history[0].ID > lastID+1:
+		complete = false
+	case len(b.history) == 0 && b.lastID > lastID:
+		complete = false
+	}
+	for _, event := range b.history {
+		if event.ID > lastID {
+			backlog = append(backlog, event)
+		}
+	}
+	return sub, backlog, complete
+}
+
+func (b *EventBroker) Unsubscribe(sub chan FileEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, found := b.subscribers[sub]; found {
+		close(sub)
+		delete(b.subscribers, sub)
+	}
+}
+
+// Event is within the requested directories, or of one of the files in them
+func eventInDirs(event FileEvent, dirs []string) bool {
+	if len(dirs) == 0 {
+		return true
+	}
+	if subDir(event.File.Directories, dirs) {
+		return true
+	}
+	return event.From != nil && subDir(event.From.Directories, dirs)
+}
+
+func lastEventID(r *http.Request) int64 {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("lastEventId")
+	}
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
+
+// Server-Sent Events stream of file changes.
+// Clients resume with the Last-Event-ID header, when the history does not
+// reach back far enough a reset event is send and the listing should be refetched.
+// Requests with a WebSocket upgrade get the same events as JSON messages.
+func eventsRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	if isWebSocketUpgrade(r) {
+		eventsWebSocket(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ErrorResponse(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	dirs := r.URL.Query()["dirs"]
+
+	sub, backlog, complete := Events.Subscribe(lastEventID(r))
+	defer Events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	// The stream outlives the write-timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		writeSSE(w, event, dirs)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+		case event, open := <-sub:
+			if !open {
+				return
+			}
+			writeSSE(w, event, dirs)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event FileEvent, dirs []string) {
+	if !eventInDirs(event, dirs) {
+		return
+	}
+	data, err := apiJSON(w, event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
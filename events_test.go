@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffCacheMaps(t *testing.T) {
+	oldItems := CacheMap{
+		"/same.txt":     {Name: "same.txt", RelPath: "/", Size: 1, ModDate: 1},
+		"/changed.txt":  {Name: "changed.txt", RelPath: "/", Size: 1, ModDate: 1},
+		"/deleted.txt":  {Name: "deleted.txt", RelPath: "/", Size: 2, ModDate: 2},
+		"/old/name.jpg": {Name: "name.jpg", RelPath: "/old/", Size: 3, ModDate: 3},
+	}
+	newItems := CacheMap{
+		"/same.txt":     {Name: "same.txt", RelPath: "/", Size: 1, ModDate: 1},
+		"/changed.txt":  {Name: "changed.txt", RelPath: "/", Size: 1, ModDate: 5},
+		"/created.txt":  {Name: "created.txt", RelPath: "/", Size: 4, ModDate: 4},
+		"/new/name.jpg": {Name: "name.jpg", RelPath: "/new/", Size: 3, ModDate: 3},
+	}
+
+	expected := []struct {
+		typ  string
+		path string
+	}{
+		{EventModified, "/changed.txt"},
+		{EventCreated, "/created.txt"},
+		{EventMoved, "/new/name.jpg"},
+		{EventDeleted, "/deleted.txt"},
+	}
+	changes := diffCacheMaps(oldItems, newItems)
+	if len(changes) != len(expected) {
+		t.Fatal("expected", len(expected), "changes !=", len(changes))
+	}
+	for i, change := range changes {
+		if change.Type != expected[i].typ || change.File.relativePath() != expected[i].path {
+			t.Error("change", i, "expected", expected[i], "!=", change.Type, change.File.relativePath())
+		}
+	}
+	if changes[2].From == nil || changes[2].From.relativePath() != "/old/name.jpg" {
+		t.Error("moved file should come from /old/name.jpg")
+	}
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	broker := newEventBroker()
+	file := &File{Name: "a.txt", RelPath: "/"}
+	for i := 0; i < eventHistorySize+10; i++ {
+		broker.Publish([]Change{{Type: EventCreated, File: file}})
+	}
+
+	sub, backlog, complete := broker.Subscribe(broker.lastID - 3)
+	if len(backlog) != 3 || !complete {
+		t.Error("expected 3 events from history !=", len(backlog), complete)
+	}
+	broker.Unsubscribe(sub)
+
+	sub, _, complete = broker.Subscribe(1)
+	if complete {
+		t.Error("events before the history should not be complete")
+	}
+
+	broker.Publish([]Change{{Type: EventDeleted, File: file}})
+	if event := <-sub; event.Type != EventDeleted || event.ID != broker.lastID {
+		t.Error("unexpected event", event)
+	}
+	broker.Unsubscribe(sub)
+}
+
+func TestEventBrokerRestart(t *testing.T) {
+	file := &File{Name: "a.txt", RelPath: "/"}
+	before := newEventBroker()
+	for i := 0; i < 10; i++ {
+		before.Publish([]Change{{Type: EventCreated, File: file}})
+	}
+	time.Sleep(time.Millisecond)
+	after := newEventBroker()
+
+	// Resuming with an ID of the earlier process before or after any new event
+	sub, backlog, complete := after.Subscribe(before.lastID)
+	if complete || len(backlog) != 0 {
+		t.Error("expected a reset for an ID of an earlier process", len(backlog), complete)
+	}
+	after.Unsubscribe(sub)
+	after.Publish([]Change{{Type: EventCreated, File: file}})
+	sub, _, complete = after.Subscribe(before.lastID)
+	if complete {
+		t.Error("expected a reset for an ID of an earlier process after new events")
+	}
+	after.Unsubscribe(sub)
+
+	// An ID that was never given out
+	sub, _, complete = after.Subscribe(after.lastID + 5)
+	if complete {
+		t.Error("expected a reset for an ID ahead of the broker")
+	}
+	after.Unsubscribe(sub)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Metadata of image files, read from EXIF for jpeg files.
+// Width and Height fall back to the decoded image size.
+type ImageMeta struct {
+	TakenAt     int64
+	CameraMake  string
+	CameraModel string
+	Orientation int
+	Width       int
+	Height      int
+	GPS         *GPSCoordinates `json:",omitempty"`
+}
+
+type GPSCoordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Camera make and model, as used by the camera= filter
+func (m *ImageMeta) Camera() string {
+	return strings.TrimSpace(m.CameraMake + " " + m.CameraModel)
+}
+
+var errNoExif = errors.New("No EXIF data found")
+
+// EXIF tags that are read
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagPixelXDimension  = 0xA002
+	tagPixelYDimension  = 0xA003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// Size in bytes of the tiff field types
+var tiffTypeSize = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiffReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, errNoExif
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errNoExif
+	}
+	if t.order.Uint16(data[2:4]) != 42 {
+		return nil, errNoExif
+	}
+	return t, nil
+}
+
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+// Read all entries of the IFD at offset, values outside the data are skipped.
+func (t *tiffReader) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errNoExif
+	}
+	count := uint32(t.order.Uint16(t.data[offset:]))
+	entries := make(map[uint16]tiffEntry, count)
+	for i := uint32(0); i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			break
+		}
+		raw := t.data[start : start+12]
+		entry := tiffEntry{
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+		}
+		size, ok := tiffTypeSize[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+length > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[valueOffset : valueOffset+length]
+		}
+		entries[t.order.Uint16(raw[0:2])] = entry
+	}
+	return entries, nil
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t *tiffReader) uint(e tiffEntry) uint32 {
+	switch e.typ {
+	case 3:
+		if len(e.value) >= 2 {
+			return uint32(t.order.Uint16(e.value))
+		}
+	case 4, 9:
+		if len(e.value) >= 4 {
+			return t.order.Uint32(e.value)
+		}
+	}
+	return 0
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	values := []float64{}
+	if e.typ != 5 {
+		return values
+	}
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num := t.order.Uint32(e.value[i:])
+		den := t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			values = append(values, 0)
+			continue
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// EXIF dates have no timezone, they are read as UTC.
+func parseExifDate(s string) int64 {
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func (t *tiffReader) gps(entries map[uint16]tiffEntry) *GPSCoordinates {
+	lat := t.rationals(entries[tagGPSLatitude])
+	lon := t.rationals(entries[tagGPSLongitude])
+	if len(lat) != 3 || len(lon) != 3 {
+		return nil
+	}
+	coordinates := &GPSCoordinates{
+		Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+		Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+	}
+	if t.str(entries[tagGPSLatitudeRef]) == "S" {
+		coordinates.Latitude = -coordinates.Latitude
+	}
+	if t.str(entries[tagGPSLongitudeRef]) == "W" {
+		coordinates.Longitude = -coordinates.Longitude
+	}
+	return coordinates
+}
+
+// Parse the TIFF structure inside an EXIF segment
+func parseExif(data []byte) (*ImageMeta, error) {
+	t, err := newTiffReader(data)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.ifd(t.firstIFD())
+	if err != nil {
+		return nil, err
+	}
+	meta := &ImageMeta{
+		CameraMake:  t.str(ifd0[tagMake]),
+		CameraModel: t.str(ifd0[tagModel]),
+		Orientation: int(t.uint(ifd0[tagOrientation])),
+		TakenAt:     parseExifDate(t.str(ifd0[tagDateTime])),
+	}
+	if entry, ok := ifd0[tagExifIFD]; ok {
+		if exifIFD, err := t.ifd(t.uint(entry)); err == nil {
+			if taken := parseExifDate(t.str(exifIFD[tagDateTimeOriginal])); taken != 0 {
+				meta.TakenAt = taken
+			}
+			meta.Width = int(t.uint(exifIFD[tagPixelXDimension]))
+			meta.Height = int(t.uint(exifIFD[tagPixelYDimension]))
+		}
+	}
+	if entry, ok := ifd0[tagGPSIFD]; ok {
+		if gpsIFD, err := t.ifd(t.uint(entry)); err == nil {
+			meta.GPS = t.gps(gpsIFD)
+		}
+	}
+	return meta, nil
+}
+
+// Find the APP1 Exif segment in a jpeg stream
+func readJpegExif(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, errNoExif
+	}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, errNoExif
+		}
+		if header[0] != 0xFF {
+			return nil, errNoExif
+		}
+		marker := header[1]
+		// Start of scan, no metadata follows
+		if marker == 0xDA || marker == 0xD9 {
+			return nil, errNoExif
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errNoExif
+		}
+		if marker != 0xE1 {
+			if _, err := br.Discard(length); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, errNoExif
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// Read image metadata, for files without EXIF only the dimensions are set.
+func readImageMeta(fullPath string, contentType string) (*ImageMeta, error) {
+	osFile, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer osFile.Close()
+
+	meta := &ImageMeta{}
+	if contentType == "image/jpeg" {
+		if data, err := readJpegExif(osFile); err == nil {
+			if parsed, err := parseExif(data); err == nil {
+				meta = parsed
+			}
+		}
+		osFile.Seek(0, io.SeekStart)
+	}
+	if meta.Width == 0 || meta.Height == 0 {
+		config, _, err := image.DecodeConfig(osFile)
+		if err != nil {
+			return nil, err
+		}
+		meta.Width = config.Width
+		meta.Height = config.Height
+	}
+	return meta, nil
+}
+
+func (f *File) SetImageMeta() {
+	if !f.thumbnailable() {
+		return
+	}
+	if meta, err := readImageMeta(f.fullPath(), f.ContentType); err == nil {
+		f.Image = meta
+	}
+}
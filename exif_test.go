@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+type testTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// Build a big endian IFD at offset, values larger than 4 bytes
+// are placed directly after the entries.
+func testIFD(offset uint32, tags []testTag) []byte {
+	be := binary.BigEndian
+	ifd := make([]byte, 2+12*len(tags)+4)
+	be.PutUint16(ifd, uint16(len(tags)))
+	extra := []byte{}
+	extraOffset := offset + uint32(len(ifd))
+	for i, tag := range tags {
+		entry := ifd[2+12*i:]
+		be.PutUint16(entry[0:], tag.tag)
+		be.PutUint16(entry[2:], tag.typ)
+		be.PutUint32(entry[4:], tag.count)
+		if len(tag.value) <= 4 {
+			copy(entry[8:12], tag.value)
+		} else {
+			be.PutUint32(entry[8:], extraOffset+uint32(len(extra)))
+			extra = append(extra, tag.value...)
+		}
+	}
+	return append(ifd, extra...)
+}
+
+func testRationals(values ...uint32) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[8*i:], v)
+		binary.BigEndian.PutUint32(b[8*i+4:], 1)
+	}
+	return b
+}
+
+func testLong(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func testExif() []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	exifOffset := uint32(200)
+	gpsOffset := uint32(300)
+	ifd0 := testIFD(8, []testTag{
+		{tagMake, 2, 6, []byte("Canon\x00")},
+		{tagModel, 2, 8, []byte("EOS 5D\x00\x00")},
+		{tagOrientation, 3, 1, []byte{0, 6, 0, 0}},
+		{tagExifIFD, 4, 1, testLong(exifOffset)},
+		{tagGPSIFD, 4, 1, testLong(gpsOffset)},
+	})
+	exifIFD := testIFD(exifOffset, []testTag{
+		{tagDateTimeOriginal, 2, 20, []byte("2019:07:14 10:30:00\x00")},
+		{tagPixelXDimension, 4, 1, testLong(4000)},
+		{tagPixelYDimension, 4, 1, testLong(3000)},
+	})
+	gpsIFD := testIFD(gpsOffset, []testTag{
+		{tagGPSLatitudeRef, 2, 2, []byte("N\x00")},
+		{tagGPSLatitude, 5, 3, testRationals(52, 30, 0)},
+		{tagGPSLongitudeRef, 2, 2, []byte("W\x00")},
+		{tagGPSLongitude, 5, 3, testRationals(4, 15, 0)},
+	})
+
+	data := make([]byte, 512)
+	copy(data, tiff)
+	copy(data[8:], ifd0)
+	copy(data[exifOffset:], exifIFD)
+	copy(data[gpsOffset:], gpsIFD)
+	return data
+}
+
+func TestParseExif(t *testing.T) {
+	meta, err := parseExif(testExif())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Camera() != "Canon EOS 5D" {
+		t.Error("expected camera Canon EOS 5D !=", meta.Camera())
+	}
+	if meta.Orientation != 6 {
+		t.Error("expected orientation 6 !=", meta.Orientation)
+	}
+	if meta.TakenAt != 1563100200 {
+		t.Error("expected taken 1563100200 !=", meta.TakenAt)
+	}
+	if meta.Width != 4000 || meta.Height != 3000 {
+		t.Error("expected 4000x3000 !=", meta.Width, meta.Height)
+	}
+	if meta.GPS == nil || math.Abs(meta.GPS.Latitude-52.5) > 1e-9 || math.Abs(meta.GPS.Longitude+4.25) > 1e-9 {
+		t.Error("expected gps 52.5 -4.25 !=", meta.GPS)
+	}
+}
+
+func TestReadJpegExif(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), testExif()...)
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 4, 'J', 'F'}
+	jpeg = append(jpeg, 0xFF, 0xE1, byte((len(exif)+2)>>8), byte(len(exif)+2))
+	jpeg = append(jpeg, exif...)
+	jpeg = append(jpeg, 0xFF, 0xDA, 0, 2)
+
+	data, err := readJpegExif(bytes.NewReader(jpeg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testExif()) {
+		t.Error("exif segment not found")
+	}
+
+	if _, err := readJpegExif(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xDA})); err != errNoExif {
+		t.Error("expected errNoExif !=", err)
+	}
+}
+
+func TestParseExifTruncated(t *testing.T) {
+	data := testExif()
+	for i := 0; i < len(data); i += 7 {
+		parseExif(data[:i])
+	}
+}
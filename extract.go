@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	errExtractTooLarge    = errors.New("Archive exceeds the maximum extracted size")
+	errExtractRatio       = errors.New("Archive exceeds the maximum compression ratio")
+	errExtractTooMany     = errors.New("Archive exceeds the maximum number of files")
+	errExtractUnsupported = errors.New("Unsupported archive format")
+)
+
+// Failures on the server side are reported by code only, so paths
+// are not exposed, anything else is a problem with the archive.
+func extractFailed(filename string, err error) UploadSuccesResponse {
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, errExtractTooLarge), errors.Is(err, errExtractRatio), errors.Is(err, errExtractTooMany):
+		return uploadFailed(filename, codeTooLarge, err.Error())
+	case errors.Is(err, errExtractUnsupported):
+		return uploadFailed(filename, codeUnsupportedType, err.Error())
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		code := osErrorCode(err)
+		return uploadFailed(filename, code, code.Title)
+	}
+	return uploadFailed(filename, codeBadRequest, "Invalid archive, "+err.Error())
+}
+
+// Guards against zip bombs, checked while writing extracted data.
+type extractLimits struct {
+	maxBytes int64
+	maxRatio int64
+	maxFiles int
+
+	read    *countingReader
+	written int64
+	files   int
+
+	// Extracting stops when the request is done
+	ctx context.Context
+}
+
+func newExtractLimits(ctx context.Context) *extractLimits {
+	return &extractLimits{
+		ctx:      ctx,
+		maxBytes: SETTINGS.GetBytes("extract-max-size"),
+		maxRatio: int64(SETTINGS.GetInt("extract-max-ratio")),
+		maxFiles: SETTINGS.GetInt("extract-max-files"),
+	}
+}
+
+func (l *extractLimits) addFile() error {
+	l.files++
+	if l.files > l.maxFiles {
+		return errExtractTooMany
+	}
+	return nil
+}
+
+func (l *extractLimits) Write(p []byte) (int, error) {
+	l.written += int64(len(p))
+	if l.written > l.maxBytes {
+		return 0, errExtractTooLarge
+	}
+	// Small archives are allowed a compressed size of at least 1MB,
+	// so tiny text files don't trip the ratio check.
+	compressed := l.read.n
+	if compressed < 1<<20 {
+		compressed = 1 << 20
+	}
+	if l.written > compressed*l.maxRatio {
+		return 0, errExtractRatio
+	}
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Extracts the archive in the part under base/dirs.
+// Every entry name is cleaned, only regular files and directories are
+// extracted, symlinks and devices are skipped.
+// Entries are written to a staging directory under base first and only
+// moved into place when the whole archive is extracted, on failure
+// existing files are left untouched.
+func extractUploadPart(ctx context.Context, part *multipart.Part, dirs []string) []UploadSuccesResponse {
+	rawFilename := partFilename(part)
+	targetSegments := cleanRelativePath(strings.Join(dirs, "/"))
+	target := filepath.Join(SETTINGS.Get("base"), filepath.FromSlash(strings.Join(targetSegments, "/")))
+
+	staging, err := os.MkdirTemp(SETTINGS.Get("base"), internalPrefix+"extract-*")
+	if err != nil {
+		return []UploadSuccesResponse{extractFailed(rawFilename, err)}
+	}
+	defer os.RemoveAll(staging)
+
+	limits := newExtractLimits(ctx)
+	limits.read = &countingReader{r: contextReader{ctx, part}}
+	entries := []string{}
+
+	lower := strings.ToLower(rawFilename)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		entries, err = extractZip(limits, staging)
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(limits.read); err == nil {
+			entries, err = extractTar(tar.NewReader(gr), limits, staging)
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		entries, err = extractTar(tar.NewReader(limits.read), limits, staging)
+	default:
+		err = errExtractUnsupported
+	}
+	uploadBytes.Add(float64(limits.read.n))
+
+	extracted := []string{}
+	if err == nil {
+		extracted, err = moveExtracted(staging, target, entries)
+	}
+
+	// Files moved before a failed move are in place, they are reported
+	// together with the failure.
+	responses := []UploadSuccesResponse{}
+	for _, fp := range extracted {
+		cacheStoredFile(fp)
+		relativePath := filepath.ToSlash(fp[len(SETTINGS.Get("base")):])
+		segments := removeEmpty(strings.Split(relativePath, "/"))
+		responses = append(responses, UploadSuccesResponse{
+			Message:     "Extract succeeded",
+			Filename:    segments[len(segments)-1],
+			ContentURL:  "/" + "content/" + url.PathEscape(relativePath),
+			Directories: segments[:len(segments)-1],
+		})
+	}
+	if err != nil {
+		responses = append(responses, extractFailed(rawFilename, err))
+	}
+	return responses
+}
+
+// Move the staged entries under target, replacing files with the same name.
+// Every entry is checked before anything is created, so a conflict with
+// an existing directory or file does not leave the archive half extracted.
+// When a move fails the files moved until then are returned with the error.
+func moveExtracted(staging, target string, entries []string) ([]string, error) {
+	// Archives may contain the same name twice, the last one was staged
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if !seen[entry] {
+			seen[entry] = true
+			unique = append(unique, entry)
+		}
+	}
+	entries = unique
+
+	for _, entry := range entries {
+		if err := checkExtractTarget(target, entry); err != nil {
+			return nil, err
+		}
+	}
+	extracted := []string{}
+	for _, entry := range entries {
+		fp := filepath.Join(target, entry)
+		err := os.MkdirAll(filepath.Dir(fp), 0777)
+		if err == nil {
+			err = os.Rename(filepath.Join(staging, entry), fp)
+		}
+		if err != nil {
+			return extracted, err
+		}
+		extracted = append(extracted, fp)
+	}
+	return extracted, nil
+}
+
+// An error when the entry can not be placed under target, its path is
+// an existing directory or its nearest existing parent is not a directory.
+func checkExtractTarget(target, entry string) error {
+	fp := filepath.Join(target, entry)
+	if info, err := os.Stat(fp); err == nil && info.IsDir() {
+		return &os.PathError{Op: "extract", Path: fp, Err: syscall.EISDIR}
+	}
+	for dir := filepath.Dir(fp); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return &os.PathError{Op: "extract", Path: dir, Err: syscall.ENOTDIR}
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// zip needs random access, the upload is spooled to a temporary file first.
+// The spool is limited to extract-max-size as well.
+func extractZip(limits *extractLimits, staging string) ([]string, error) {
+	tmp, err := ioutil.TempFile("", "silo-upload-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.LimitReader(limits.read, limits.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > limits.maxBytes {
+		return nil, errExtractTooLarge
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, entry := range zr.File {
+		mode := entry.Mode()
+		if mode.IsDir() || !mode.IsRegular() {
+			continue
+		}
+		if err := limits.addFile(); err != nil {
+			return nil, err
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		name, err := extractEntry(rc, entry.Name, limits, staging)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		entries = appendEntry(entries, name)
+	}
+	return entries, nil
+}
+
+func extractTar(tr *tar.Reader, limits *extractLimits, staging string) ([]string, error) {
+	entries := []string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := limits.addFile(); err != nil {
+			return nil, err
+		}
+		name, err := extractEntry(tr, header.Name, limits, staging)
+		if err != nil {
+			return nil, err
+		}
+		entries = appendEntry(entries, name)
+	}
+}
+
+func appendEntry(entries []string, name string) []string {
+	if name == "" {
+		return entries
+	}
+	return append(entries, name)
+}
+
+// Write a single entry under staging and return its cleaned relative path.
+// Entries with an empty name after cleaning are skipped.
+func extractEntry(r io.Reader, name string, limits *extractLimits, staging string) (string, error) {
+	segments := cleanRelativePath(name)
+	if len(segments) == 0 {
+		return "", nil
+	}
+	relativePath := filepath.FromSlash(strings.Join(segments, "/"))
+	fp := filepath.Join(staging, relativePath)
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(io.MultiWriter(limits, f), contextReader{limits.ctx, r})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return relativePath, err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name string
+	data string
+	link string
+}
+
+func testZip(entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(0644)
+		data := entry.data
+		if entry.link != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			data = entry.link
+		}
+		w, _ := zw.CreateHeader(header)
+		w.Write([]byte(data))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func testTar(entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		if entry.link != "" {
+			tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeSymlink, Linkname: entry.link, Mode: 0777})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Size: int64(len(entry.data)), Mode: 0644})
+		tw.Write([]byte(entry.data))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func testUploadPart(t *testing.T, filename string, data []byte) *multipart.Part {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("uploadfile", filename)
+	fw.Write(data)
+	mw.Close()
+	part, err := multipart.NewReader(&body, mw.Boundary()).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return part
+}
+
+// Relative paths of all files under dir
+func testFiles(dir string) []string {
+	files := []string{}
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractUploadPart(t *testing.T) {
+	defer func(base string, size int64, ratio, files int) {
+		SETTINGS.VarString["base"] = base
+		SETTINGS.VarBytes["extract-max-size"] = size
+		SETTINGS.VarInt["extract-max-ratio"] = ratio
+		SETTINGS.VarInt["extract-max-files"] = files
+	}(SETTINGS.Get("base"), SETTINGS.GetBytes("extract-max-size"),
+		SETTINGS.GetInt("extract-max-ratio"), SETTINGS.GetInt("extract-max-files"))
+
+	zeros := strings.Repeat("0", 3<<20)
+	tests := []struct {
+		filename string
+		archive  []byte
+		maxSize  int64
+		maxRatio int
+		maxFiles int
+		code     string
+		// files under base afterwards, base starts with keep.txt
+		expected []string
+		keep     string
+	}{
+		{"a.zip", testZip([]testEntry{{name: "sub/a.txt", data: "a"}, {name: "b.txt", data: "b"}}),
+			1 << 30, 100, 100, "", []string{"docs/b.txt", "docs/sub/a.txt", "keep.txt"}, "original"},
+		// zip slip, entries stay under the target
+		{"slip.zip", testZip([]testEntry{{name: "../../evil.txt", data: "x"}, {name: "/abs/x.txt", data: "x"}}),
+			1 << 30, 100, 100, "", []string{"docs/abs/x.txt", "docs/evil.txt", "keep.txt"}, "original"},
+		{"slip.tar", testTar([]testEntry{{name: "../evil.txt", data: "x"}}),
+			1 << 30, 100, 100, "", []string{"docs/evil.txt", "keep.txt"}, "original"},
+		// symlinks are skipped
+		{"links.zip", testZip([]testEntry{{name: "passwd", link: "/etc/passwd"}, {name: "a.txt", data: "a"}}),
+			1 << 30, 100, 100, "", []string{"docs/a.txt", "keep.txt"}, "original"},
+		{"links.tar", testTar([]testEntry{{name: "passwd", link: "/etc/passwd"}, {name: "a.txt", data: "a"}}),
+			1 << 30, 100, 100, "", []string{"docs/a.txt", "keep.txt"}, "original"},
+		// limits
+		{"many.tar", testTar([]testEntry{{name: "a.txt", data: "a"}, {name: "b.txt", data: "b"}, {name: "c.txt", data: "c"}}),
+			1 << 30, 100, 2, "too-large", []string{"keep.txt"}, "original"},
+		{"large.tar", testTar([]testEntry{{name: "a.txt", data: strings.Repeat("a", 2048)}}),
+			1000, 100, 100, "too-large", []string{"keep.txt"}, "original"},
+		{"bomb.zip", testZip([]testEntry{{name: "zeros.txt", data: zeros}}),
+			1 << 30, 1, 100, "too-large", []string{"keep.txt"}, "original"},
+		// the zip spool is limited as well
+		{"spool.zip", testZip([]testEntry{{name: "a.txt", data: strings.Repeat("a", 2048)}}),
+			1000, 100, 100, "too-large", []string{"keep.txt"}, "original"},
+		// rollback leaves existing files alone
+		{"rollback.tar", testTar([]testEntry{{name: "../keep.txt", data: "replaced"}, {name: "a.txt", data: "a"}}),
+			1 << 30, 100, 1, "too-large", []string{"keep.txt"}, "original"},
+		{"corrupt.zip", []byte("PK not a zip"), 1 << 30, 100, 100, "bad-request", []string{"keep.txt"}, "original"},
+		{"a.rar", []byte("rar"), 1 << 30, 100, 100, "unsupported-type", []string{"keep.txt"}, "original"},
+		// existing files are replaced on success
+		{"replace.tar", testTar([]testEntry{{name: "../keep.txt", data: "replaced"}}),
+			1 << 30, 100, 100, "", []string{"keep.txt"}, "replaced"},
+	}
+	for tcNumber, test := range tests {
+		base, err := ioutil.TempDir("", "silo-extract")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(base, "keep.txt"), []byte("original"), 0644)
+		SETTINGS.VarString["base"] = base
+		SETTINGS.VarBytes["extract-max-size"] = test.maxSize
+		SETTINGS.VarInt["extract-max-ratio"] = test.maxRatio
+		SETTINGS.VarInt["extract-max-files"] = test.maxFiles
+
+		// rollback.tar and replace.tar target base itself, the others base/docs
+		dirs := []string{"docs"}
+		if test.filename == "rollback.tar" || test.filename == "replace.tar" {
+			dirs = []string{}
+		}
+		responses := extractUploadPart(context.Background(), testUploadPart(t, test.filename, test.archive), dirs)
+		code := ""
+		if len(responses) == 1 {
+			code = responses[0].Code
+		}
+		if code != test.code {
+			t.Error("testcase", tcNumber, "expected", test.code, "!=", code, responses)
+		}
+		result := testFiles(base)
+		if strings.Join(result, ",") != strings.Join(test.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+		if content, _ := ioutil.ReadFile(filepath.Join(base, "keep.txt")); string(content) != test.keep {
+			t.Error("testcase", tcNumber, "expected", test.keep, "!=", string(content))
+		}
+		entries, _ := os.ReadDir(base)
+		for _, entry := range entries {
+			if isInternalName(entry.Name()) {
+				t.Error("testcase", tcNumber, "staging directory left behind", entry.Name())
+			}
+		}
+		os.RemoveAll(base)
+	}
+}
+
+func TestMoveExtracted(t *testing.T) {
+	testcases := []struct {
+		entries []string
+		// staged entries, the others fail to move
+		staged   []string
+		failed   bool
+		expected []string
+	}{
+		{[]string{"a/b.txt", "c.txt"}, []string{"a/b.txt", "c.txt"}, false, []string{"a/b.txt", "c.txt", "dir/y.txt", "keep.txt"}},
+		// keep.txt is a file, nothing is created, not even a/
+		{[]string{"a/b.txt", "keep.txt/x.txt"}, []string{"a/b.txt", "keep.txt/x.txt"}, true, []string{"dir/y.txt", "keep.txt"}},
+		{[]string{"a/b.txt", "dir"}, []string{"a/b.txt"}, true, []string{"dir/y.txt", "keep.txt"}},
+		// a failed move returns the files moved before it
+		{[]string{"a/b.txt", "c.txt", "d.txt"}, []string{"a/b.txt", "d.txt"}, true, []string{"a/b.txt", "dir/y.txt", "keep.txt"}},
+	}
+
+	for tcNumber, testcase := range testcases {
+		staging, target := t.TempDir(), t.TempDir()
+		os.WriteFile(filepath.Join(target, "keep.txt"), []byte("keep"), 0644)
+		os.MkdirAll(filepath.Join(target, "dir"), 0755)
+		os.WriteFile(filepath.Join(target, "dir", "y.txt"), []byte("y"), 0644)
+		for _, entry := range testcase.staged {
+			os.MkdirAll(filepath.Dir(filepath.Join(staging, entry)), 0755)
+			os.WriteFile(filepath.Join(staging, entry), []byte(entry), 0644)
+		}
+
+		extracted, err := moveExtracted(staging, target, testcase.entries)
+		if (err != nil) != testcase.failed {
+			t.Error("testcase", tcNumber, "expected failure", testcase.failed, "!=", err)
+		}
+		result := testFiles(target)
+		if strings.Join(result, ",") != strings.Join(testcase.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+		for _, fp := range extracted {
+			if _, err := os.Stat(fp); err != nil {
+				t.Error("testcase", tcNumber, "extracted file missing", fp)
+			}
+		}
+		// nothing moved, no directories created
+		if _, err := os.Stat(filepath.Join(target, "a")); err == nil && len(extracted) == 0 {
+			t.Error("testcase", tcNumber, "empty directory left behind")
+		}
+	}
+}
+
+func TestExtractEntryMode(t *testing.T) {
+	staging := t.TempDir()
+	limits := newExtractLimits(context.Background())
+	limits.read = &countingReader{r: strings.NewReader("")}
+	name, err := extractEntry(strings.NewReader("data"), "a/b.sh", limits, staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(staging, name))
+	if err != nil || info.Mode().Perm()&^0644 != 0 {
+		t.Error("expected at most 0644 !=", info.Mode(), err)
+	}
+}
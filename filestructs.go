@@ -1,7 +1,7 @@
 package main
 
 import (
-	"net/http"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -15,16 +15,25 @@ import (
 //Sync goroutine is responsible for updating the cache
 type CacheMap map[string]*File
 type CacheFiles struct {
-	Cycle int64
-	Items CacheMap
-	Mu    sync.RWMutex
+	Cycle   int64
+	Items   CacheMap
+	Mu      sync.RWMutex
+	Journal ChangeJournal
 }
 type ListFiles []ListFile
 
-func (c *CacheFiles) Set(k string, f *File) {
+// Set a single item, a new cycle is started so clients notice the change
+func (c *CacheFiles) Set(k string, f *File) Change {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
+	change := Change{Type: EventCreated, File: f}
+	if _, found := c.Items[k]; found {
+		change.Type = EventModified
+	}
+	c.Cycle = time.Now().UnixNano()
 	c.Items[k] = f
+	c.Journal.Record(c.Cycle, []Change{change})
+	return change
 }
 
 func (c *CacheFiles) Get(k string) (*File, bool) {
@@ -34,14 +43,61 @@ func (c *CacheFiles) Get(k string) (*File, bool) {
 	return found, ok
 }
 
-func (c *CacheFiles) Update(newItems CacheMap) {
+// Replace all items, returns the changes compared to the previous items.
+// The first update fills the cache and returns no changes.
+func (c *CacheFiles) Update(newItems CacheMap) []Change {
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
 	c.Cycle = time.Now().UnixNano()
+	if !c.Journal.Started() {
+		c.Journal.Start(c.Cycle)
+		c.Items = newItems
+		return nil
+	}
+	changes := diffCacheMaps(c.Items, newItems)
 	c.Items = newItems
+	c.Journal.Record(c.Cycle, changes)
+	return changes
+}
+
+// Delete a single item, returns the deleted file
+func (c *CacheFiles) Delete(k string) (*File, bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	found, ok := c.Items[k]
+	if ok {
+		c.Cycle = time.Now().UnixNano()
+		delete(c.Items, k)
+		c.Journal.Record(c.Cycle, []Change{{Type: EventDeleted, File: found}})
+	}
+	return found, ok
+}
+
+// Changes since the given cycle together with the current cycle,
+// false when the journal does not reach back that far.
+func (c *CacheFiles) ChangesSince(cycle int64) ([]Change, int64, bool) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	changes, ok := c.Journal.Since(cycle)
+	return changes, c.Cycle, ok
+}
+
+// Keys starting with prefix, used for all items below a directory
+func (c *CacheFiles) KeysWithPrefix(prefix string) []string {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	keys := []string{}
+	for key := range c.Items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
 
 func (c *CacheFiles) Length() int {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
 	return len(c.Items)
 }
 
@@ -63,13 +119,20 @@ type File struct {
 	RelPath     string
 	IsDir       bool
 	ModDate     int64
+	ModNano     int64 // ModDate in nanoseconds
 	ContentType string
+	// Set for virtual files inside an archive,
+	// full path of the archive and the path of the member in it.
+	Archive string
+	Member  string
+	Image   *ImageMeta
+	Media   *MediaMeta
 }
 
 type ListFile struct {
 	Name        string
 	ModDate     int64
-	SizeBytes   string
+	SizeBytes   string `v1:",int"`
 	IsDir       bool
 	ContentType string
 	Directories []string
@@ -77,12 +140,18 @@ type ListFile struct {
 	ContentURL  string
 	VideoURL    string
 	ViewURL     string
+	ThumbURL    string
+	StreamURL   string
+	IsArchive   bool
+	Image       *ImageMeta `json:",omitempty"`
+	Media       *MediaMeta `json:",omitempty"`
+	Members     []ListFile `json:",omitempty"`
 }
 
 type ListFileGrouped struct {
 	Name        string
 	ModDate     int64
-	SizeBytes   string
+	SizeBytes   string `v1:",int"`
 	IsDir       bool
 	ContentType string
 	Directories []string
@@ -90,6 +159,11 @@ type ListFileGrouped struct {
 	ContentURL  string
 	VideoURL    string
 	ViewURL     string
+	ThumbURL    string
+	StreamURL   string
+	IsArchive   bool
+	Image       *ImageMeta `json:",omitempty"`
+	Media       *MediaMeta `json:",omitempty"`
 	Grouped     []*ListFileGrouped
 }
 
@@ -114,7 +188,7 @@ func ListFileToGrouped(items []ListFile) *ListFileGrouped {
 		itemGrouped := item.ListFileGrouped()
 		groupedItems = append(groupedItems, itemGrouped)
 
-		if itemGrouped.IsDir {
+		if itemGrouped.IsDir || itemGrouped.IsArchive {
 			key := strings.Join(itemGrouped.Directories, "") + itemGrouped.Name
 			dirs[key] = itemGrouped
 		}
@@ -139,6 +213,11 @@ func (f File) relativePath() string {
 	return filepath.Join(f.RelPath, f.Name)
 }
 
+// Real archive on disk, members of archives are not opened recursively
+func (f File) isArchive() bool {
+	return !f.IsDir && f.Archive == "" && isArchiveName(f.Name)
+}
+
 func (f File) urlEncoded() string {
 	return url.PathEscape(f.relativePath())
 }
@@ -148,20 +227,37 @@ func (f File) urlFor(s string) string {
 }
 
 func (f *File) SetContentType() {
+	if f.Archive != "" {
+		return
+	}
 	osFile, err := os.Open(f.fullPath())
 	if err != nil {
 		return
 	}
 	defer osFile.Close()
+	contentTypeSniffs.Inc()
 	buffer := make([]byte, 512)
-	if _, err := osFile.Read(buffer); err != nil {
+	n, err := io.ReadFull(osFile, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return
 	}
-	osFile.Seek(0, 0)
-	f.ContentType = http.DetectContentType(buffer)
+	f.ContentType = detectContentType(buffer[:n], f.Name)
 }
 
 func (f File) ListFile() ListFile {
+	thumbURL := ""
+	if f.thumbnailable() {
+		thumbURL = f.urlFor("thumb")
+	}
+	streamURL := ""
+	if f.Media != nil && f.Media.Container == "mp4" {
+		streamURL = f.urlFor("stream") + "/"
+	}
+	relPath := f.RelPath
+	if f.Archive != "" {
+		// Members are grouped under the archive as if it was a directory
+		relPath = strings.Replace(relPath, archiveSeparator, "/", 1)
+	}
 	return ListFile{
 		Name:        f.Name,
 		ModDate:     f.ModDate,
@@ -172,10 +268,20 @@ func (f File) ListFile() ListFile {
 		ContentURL:  f.urlFor("content"),
 		VideoURL:    f.urlFor("video"),
 		ViewURL:     f.urlFor("view"),
-		Directories: removeEmpty(strings.Split(f.RelPath, "/")), //string(filepath.Separator))),
+		ThumbURL:    thumbURL,
+		StreamURL:   streamURL,
+		IsArchive:   f.isArchive(),
+		Image:       f.Image,
+		Media:       f.Media,
+		Directories: removeEmpty(strings.Split(relPath, "/")), //string(filepath.Separator))),
 	}
 }
 
+// Key of the file in CacheFiles
+func (f ListFile) cacheKey() string {
+	return "/" + strings.Join(append(append([]string{}, f.Directories...), f.Name), "/")
+}
+
 func (f ListFile) ListFileGrouped() *ListFileGrouped {
 	return &ListFileGrouped{
 		Name:        f.Name,
@@ -187,6 +293,11 @@ func (f ListFile) ListFileGrouped() *ListFileGrouped {
 		ContentURL:  f.ContentURL,
 		VideoURL:    f.VideoURL,
 		ViewURL:     f.ViewURL,
+		ThumbURL:    f.ThumbURL,
+		StreamURL:   f.StreamURL,
+		IsArchive:   f.IsArchive,
+		Image:       f.Image,
+		Media:       f.Media,
 		Directories: f.Directories,
 		Grouped:     []*ListFileGrouped{},
 	}
@@ -0,0 +1,3 @@
+module github.com/Attumm/silo
+
+go 1.22
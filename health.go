@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.version=v1.2.3"
+var version = ""
+
+var startTime = time.Now()
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return "dev"
+}
+
+type HealthResponse struct {
+	Status string
+}
+
+type ReadyCheck struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+type ReadyResponse struct {
+	Ready  bool
+	Checks []ReadyCheck
+}
+
+type StatusResponse struct {
+	Version    string
+	Started    int64
+	UptimeSec  int64
+	Settings   map[string]string
+	CacheItems int
+	// Unix time the last sync finished, 0 before the first sync
+	LastSync   int64
+	LastSyncMs int64
+	DiskFree   uint64 `json:",omitempty"`
+	DiskTotal  uint64 `json:",omitempty"`
+}
+
+// The first sync has finished, the listing is complete
+func synced() bool {
+	return lastSyncTime.Load() != 0
+}
+
+// Checks of /readyz, errors do not contain paths since /readyz is public
+func readyChecks() []ReadyCheck {
+	base := SETTINGS.Get("base")
+	check := func(name string, ok bool, reason string) ReadyCheck {
+		if ok {
+			return ReadyCheck{Name: name, OK: true}
+		}
+		return ReadyCheck{Name: name, Error: reason}
+	}
+
+	readable := false
+	if dir, err := os.Open(base); err == nil {
+		_, err = dir.Readdirnames(1)
+		readable = err == nil || err == io.EOF
+		dir.Close()
+	}
+
+	return []ReadyCheck{
+		check("shutdown", !isShuttingDown(), "Server is shutting down"),
+		check("sync", synced(), "First sync has not finished"),
+		check("base-readable", readable, "Base directory is not readable"),
+		check("base-writable", dirWritable(base), "Base directory is not writable"),
+	}
+}
+
+// GET /healthz, the process is alive
+func healthzRest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, HealthResponse{Status: "ok"})
+}
+
+// GET /readyz, 503 until the first sync finished, while the base
+// directory can not be read or written and once shutdown started.
+func readyzRest(w http.ResponseWriter, r *http.Request) {
+	response := ReadyResponse{Ready: true, Checks: readyChecks()}
+	for _, check := range response.Checks {
+		response.Ready = response.Ready && check.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, response)
+}
+
+// Admin API
+// GET /status, version, settings with secrets redacted, cache and disk
+func statusRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	if !requireAdmin(w, r) {
+		return
+	}
+	settings := map[string]string{}
+	for _, key := range SETTINGS.Keys() {
+		settings[key] = redactedSetting(key)
+	}
+	response := StatusResponse{
+		Version:    buildVersion(),
+		Started:    startTime.Unix(),
+		UptimeSec:  int64(time.Since(startTime).Seconds()),
+		Settings:   settings,
+		CacheItems: Cache.Length(),
+		LastSync:   lastSyncTime.Load() / int64(time.Second),
+		LastSyncMs: time.Duration(lastSyncDuration.Load()).Milliseconds(),
+	}
+	if free, total, err := diskSpace(SETTINGS.Get("base")); err == nil {
+		response.DiskFree = free
+		response.DiskTotal = total
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, response)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	base, err := os.MkdirTemp("", "silo-ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	defer func(base string, synced int64) {
+		SETTINGS.VarString["base"] = base
+		lastSyncTime.Store(synced)
+	}(SETTINGS.Get("base"), lastSyncTime.Load())
+
+	defer func(ch chan struct{}) {
+		shuttingDown = ch
+	}(shuttingDown)
+	closed := make(chan struct{})
+	close(closed)
+
+	tests := []struct {
+		base         string
+		synced       bool
+		shuttingDown bool
+		expected     int
+		failed       string
+	}{
+		{base, true, false, 200, ""},
+		{base, false, false, 503, "sync"},
+		{base + "/missing", true, false, 503, "base-readable"},
+		{base + "/missing", true, false, 503, "base-writable"},
+		{base, true, true, 503, "shutdown"},
+	}
+	for tcNumber, test := range tests {
+		SETTINGS.VarString["base"] = test.base
+		shuttingDown = make(chan struct{})
+		if test.shuttingDown {
+			shuttingDown = closed
+		}
+		lastSyncTime.Store(0)
+		if test.synced {
+			recordSync(time.Now())
+		}
+		w := httptest.NewRecorder()
+		readyzRest(w, httptest.NewRequest("GET", "/readyz", nil))
+		response := ReadyResponse{}
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != test.expected || response.Ready != (test.expected == 200) {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", w.Code, response)
+		}
+		for _, check := range response.Checks {
+			if check.Name == test.failed && check.OK {
+				t.Error("testcase", tcNumber, "expected failed check", test.failed, "!=", response.Checks)
+			}
+		}
+	}
+	entries, _ := os.ReadDir(base)
+	if len(entries) != 0 {
+		t.Error("expected the writable check to not create files, found", entries)
+	}
+}
+
+// Run with -race, /status reads the cache while the sync replaces items
+func TestStatusDuringUpdate(t *testing.T) {
+	defer func(token string, items CacheMap) {
+		SETTINGS.VarString["admin-token"] = token
+		Cache.Update(items)
+	}(SETTINGS.Get("admin-token"), Cache.Items)
+	SETTINGS.VarString["admin-token"] = "secret"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Cache.Update(CacheMap{"/a.txt": {Name: "a.txt", RelPath: "/", ModDate: int64(i)}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		statusRest(w, r)
+		status := StatusResponse{}
+		if w.Code != 200 || json.NewDecoder(w.Body).Decode(&status) != nil {
+			t.Fatal("unexpected status", w.Code, w.Body.String())
+		}
+	}
+	<-done
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Fragments are joined into segments of at least this many seconds
+const hlsTargetSegment = 6.0
+
+// Files that are not fragmented are remuxed, see hlsremux.go
+var errNotFragmented = errors.New("Not a fragmented MP4 file")
+
+// Byte range of the file with its duration in seconds
+type hlsSegment struct {
+	offset   int64
+	length   int64
+	duration float64
+}
+
+// Sum of the sample durations of the track in a moof box,
+// in the timescale of the track.
+func moofDuration(moof []byte, track *mp4Track) uint64 {
+	total := uint64(0)
+	for _, traf := range mp4Children(moof, "traf") {
+		tfhd := mp4Find(traf, "tfhd")
+		if len(tfhd) < 8 || binary.BigEndian.Uint32(tfhd[4:8]) != track.id {
+			continue
+		}
+		defaultDuration := track.defaultDuration
+		flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xFFFFFF
+		offset := 8
+		if flags&0x1 != 0 {
+			offset += 8
+		}
+		if flags&0x2 != 0 {
+			offset += 4
+		}
+		if flags&0x8 != 0 && len(tfhd) >= offset+4 {
+			defaultDuration = binary.BigEndian.Uint32(tfhd[offset:])
+		}
+		for _, trun := range mp4Children(traf, "trun") {
+			total += trunDuration(trun, defaultDuration)
+		}
+	}
+	return total
+}
+
+func trunDuration(trun []byte, defaultDuration uint32) uint64 {
+	if len(trun) < 8 {
+		return 0
+	}
+	flags := binary.BigEndian.Uint32(trun[0:4]) & 0xFFFFFF
+	count := binary.BigEndian.Uint32(trun[4:8])
+	if flags&0x100 == 0 {
+		return uint64(count) * uint64(defaultDuration)
+	}
+	offset := 8
+	if flags&0x1 != 0 {
+		offset += 4
+	}
+	if flags&0x4 != 0 {
+		offset += 4
+	}
+	sampleSize := 0
+	for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&flag != 0 {
+			sampleSize += 4
+		}
+	}
+	total := uint64(0)
+	for i := uint32(0); i < count && offset+4 <= len(trun); i++ {
+		total += uint64(binary.BigEndian.Uint32(trun[offset:]))
+		offset += sampleSize
+	}
+	return total
+}
+
+// Split a fragmented MP4 in the init section, everything before the
+// first moof, and segments of whole fragments.
+func hlsSegments(r io.ReaderAt, size int64) (int64, []hlsSegment, error) {
+	movie, boxes, err := readMp4Movie(r, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	track := movie.mainTrack()
+	if !movie.fragmented || track == nil || track.timescale == 0 {
+		return 0, nil, errNotFragmented
+	}
+
+	initLength := int64(-1)
+	fragments := []hlsSegment{}
+	for i, box := range boxes {
+		if box.typ != "moof" {
+			continue
+		}
+		if initLength == -1 {
+			initLength = box.offset
+		}
+		moof, err := readMp4Payload(r, box)
+		if err != nil {
+			return 0, nil, err
+		}
+		// A fragment runs until the next moof, including its mdat
+		end := size
+		for _, next := range boxes[i+1:] {
+			if next.typ == "moof" {
+				end = next.offset
+				break
+			}
+		}
+		fragments = append(fragments, hlsSegment{
+			offset:   box.offset,
+			length:   end - box.offset,
+			duration: float64(moofDuration(moof, track)) / float64(track.timescale),
+		})
+	}
+	if initLength == -1 {
+		return 0, nil, errNotFragmented
+	}
+
+	segments := []hlsSegment{}
+	for _, fragment := range fragments {
+		last := len(segments) - 1
+		if last >= 0 && segments[last].duration < hlsTargetSegment {
+			segments[last].length += fragment.length
+			segments[last].duration += fragment.duration
+			continue
+		}
+		segments = append(segments, fragment)
+	}
+	return initLength, segments, nil
+}
+
+func hlsPlaylistHeader(b *strings.Builder, durations []float64) {
+	target := 1.0
+	for _, duration := range durations {
+		target = math.Max(target, math.Ceil(duration))
+	}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+}
+
+// VOD playlist with byte ranges into the original file on /content/
+func hlsPlaylist(contentURL string, initLength int64, segments []hlsSegment) string {
+	durations := []float64{}
+	for _, segment := range segments {
+		durations = append(durations, segment.duration)
+	}
+	var b strings.Builder
+	hlsPlaylistHeader(&b, durations)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n", contentURL, initLength)
+	for _, segment := range segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", segment.duration, segment.length, segment.offset, contentURL)
+	}
+	fmt.Fprintf(&b, "#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// VOD playlist of a remuxed file, the init segment and segments
+// are served below the stream URL.
+func hlsRemuxPlaylist(streamURL string, durations []float64) string {
+	var b strings.Builder
+	hlsPlaylistHeader(&b, durations)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%sinit.mp4\"\n", streamURL)
+	for i, duration := range durations {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%sseg%d.m4s\n", duration, streamURL, i)
+	}
+	fmt.Fprintf(&b, "#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// The file and the part of a stream requested, the playlist for
+// <path>/ and <path>/index.m3u8, init.mp4 and seg<n>.m4s for the
+// segments of a remuxed file.
+func streamTarget(p string) (*File, string, bool) {
+	p = stripTrailingSlash(p)
+	if file, found := Cache.Get(p); found {
+		return file, "", true
+	}
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return nil, "", false
+	}
+	file, found := Cache.Get(p[:i])
+	return file, p[i+1:], found
+}
+
+// Serves /stream/<path>/ with the HLS playlist of an MP4. Fragmented
+// files are served by byte range from /content/, others are remuxed
+// into fragments. Poster frames are not made, that needs a video decoder.
+func streamRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	filename, err := url.PathUnescape(r.URL.Path[len("/stream"):])
+	if err != nil {
+		ErrorResponse(w, "Unable to parse URL", http.StatusBadRequest)
+		return
+	}
+	file, part, found := streamTarget(filename)
+	if !found || file.IsDir || file.Archive != "" {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if mediaContainer(file.Name) != "mp4" {
+		ErrorResponse(w, "Only MP4 files can be streamed", http.StatusUnsupportedMediaType)
+		return
+	}
+	segment := -1
+	switch {
+	case part == "" || part == "index.m3u8" || part == "init.mp4":
+	case strings.HasPrefix(part, "seg") && strings.HasSuffix(part, ".m4s"):
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(part, "seg"), ".m4s"))
+		if err != nil || n < 0 {
+			ErrorResponse(w, "File not found", http.StatusNotFound)
+			return
+		}
+		segment = n
+	default:
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	osFile, err := os.Open(file.fullPath())
+	if err != nil {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer osFile.Close()
+	info, err := osFile.Stat()
+	if err != nil {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	initLength, segments, err := hlsSegments(osFile, info.Size())
+	if err == nil {
+		if part != "" && part != "index.m3u8" {
+			ErrorResponse(w, "File not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, hlsPlaylist(file.urlFor("content"), initLength, segments))
+		return
+	}
+	if err != errNotFragmented {
+		ErrorResponse(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	remux, err := hlsRemuxes.get(file, func() (*hlsRemux, error) {
+		return readHlsRemux(osFile, info.Size())
+	})
+	if err != nil {
+		ErrorResponse(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	switch {
+	case part == "init.mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(remux.init)
+	case segment >= 0:
+		if segment >= len(remux.durations) {
+			ErrorResponse(w, "File not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		remux.writeSegment(w, osFile, segment)
+	default:
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, hlsRemuxPlaylist(file.urlFor("stream")+"/", remux.durations))
+	}
+}
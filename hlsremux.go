@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// MP4 files that are not fragmented are streamed by remuxing them into
+// fragments on request. The init segment is the moov with empty sample
+// tables, every segment is a moof and mdat with the samples copied from
+// the file. Segments start at key frames of the video track.
+
+// Most samples read of a track, two hours of 60 fps video are 432000
+const mp4MaxSamples = 1 << 21
+
+var errNoSamples = errors.New("Unable to read the samples of the media file")
+
+// A sample of a track, decode is the decode time in the track timescale
+type mp4Sample struct {
+	offset   int64
+	size     uint32
+	decode   uint64
+	duration uint32
+	cto      int32
+	sync     bool
+}
+
+type remuxTrack struct {
+	id        uint32
+	timescale uint32
+	samples   []mp4Sample
+}
+
+type hlsRemux struct {
+	init      []byte
+	tracks    []*remuxTrack
+	durations []float64
+	// First sample of every segment per track, with the sample count last
+	bounds [][]int
+}
+
+// Indexes of recently streamed files, a playlist is followed by
+// requests for every segment.
+var hlsRemuxes = newIndexCache[*hlsRemux](16)
+
+func mp4BoxBytes(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], typ)
+	return append(box, payload...)
+}
+
+func mp4Uint32s(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// Call fn for every direct child box of payload
+func mp4Each(payload []byte, fn func(typ string, payload []byte)) {
+	boxes, _ := readMp4Boxes(bytes.NewReader(payload), 0, int64(len(payload)))
+	for _, box := range boxes {
+		fn(box.typ, payload[box.offset+box.headerSize:box.end()])
+	}
+}
+
+// Entries of a full box table, the count follows version and flags
+func mp4Table(payload []byte, headerSize, entrySize int) ([]byte, int, bool) {
+	if len(payload) < headerSize {
+		return nil, 0, false
+	}
+	count := int(binary.BigEndian.Uint32(payload[headerSize-4:]))
+	if count > mp4MaxSamples || len(payload) < headerSize+count*entrySize {
+		return nil, 0, false
+	}
+	return payload[headerSize:], count, true
+}
+
+// Samples from the stbl sample tables, stsz, stco or co64, stsc and
+// stts are required, ctts and stss are optional.
+func parseMp4Samples(stbl []byte) ([]mp4Sample, error) {
+	stsz := mp4Find(stbl, "stsz")
+	if len(stsz) < 12 {
+		return nil, errNoSamples
+	}
+	constantSize := binary.BigEndian.Uint32(stsz[4:8])
+	sizes, count, ok := mp4Table(stsz, 12, 4)
+	if constantSize != 0 {
+		count = int(binary.BigEndian.Uint32(stsz[8:12]))
+		ok = count <= mp4MaxSamples
+	}
+	if !ok {
+		return nil, errNoSamples
+	}
+
+	offsets := []int64{}
+	if stco := mp4Find(stbl, "stco"); stco != nil {
+		table, chunks, ok := mp4Table(stco, 8, 4)
+		if !ok {
+			return nil, errNoSamples
+		}
+		for i := 0; i < chunks; i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(table[4*i:])))
+		}
+	} else if co64 := mp4Find(stbl, "co64"); co64 != nil {
+		table, chunks, ok := mp4Table(co64, 8, 8)
+		if !ok {
+			return nil, errNoSamples
+		}
+		for i := 0; i < chunks; i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(table[8*i:])))
+		}
+	}
+
+	stsc, entries, ok := mp4Table(mp4Find(stbl, "stsc"), 8, 12)
+	if !ok || entries == 0 {
+		return nil, errNoSamples
+	}
+	samples := make([]mp4Sample, 0, count)
+	entry := 0
+	for chunk := 0; chunk < len(offsets) && len(samples) < count; chunk++ {
+		for entry+1 < entries && int(binary.BigEndian.Uint32(stsc[12*(entry+1):])) <= chunk+1 {
+			entry++
+		}
+		perChunk := binary.BigEndian.Uint32(stsc[12*entry+4:])
+		offset := offsets[chunk]
+		for i := uint32(0); i < perChunk && len(samples) < count; i++ {
+			size := constantSize
+			if size == 0 {
+				size = binary.BigEndian.Uint32(sizes[4*len(samples):])
+			}
+			samples = append(samples, mp4Sample{offset: offset, size: size, sync: true})
+			offset += int64(size)
+		}
+	}
+	if len(samples) != count || count == 0 {
+		return nil, errNoSamples
+	}
+
+	stts, entries, ok := mp4Table(mp4Find(stbl, "stts"), 8, 8)
+	if !ok {
+		return nil, errNoSamples
+	}
+	i, decode := 0, uint64(0)
+	for e := 0; e < entries && i < count; e++ {
+		n := binary.BigEndian.Uint32(stts[8*e:])
+		delta := binary.BigEndian.Uint32(stts[8*e+4:])
+		for j := uint32(0); j < n && i < count; j++ {
+			samples[i].decode = decode
+			samples[i].duration = delta
+			decode += uint64(delta)
+			i++
+		}
+	}
+	if i != count {
+		return nil, errNoSamples
+	}
+
+	// Composition offsets are signed in version 1, version 0 files
+	// written as signed are common as well.
+	if ctts, entries, ok := mp4Table(mp4Find(stbl, "ctts"), 8, 8); ok {
+		i := 0
+		for e := 0; e < entries && i < count; e++ {
+			n := binary.BigEndian.Uint32(ctts[8*e:])
+			cto := int32(binary.BigEndian.Uint32(ctts[8*e+4:]))
+			for j := uint32(0); j < n && i < count; j++ {
+				samples[i].cto = cto
+				i++
+			}
+		}
+	}
+
+	// Without stss every sample is a sync sample
+	if stss, entries, ok := mp4Table(mp4Find(stbl, "stss"), 8, 4); ok {
+		for i := range samples {
+			samples[i].sync = false
+		}
+		for e := 0; e < entries; e++ {
+			number := int(binary.BigEndian.Uint32(stss[4*e:]))
+			if number >= 1 && number <= count {
+				samples[number-1].sync = true
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Box of the init segment, the sample tables are emptied and
+// kept empty as the samples are in the fragments.
+func remuxInitBox(typ string, payload []byte) []byte {
+	switch typ {
+	case "mdia", "minf":
+		children := [][]byte{}
+		mp4Each(payload, func(typ string, payload []byte) {
+			children = append(children, remuxInitBox(typ, payload))
+		})
+		return mp4BoxBytes(typ, children...)
+	case "stbl":
+		return mp4BoxBytes(typ,
+			mp4BoxBytes("stsd", mp4Find(payload, "stsd")),
+			mp4BoxBytes("stts", make([]byte, 8)),
+			mp4BoxBytes("stsc", make([]byte, 8)),
+			mp4BoxBytes("stsz", make([]byte, 12)),
+			mp4BoxBytes("stco", make([]byte, 8)))
+	}
+	return mp4BoxBytes(typ, payload)
+}
+
+// Index of an MP4 that is not fragmented, with its video and audio
+// tracks split in segments.
+func readHlsRemux(r io.ReaderAt, size int64) (*hlsRemux, error) {
+	_, boxes, err := readMp4Movie(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var moov []byte
+	for _, box := range boxes {
+		if box.typ == "moov" {
+			if moov, err = readMp4Payload(r, box); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	remux := &hlsRemux{}
+	traks := [][]byte{}
+	trex := [][]byte{}
+	var main *remuxTrack
+	mainVideo := false
+	for _, trak := range mp4Children(moov, "trak") {
+		info := parseMp4Track(trak)
+		if (info.handler != "vide" && info.handler != "soun") || info.timescale == 0 {
+			continue
+		}
+		samples, err := parseMp4Samples(mp4Find(trak, "mdia", "minf", "stbl"))
+		if err != nil {
+			continue
+		}
+		for _, sample := range samples {
+			if sample.offset < 0 || sample.offset+int64(sample.size) > size {
+				return nil, errNoSamples
+			}
+		}
+		track := &remuxTrack{id: info.id, timescale: info.timescale, samples: samples}
+		remux.tracks = append(remux.tracks, track)
+		if main == nil || (info.handler == "vide" && !mainVideo) {
+			main, mainVideo = track, info.handler == "vide"
+		}
+
+		children := [][]byte{}
+		mp4Each(trak, func(typ string, payload []byte) {
+			if typ == "tkhd" || typ == "edts" || typ == "mdia" {
+				children = append(children, remuxInitBox(typ, payload))
+			}
+		})
+		traks = append(traks, mp4BoxBytes("trak", children...))
+		trex = append(trex, mp4BoxBytes("trex", mp4Uint32s(0, info.id, 1, 0, 0, 0)))
+	}
+	if main == nil {
+		return nil, errNoSamples
+	}
+
+	ftyp := mp4BoxBytes("ftyp", []byte("iso6"), make([]byte, 4), []byte("iso6isommp41"))
+	moovChildren := append([][]byte{mp4BoxBytes("mvhd", mp4Find(moov, "mvhd"))}, traks...)
+	moovChildren = append(moovChildren, mp4BoxBytes("mvex", trex...))
+	remux.init = append(ftyp, mp4BoxBytes("moov", moovChildren...)...)
+
+	// Segments of the main track start at a sync sample after at
+	// least the target duration.
+	mainBounds := []int{0}
+	for i, sample := range main.samples {
+		start := main.samples[mainBounds[len(mainBounds)-1]].decode
+		if i > 0 && sample.sync && float64(sample.decode-start)/float64(main.timescale) >= hlsTargetSegment {
+			mainBounds = append(mainBounds, i)
+		}
+	}
+	last := main.samples[len(main.samples)-1]
+	end := last.decode + uint64(last.duration)
+	for k, first := range mainBounds {
+		next := end
+		if k+1 < len(mainBounds) {
+			next = main.samples[mainBounds[k+1]].decode
+		}
+		remux.durations = append(remux.durations, float64(next-main.samples[first].decode)/float64(main.timescale))
+	}
+
+	// Other tracks are cut at the same times
+	for _, track := range remux.tracks {
+		bounds := []int{0}
+		for _, first := range mainBounds[1:] {
+			at := main.samples[first].decode
+			bounds = append(bounds, sort.Search(len(track.samples), func(i int) bool {
+				return track.samples[i].decode*uint64(main.timescale) >= at*uint64(track.timescale)
+			}))
+		}
+		remux.bounds = append(remux.bounds, append(bounds, len(track.samples)))
+	}
+	return remux, nil
+}
+
+// The moof of a segment, dataOffset is where the samples start in
+// the mdat, relative to the start of the moof.
+func (remux *hlsRemux) moof(segment int, dataOffset uint32) []byte {
+	trafs := [][]byte{mp4BoxBytes("mfhd", mp4Uint32s(0, uint32(segment+1)))}
+	for t, track := range remux.tracks {
+		samples := track.samples[remux.bounds[t][segment]:remux.bounds[t][segment+1]]
+		if len(samples) == 0 {
+			continue
+		}
+		// Version 1 for signed composition offsets, with sample
+		// duration, size, flags and composition offset present.
+		trun := mp4Uint32s(1<<24|0xF01, uint32(len(samples)), dataOffset)
+		for _, sample := range samples {
+			flags := uint32(0x01010000)
+			if sample.sync {
+				flags = 0x02000000
+			}
+			trun = append(trun, mp4Uint32s(sample.duration, sample.size, flags, uint32(sample.cto))...)
+			dataOffset += sample.size
+		}
+		tfdt := append(mp4Uint32s(1<<24), make([]byte, 8)...)
+		binary.BigEndian.PutUint64(tfdt[4:], samples[0].decode)
+		trafs = append(trafs, mp4BoxBytes("traf",
+			// default-base-is-moof
+			mp4BoxBytes("tfhd", mp4Uint32s(0x020000, track.id)),
+			mp4BoxBytes("tfdt", tfdt),
+			mp4BoxBytes("trun", trun)))
+	}
+	return mp4BoxBytes("moof", trafs...)
+}
+
+// Write a segment, the samples are copied from r
+func (remux *hlsRemux) writeSegment(w io.Writer, r io.ReaderAt, segment int) error {
+	if segment < 0 || segment >= len(remux.durations) {
+		return errNoSamples
+	}
+	dataSize := uint64(0)
+	for t, track := range remux.tracks {
+		for _, sample := range track.samples[remux.bounds[t][segment]:remux.bounds[t][segment+1]] {
+			dataSize += uint64(sample.size)
+		}
+	}
+	if dataSize > 1<<31 {
+		return errNoSamples
+	}
+	// The moof size does not depend on the data offset
+	moofSize := len(remux.moof(segment, 0))
+	moof := remux.moof(segment, uint32(moofSize+8))
+	mdat := mp4Uint32s(uint32(dataSize+8), 0)
+	copy(mdat[4:], "mdat")
+	if _, err := w.Write(append(moof, mdat...)); err != nil {
+		return err
+	}
+	for t, track := range remux.tracks {
+		for _, sample := range track.samples[remux.bounds[t][segment]:remux.bounds[t][segment+1]] {
+			if _, err := io.Copy(w, io.NewSectionReader(r, sample.offset, int64(sample.size))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "sync"
+
+// Indexes built by reading a file, such as the segments of a video.
+// An index is kept per path until the file changes, the oldest is
+// dropped when the cache is full.
+type indexCache[V any] struct {
+	mu      sync.Mutex
+	max     int
+	order   []string
+	entries map[string]indexEntry[V]
+}
+
+type indexEntry[V any] struct {
+	modDate int64
+	size    int64
+	value   V
+}
+
+func newIndexCache[V any](max int) *indexCache[V] {
+	return &indexCache[V]{max: max, entries: make(map[string]indexEntry[V])}
+}
+
+// The index of the file, load builds it when missing or outdated.
+// Errors are not cached.
+func (c *indexCache[V]) get(f *File, load func() (V, error)) (V, error) {
+	key := f.fullPath()
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	c.mu.Unlock()
+	if found && entry.modDate == f.ModDate && entry.size == f.Size {
+		return entry.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[key]; !found {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = indexEntry[V]{modDate: f.ModDate, size: f.Size, value: value}
+	for len(c.order) > c.max {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	return value, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("broken")
+		}
+		w.Write([]byte("hello"))
+	}), requestIDMiddleware, accessLogMiddleware, recoverMiddleware)
+
+	tests := []struct {
+		path      string
+		requestID string
+		status    int
+		bytes     int
+	}{
+		{"/hello", "", 200, 5},
+		{"/hello", "proxy-id-1", 200, 5},
+		{"/hello", "bad id", 200, 5},
+		{"/panic", "", 500, -1},
+	}
+	for tcNumber, test := range tests {
+		logs.Reset()
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.requestID != "" {
+			r.Header.Set(requestIDHeader, test.requestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		kept := id == test.requestID
+		if id == "" || kept != validRequestID(test.requestID) {
+			t.Error("testcase", tcNumber, "expected request id", test.requestID, "!=", id)
+		}
+		if w.Code != test.status {
+			t.Error("testcase", tcNumber, "expected", test.status, "!=", w.Code)
+		}
+		if test.status == 500 && w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Error("testcase", tcNumber, "expected problem+json !=", w.Header().Get("Content-Type"))
+		}
+
+		// the access log is the last line
+		lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+		entry := map[string]interface{}{}
+		json.Unmarshal(lines[len(lines)-1], &entry)
+		if entry["msg"] != "request" || entry["request_id"] != id || entry["path"] != test.path ||
+			entry["status"] != float64(test.status) || entry["method"] != "GET" {
+			t.Error("testcase", tcNumber, "unexpected access log", string(lines[len(lines)-1]))
+		}
+		if test.bytes >= 0 && entry["bytes"] != float64(test.bytes) {
+			t.Error("testcase", tcNumber, "expected", test.bytes, "!=", entry["bytes"])
+		}
+		if test.status == 500 && len(lines) != 2 {
+			t.Error("testcase", tcNumber, "expected panic to be logged", logs.String())
+		}
+	}
+}
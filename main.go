@@ -10,57 +10,125 @@ This will prevent many security issues.
 */
 
 // TODO list
-// ADD Context package, for lifecycle and cancellation of requests
 // ADD something of users, or inbox
 
 // Maybe ADD META through Shadow files with meta data
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var Cache = &CacheFiles{Items: make(CacheMap)}
 
 func init() {
 
+	SETTINGS.Set("config", "", "Config file, JSON or key = value lines")
 	SETTINGS.SetParsed("base", "/files", "set the basedir", BasePathParser)
 	SETTINGS.Set("host", "0.0.0.0:8000", "enter host with port")
-	SETTINGS.Set("cors", "not-set", "Domains whitelisted under cors")
-	SETTINGS.SetInt("sync", 600, "Pauze between directory cache syncs, in seconds")
-
-	SETTINGS.Parse()
+	SETTINGS.Set("log-level", "info", "Log level, debug, info, warn or error")
+	SETTINGS.SetDuration("read-timeout", time.Hour, "Max duration of reading a request including an upload, 0 for no limit")
+	SETTINGS.SetDuration("write-timeout", time.Hour, "Max duration of writing a response such as a download, 0 for no limit, event streams have none")
+	SETTINGS.SetDuration("idle-timeout", 2*time.Minute, "How long idle keep-alive connections are kept open")
+	SETTINGS.SetDuration("shutdown-timeout", 30*time.Second, "How long requests in flight may finish on SIGTERM")
+	SETTINGS.SetList("cors", []string{}, "Origins allowed cross-origin requests, such as https://*.example.com, * for any")
+	SETTINGS.SetList("cors-methods", []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}, "Methods allowed in cross-origin requests")
+	SETTINGS.SetList("cors-headers", []string{"Authorization", "Content-Type", "If-None-Match", "If-Modified-Since", "Last-Event-ID", "Range"},
+		"Request headers allowed in cross-origin requests, * for any")
+	SETTINGS.SetBool("cors-credentials", false, "Allow cookies and authorization in cross-origin requests")
+	SETTINGS.SetDuration("cors-max-age", 10*time.Minute, "How long browsers may cache a preflight response")
+	SETTINGS.SetDuration("sync", 600*time.Second, "Pauze between directory cache syncs, such as 10m, plain numbers are seconds")
+	SETTINGS.SetBytes("extract-max-size", 1<<30, 1<<20, "Max total size of an extracted archive upload, such as 2GB, plain numbers are MB")
+	SETTINGS.SetInt("extract-max-ratio", 100, "Max ratio between extracted and uploaded archive size")
+	SETTINGS.SetInt("extract-max-files", 10000, "Max number of files in an extracted archive upload")
+	SETTINGS.SetBool("archive-browse", false, "List members of zip and tar archives as virtual files")
+	SETTINGS.Set("content-types", "", "Content type per extension, overrides detection, .ext=type,.ext=type")
+	SETTINGS.Set("thumb-dir", "", "Directory for cached thumbnails, defaults to .silo-thumbs in the temp dir")
+	SETTINGS.SetBool("thumb-sync", false, "Create default size thumbnails for new images during sync")
+	SETTINGS.SetSecret("admin-token", "", "Bearer token for the admin API, admin API is disabled when empty")
+	SETTINGS.SetList("webhooks", []string{}, "Comma separated webhook urls, receiving all file events")
+	SETTINGS.SetSecret("webhook-secret", "", "Secret used to sign the webhooks from settings")
+	SETTINGS.Set("webhook-store", "", "Directory for registered webhooks and the delivery queue, defaults to .silo-webhooks in base")
+
+	SETTINGS.Validate("base", validateBase)
+	SETTINGS.Validate("host", validateHost)
+	SETTINGS.Validate("sync", validatePositive("sync"))
+	SETTINGS.Validate("extract-max-size", validatePositive("extract-max-size"))
+	SETTINGS.Validate("extract-max-ratio", validatePositive("extract-max-ratio"))
+	SETTINGS.Validate("extract-max-files", validatePositive("extract-max-files"))
+	SETTINGS.Validate("webhooks", validateWebhookURLs)
+	SETTINGS.Validate("log-level", validateLogLevel)
+	SETTINGS.Validate("shutdown-timeout", validatePositive("shutdown-timeout"))
+
+	// Changed through SIGHUP or /admin/reload, everything else needs a restart
+	SETTINGS.Reloadable("log-level", "cors", "cors-methods", "cors-headers", "cors-credentials", "cors-max-age", "sync", "admin-token", "webhooks", "webhook-secret", "content-types",
+		"thumb-dir", "thumb-sync", "archive-browse", "extract-max-size", "extract-max-ratio", "extract-max-files")
+	SETTINGS.OnReload(func(reloaded []string) {
+		if containsString(reloaded, "sync") {
+			wakeSync()
+		}
+		if containsString(reloaded, "log-level") {
+			logLevel.Set(settingLogLevel(SETTINGS))
+		}
+		if containsString(reloaded, "webhooks") || containsString(reloaded, "webhook-secret") {
+			Webhooks.LoadSettings()
+		}
+	})
 }
 
 func main() {
-
-	fmt.Println("Start server:", SETTINGS.Get("host"))
-	fmt.Println("File path:", SETTINGS.Get("base"))
-
-	fmt.Println("Sync pauze, seconds:", SETTINGS.GetInt("sync"))
-
-	go syncFiles(SETTINGS.Get("base"))
-
-	//Rest Api
-	http.HandleFunc("/list/group/", listGroupedRest)
-	http.HandleFunc("/list/", listRest)
-
-	http.HandleFunc("/detail/", detailRest)
-	http.HandleFunc("/content/", contentRest)
-	http.HandleFunc("/upload/", uploadRest)
-	http.HandleFunc("/delete/", deleteRest)
-
-	http.HandleFunc("/cycle/", cycleRest)
-
-	// Vue view
-	http.HandleFunc("/", indexView)
-
-	//HTML Views
-	http.HandleFunc("/items", itemsView)
-	http.HandleFunc("/view/", viewView)
-	http.HandleFunc("/video/", videoView)
-	http.HandleFunc("/add/", addView)
-
-	log.Fatal(http.ListenAndServe(SETTINGS.Get("host"), nil))
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, found := commands[os.Args[1]]
+		if !found {
+			commandUsage()
+			os.Exit(2)
+		}
+		os.Exit(command(os.Args[2:]))
+	}
+
+	err := SETTINGS.Parse(os.Args[1:])
+	for _, warning := range SETTINGS.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "invalid settings:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	setupLogging()
+	logger.Info("start server", "host", SETTINGS.Get("host"), "base", SETTINGS.Get("base"),
+		"sync", SETTINGS.GetDuration("sync").String())
+
+	// SIGTERM and ctrl-c stop the server gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go syncFiles(ctx, SETTINGS.Get("base"))
+
+	Webhooks.Load(webhookStoreDir())
+	go Webhooks.Run()
+	go watchReloadSignal()
+
+	routes(http.DefaultServeMux)
+
+	handler := chain(http.DefaultServeMux,
+		requestIDMiddleware, accessLogMiddleware, metricsMiddleware(http.DefaultServeMux), recoverMiddleware, corsMiddleware)
+	err = serve(ctx, newServer(handler))
+	Webhooks.Flush()
+	if err != nil {
+		logger.Error("server stopped", "error", err.Error())
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
 }
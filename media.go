@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Container metadata of video and audio files.
+// Duration is in seconds, Fragmented is set for fragmented MP4
+// files, which are streamed with HLS as they are, other MP4 files
+// are remuxed.
+type MediaMeta struct {
+	Container  string
+	Duration   float64
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	Fragmented bool
+}
+
+var errNoMedia = errors.New("Unable to parse media container")
+
+// Largest box that is read in memory, moov of long movies are a few MB.
+const mp4MaxBoxSize = 64 << 20
+
+func mediaContainer(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return "mp4"
+	case ".mkv":
+		return "matroska"
+	case ".webm":
+		return "webm"
+	}
+	return ""
+}
+
+func (f *File) SetMediaMeta() {
+	if f.IsDir || f.Archive != "" {
+		return
+	}
+	container := mediaContainer(f.Name)
+	if container == "" {
+		return
+	}
+	osFile, err := os.Open(f.fullPath())
+	if err != nil {
+		return
+	}
+	defer osFile.Close()
+
+	var meta *MediaMeta
+	if container == "mp4" {
+		meta, err = readMp4Meta(osFile, f.Size)
+	} else {
+		meta, err = readMatroskaMeta(osFile, f.Size)
+	}
+	if err == nil {
+		f.Media = meta
+	}
+}
+
+// MP4
+
+type mp4Box struct {
+	typ        string
+	offset     int64
+	size       int64
+	headerSize int64
+}
+
+func (b mp4Box) end() int64 {
+	return b.offset + b.size
+}
+
+// Read the box headers between start and end
+func readMp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	boxes := []mp4Box{}
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return boxes, err
+		}
+		box := mp4Box{
+			typ:        string(header[4:8]),
+			offset:     offset,
+			size:       int64(binary.BigEndian.Uint32(header[:4])),
+			headerSize: 8,
+		}
+		switch box.size {
+		case 0:
+			box.size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes, err
+			}
+			box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.headerSize = 16
+		}
+		if box.size < box.headerSize || box.end() > end {
+			return boxes, errNoMedia
+		}
+		boxes = append(boxes, box)
+		offset = box.end()
+	}
+	return boxes, nil
+}
+
+func readMp4Payload(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	size := box.size - box.headerSize
+	if size > mp4MaxBoxSize {
+		return nil, errNoMedia
+	}
+	payload := make([]byte, size)
+	_, err := r.ReadAt(payload, box.offset+box.headerSize)
+	return payload, err
+}
+
+// Find the direct children of a box payload by type
+func mp4Children(payload []byte, typ string) [][]byte {
+	children := [][]byte{}
+	boxes, _ := readMp4Boxes(bytes.NewReader(payload), 0, int64(len(payload)))
+	for _, box := range boxes {
+		if box.typ == typ {
+			children = append(children, payload[box.offset+box.headerSize:box.end()])
+		}
+	}
+	return children
+}
+
+// Follow a path of box types, returns the first match
+func mp4Find(payload []byte, path ...string) []byte {
+	for _, typ := range path {
+		children := mp4Children(payload, typ)
+		if len(children) == 0 {
+			return nil
+		}
+		payload = children[0]
+	}
+	return payload
+}
+
+type mp4Track struct {
+	id              uint32
+	handler         string
+	codec           string
+	timescale       uint32
+	duration        uint64
+	width           int
+	height          int
+	defaultDuration uint32
+}
+
+type mp4Movie struct {
+	timescale  uint32
+	duration   uint64
+	fragmented bool
+	tracks     []*mp4Track
+}
+
+// Timescale and duration of mvhd and mdhd boxes
+func mp4TimeHeader(payload []byte) (uint32, uint64) {
+	if len(payload) < 4 {
+		return 0, 0
+	}
+	if payload[0] == 1 {
+		if len(payload) < 32 {
+			return 0, 0
+		}
+		return binary.BigEndian.Uint32(payload[20:24]), binary.BigEndian.Uint64(payload[24:32])
+	}
+	if len(payload) < 20 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(payload[12:16]), uint64(binary.BigEndian.Uint32(payload[16:20]))
+}
+
+func parseMp4Track(trak []byte) *mp4Track {
+	track := &mp4Track{}
+	if tkhd := mp4Find(trak, "tkhd"); len(tkhd) > 4 {
+		idOffset, sizeOffset := 12, 76
+		if tkhd[0] == 1 {
+			idOffset, sizeOffset = 20, 88
+		}
+		if len(tkhd) >= sizeOffset+8 {
+			track.id = binary.BigEndian.Uint32(tkhd[idOffset:])
+			track.width = int(binary.BigEndian.Uint32(tkhd[sizeOffset:]) >> 16)
+			track.height = int(binary.BigEndian.Uint32(tkhd[sizeOffset+4:]) >> 16)
+		}
+	}
+	track.timescale, track.duration = mp4TimeHeader(mp4Find(trak, "mdia", "mdhd"))
+	if hdlr := mp4Find(trak, "mdia", "hdlr"); len(hdlr) >= 12 {
+		track.handler = string(hdlr[8:12])
+	}
+	if stsd := mp4Find(trak, "mdia", "minf", "stbl", "stsd"); len(stsd) >= 16 {
+		track.codec = strings.TrimSpace(string(stsd[12:16]))
+	}
+	return track
+}
+
+func parseMp4Movie(moov []byte) *mp4Movie {
+	movie := &mp4Movie{}
+	movie.timescale, movie.duration = mp4TimeHeader(mp4Find(moov, "mvhd"))
+	for _, trak := range mp4Children(moov, "trak") {
+		movie.tracks = append(movie.tracks, parseMp4Track(trak))
+	}
+	mvex := mp4Find(moov, "mvex")
+	if mvex == nil {
+		return movie
+	}
+	movie.fragmented = true
+	if mehd := mp4Find(mvex, "mehd"); len(mehd) >= 8 && movie.duration == 0 {
+		if mehd[0] == 1 && len(mehd) >= 12 {
+			movie.duration = binary.BigEndian.Uint64(mehd[4:12])
+		} else {
+			movie.duration = uint64(binary.BigEndian.Uint32(mehd[4:8]))
+		}
+	}
+	for _, trex := range mp4Children(mvex, "trex") {
+		if len(trex) < 16 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(trex[4:8])
+		for _, track := range movie.tracks {
+			if track.id == id {
+				track.defaultDuration = binary.BigEndian.Uint32(trex[12:16])
+			}
+		}
+	}
+	return movie
+}
+
+// The track used for timing, video when present
+func (m *mp4Movie) mainTrack() *mp4Track {
+	for _, track := range m.tracks {
+		if track.handler == "vide" {
+			return track
+		}
+	}
+	if len(m.tracks) > 0 {
+		return m.tracks[0]
+	}
+	return nil
+}
+
+func readMp4Movie(r io.ReaderAt, size int64) (*mp4Movie, []mp4Box, error) {
+	boxes, err := readMp4Boxes(r, 0, size)
+	if len(boxes) == 0 || boxes[0].typ != "ftyp" {
+		return nil, nil, errNoMedia
+	}
+	for _, box := range boxes {
+		if box.typ != "moov" {
+			continue
+		}
+		moov, err := readMp4Payload(r, box)
+		if err != nil {
+			return nil, nil, err
+		}
+		return parseMp4Movie(moov), boxes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, errNoMedia
+}
+
+func readMp4Meta(r io.ReaderAt, size int64) (*MediaMeta, error) {
+	movie, _, err := readMp4Movie(r, size)
+	if err != nil {
+		return nil, err
+	}
+	meta := &MediaMeta{Container: "mp4", Fragmented: movie.fragmented}
+	if movie.timescale > 0 {
+		meta.Duration = float64(movie.duration) / float64(movie.timescale)
+	}
+	for _, track := range movie.tracks {
+		switch track.handler {
+		case "vide":
+			if meta.VideoCodec == "" {
+				meta.VideoCodec = track.codec
+				meta.Width = track.width
+				meta.Height = track.height
+			}
+		case "soun":
+			if meta.AudioCodec == "" {
+				meta.AudioCodec = track.codec
+			}
+		}
+		if meta.Duration == 0 && track.timescale > 0 {
+			meta.Duration = float64(track.duration) / float64(track.timescale)
+		}
+	}
+	return meta, nil
+}
+
+// Matroska and WebM
+
+// EBML element ids that are read
+const (
+	ebmlHeader       = 0x1A45DFA3
+	ebmlDocType      = 0x4282
+	mkvSegment       = 0x18538067
+	mkvInfo          = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDuration      = 0x4489
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvTrackType     = 0x83
+	mkvCodecID       = 0x86
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvCluster       = 0x1F43B675
+)
+
+// Elements with an unknown size, only allowed for Segment and Cluster
+const ebmlUnknownSize = -1
+
+type ebmlElement struct {
+	id         uint64
+	offset     int64
+	size       int64
+	headerSize int64
+}
+
+// Read a variable length integer, the id keeps its marker bits, sizes don't.
+func readEbmlVint(r io.ReaderAt, offset int64, keepMarker bool) (uint64, int64, error) {
+	first := make([]byte, 1)
+	if _, err := r.ReadAt(first, offset); err != nil {
+		return 0, 0, err
+	}
+	length := int64(1)
+	for mask := byte(0x80); mask != 0 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errNoMedia
+	}
+	buf := make([]byte, length)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return 0, 0, err
+	}
+	if !keepMarker {
+		buf[0] &= byte(0xFF >> uint(length))
+	}
+	value := uint64(0)
+	for _, b := range buf {
+		value = value<<8 | uint64(b)
+	}
+	// A size with all bits set means unknown size
+	if !keepMarker && value == 1<<uint(7*length)-1 {
+		return math.MaxUint64, length, nil
+	}
+	return value, length, nil
+}
+
+func readEbmlElement(r io.ReaderAt, offset int64) (ebmlElement, error) {
+	id, idLength, err := readEbmlVint(r, offset, true)
+	if err != nil {
+		return ebmlElement{}, err
+	}
+	size, sizeLength, err := readEbmlVint(r, offset+idLength, false)
+	if err != nil {
+		return ebmlElement{}, err
+	}
+	element := ebmlElement{id: id, offset: offset, headerSize: idLength + sizeLength, size: int64(size)}
+	if size == math.MaxUint64 {
+		element.size = ebmlUnknownSize
+	}
+	return element, nil
+}
+
+// Walk the children of an element, returning false from fn stops the walk
+func walkEbml(r io.ReaderAt, start, end int64, fn func(ebmlElement) bool) error {
+	for offset := start; offset < end; {
+		element, err := readEbmlElement(r, offset)
+		if err != nil {
+			return err
+		}
+		if !fn(element) || element.size == ebmlUnknownSize {
+			return nil
+		}
+		offset += element.headerSize + element.size
+	}
+	return nil
+}
+
+func readEbmlData(r io.ReaderAt, e ebmlElement) []byte {
+	if e.size < 0 || e.size > 1<<16 {
+		return nil
+	}
+	data := make([]byte, e.size)
+	if _, err := r.ReadAt(data, e.offset+e.headerSize); err != nil {
+		return nil
+	}
+	return data
+}
+
+func ebmlUint(data []byte) uint64 {
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+func readMatroskaMeta(r io.ReaderAt, size int64) (*MediaMeta, error) {
+	header, err := readEbmlElement(r, 0)
+	if err != nil || header.id != ebmlHeader {
+		return nil, errNoMedia
+	}
+	meta := &MediaMeta{Container: "matroska"}
+	walkEbml(r, header.headerSize, header.headerSize+header.size, func(e ebmlElement) bool {
+		if e.id == ebmlDocType {
+			meta.Container = string(readEbmlData(r, e))
+		}
+		return true
+	})
+
+	segment, err := readEbmlElement(r, header.headerSize+header.size)
+	if err != nil || segment.id != mkvSegment {
+		return nil, errNoMedia
+	}
+	segmentEnd := size
+	if segment.size != ebmlUnknownSize && segment.offset+segment.headerSize+segment.size < size {
+		segmentEnd = segment.offset + segment.headerSize + segment.size
+	}
+
+	timecodeScale := 1000000.0
+	duration := 0.0
+	walkEbml(r, segment.offset+segment.headerSize, segmentEnd, func(e ebmlElement) bool {
+		start := e.offset + e.headerSize
+		switch e.id {
+		case mkvInfo:
+			walkEbml(r, start, start+e.size, func(c ebmlElement) bool {
+				switch c.id {
+				case mkvTimecodeScale:
+					timecodeScale = float64(ebmlUint(readEbmlData(r, c)))
+				case mkvDuration:
+					duration = ebmlFloat(readEbmlData(r, c))
+				}
+				return true
+			})
+		case mkvTracks:
+			walkEbml(r, start, start+e.size, func(c ebmlElement) bool {
+				if c.id == mkvTrackEntry {
+					readMatroskaTrack(r, c, meta)
+				}
+				return true
+			})
+		case mkvCluster:
+			// Info and Tracks come before the media data
+			return false
+		}
+		return true
+	})
+	meta.Duration = duration * timecodeScale / 1e9
+	return meta, nil
+}
+
+func readMatroskaTrack(r io.ReaderAt, entry ebmlElement, meta *MediaMeta) {
+	var trackType uint64
+	var codec string
+	var width, height int
+	start := entry.offset + entry.headerSize
+	walkEbml(r, start, start+entry.size, func(e ebmlElement) bool {
+		switch e.id {
+		case mkvTrackType:
+			trackType = ebmlUint(readEbmlData(r, e))
+		case mkvCodecID:
+			codec = string(readEbmlData(r, e))
+		case mkvVideo:
+			videoStart := e.offset + e.headerSize
+			walkEbml(r, videoStart, videoStart+e.size, func(v ebmlElement) bool {
+				switch v.id {
+				case mkvPixelWidth:
+					width = int(ebmlUint(readEbmlData(r, v)))
+				case mkvPixelHeight:
+					height = int(ebmlUint(readEbmlData(r, v)))
+				}
+				return true
+			})
+		}
+		return true
+	})
+	// Track types, 1 video and 2 audio
+	switch {
+	case trackType == 1 && meta.VideoCodec == "":
+		meta.VideoCodec = codec
+		meta.Width = width
+		meta.Height = height
+	case trackType == 2 && meta.AudioCodec == "":
+		meta.AudioCodec = codec
+	}
+}
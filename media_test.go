@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testBox(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], typ)
+	return append(box, payload...)
+}
+
+func testUint32s(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// Fragmented mp4 with one 640x360 avc1 track at timescale 1000,
+// and three fragments of 4 samples of 1 second.
+func testFragmentedMp4() []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	binary.BigEndian.PutUint32(tkhd[76:], 640<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 360<<16)
+	mdhd := testUint32s(0, 0, 0, 1000, 0, 0)
+	hdlr := append(testUint32s(0, 0), []byte("vide")...)
+	stsd := append(testUint32s(0, 1, 16), []byte("avc1")...)
+
+	moov := testBox("moov",
+		testBox("mvhd", testUint32s(0, 0, 0, 1000, 0)),
+		testBox("trak",
+			testBox("tkhd", tkhd),
+			testBox("mdia",
+				testBox("mdhd", mdhd),
+				testBox("hdlr", hdlr),
+				testBox("minf", testBox("stbl", testBox("stsd", stsd))))),
+		testBox("mvex", testBox("trex", testUint32s(0, 1, 1, 1000, 0, 0))),
+	)
+
+	file := append(testBox("ftyp", []byte("isom")), moov...)
+	for i := 0; i < 3; i++ {
+		moof := testBox("moof",
+			testBox("mfhd", testUint32s(0, uint32(i+1))),
+			testBox("traf",
+				testBox("tfhd", testUint32s(0, 1)),
+				testBox("trun", testUint32s(0, 4))))
+		file = append(file, moof...)
+		file = append(file, testBox("mdat", make([]byte, 100))...)
+	}
+	return file
+}
+
+func TestReadMp4Meta(t *testing.T) {
+	data := testFragmentedMp4()
+	meta, err := readMp4Meta(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.VideoCodec != "avc1" || meta.Width != 640 || meta.Height != 360 || !meta.Fragmented {
+		t.Error("unexpected meta", meta)
+	}
+}
+
+func TestHlsSegments(t *testing.T) {
+	data := testFragmentedMp4()
+	initLength, segments, err := hlsSegments(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[initLength+4] != 'm' || string(data[initLength+4:initLength+8]) != "moof" {
+		t.Error("init section should end at the first moof", initLength)
+	}
+	// 4 second fragments, the first two are joined to reach 6 seconds
+	if len(segments) != 2 {
+		t.Fatal("expected 2 segments !=", len(segments))
+	}
+	if segments[0].duration != 8 || segments[1].duration != 4 {
+		t.Error("expected durations 8 and 4 !=", segments[0].duration, segments[1].duration)
+	}
+	if segments[1].offset+segments[1].length != int64(len(data)) {
+		t.Error("last segment should end at the end of the file")
+	}
+
+	playlist := hlsPlaylist("/content/a.mp4", initLength, segments)
+	if !strings.Contains(playlist, "#EXT-X-TARGETDURATION:8\n") || !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+		t.Error("unexpected playlist", playlist)
+	}
+}
+
+func TestHlsSegmentsNotFragmented(t *testing.T) {
+	data := append(testBox("ftyp", []byte("isom")), testBox("moov", testBox("mvhd", testUint32s(0, 0, 0, 1000, 0)))...)
+	if _, _, err := hlsSegments(bytes.NewReader(data), int64(len(data))); err != errNotFragmented {
+		t.Error("expected errNotFragmented !=", err)
+	}
+}
+
+func testEbml(id uint64, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	idBytes := []byte{}
+	for v := id; v > 0; v >>= 8 {
+		idBytes = append([]byte{byte(v)}, idBytes...)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(payload)))
+	size[0] = 0x01
+	return append(append(idBytes, size...), payload...)
+}
+
+func TestReadMatroskaMeta(t *testing.T) {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(90500))
+	data := append(
+		testEbml(ebmlHeader, testEbml(ebmlDocType, []byte("webm"))),
+		testEbml(mkvSegment,
+			testEbml(mkvInfo,
+				testEbml(mkvTimecodeScale, []byte{0x0F, 0x42, 0x40}),
+				testEbml(mkvDuration, duration)),
+			testEbml(mkvTracks,
+				testEbml(mkvTrackEntry,
+					testEbml(mkvTrackType, []byte{1}),
+					testEbml(mkvCodecID, []byte("V_VP9")),
+					testEbml(mkvVideo,
+						testEbml(mkvPixelWidth, []byte{0x07, 0x80}),
+						testEbml(mkvPixelHeight, []byte{0x04, 0x38}))),
+				testEbml(mkvTrackEntry,
+					testEbml(mkvTrackType, []byte{2}),
+					testEbml(mkvCodecID, []byte("A_OPUS")))),
+			testEbml(mkvCluster, make([]byte, 10)))...)
+
+	meta, err := readMatroskaMeta(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MediaMeta{Container: "webm", Duration: 90.5, VideoCodec: "V_VP9", AudioCodec: "A_OPUS", Width: 1920, Height: 1080}
+	if *meta != expected {
+		t.Error("expected", expected, "!=", *meta)
+	}
+}
+
+// Plain mp4 with a video track of 12 samples of 1 second, key frames at
+// 0, 4 and 8 seconds, and an audio track of 24 samples of half a second.
+// Sample i of the video is 10 bytes of 'a'+i, of the audio 5 bytes of 'A'+i.
+func testPlainMp4() []byte {
+	trak := func(id uint32, handler string, timescale uint32, stbl ...[]byte) []byte {
+		tkhd := make([]byte, 84)
+		binary.BigEndian.PutUint32(tkhd[12:], id)
+		return testBox("trak",
+			testBox("tkhd", tkhd),
+			testBox("mdia",
+				testBox("mdhd", testUint32s(0, 0, 0, timescale, 0, 0)),
+				testBox("hdlr", append(testUint32s(0, 0), []byte(handler)...)),
+				testBox("minf", testBox("stbl", stbl...))))
+	}
+	ftyp := testBox("ftyp", []byte("isom"))
+	moovSize := func(moov []byte) int { return len(moov) }
+
+	build := func(mdatStart uint32) []byte {
+		return testBox("moov",
+			testBox("mvhd", testUint32s(0, 0, 0, 1000, 12000)),
+			trak(1, "vide", 1000,
+				testBox("stsd", append(testUint32s(0, 1, 16), []byte("avc1")...)),
+				testBox("stts", testUint32s(0, 1, 12, 1000)),
+				testBox("ctts", testUint32s(0, 1, 12, 500)),
+				testBox("stss", testUint32s(0, 3, 1, 5, 9)),
+				testBox("stsc", testUint32s(0, 1, 1, 4, 1)),
+				testBox("stsz", testUint32s(0, 10, 12)),
+				testBox("stco", testUint32s(0, 3, mdatStart, mdatStart+40, mdatStart+80))),
+			trak(2, "soun", 100,
+				testBox("stsd", append(testUint32s(0, 1, 16), []byte("mp4a")...)),
+				testBox("stts", testUint32s(0, 1, 24, 50)),
+				testBox("stsc", testUint32s(0, 1, 1, 24, 1)),
+				testBox("stsz", append(testUint32s(0, 0, 24), testUint32s(5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5)...)),
+				testBox("stco", testUint32s(0, 1, mdatStart+120))))
+	}
+	mdatStart := uint32(len(ftyp) + moovSize(build(0)) + 8)
+	mdat := []byte{}
+	for i := 0; i < 12; i++ {
+		mdat = append(mdat, bytes.Repeat([]byte{byte('a' + i)}, 10)...)
+	}
+	for i := 0; i < 24; i++ {
+		mdat = append(mdat, bytes.Repeat([]byte{byte('A' + i)}, 5)...)
+	}
+	return append(append(ftyp, build(mdatStart)...), testBox("mdat", mdat)...)
+}
+
+func TestReadHlsRemux(t *testing.T) {
+	data := testPlainMp4()
+	if _, _, err := hlsSegments(bytes.NewReader(data), int64(len(data))); err != errNotFragmented {
+		t.Fatal("expected errNotFragmented !=", err)
+	}
+	remux, err := readHlsRemux(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key frame at 4 seconds is before the target duration
+	if len(remux.durations) != 2 || remux.durations[0] != 8 || remux.durations[1] != 4 {
+		t.Error("expected durations 8 and 4 !=", remux.durations)
+	}
+	expected := [][]int{{0, 8, 12}, {0, 16, 24}}
+	for i, bounds := range remux.bounds {
+		if fmt.Sprint(bounds) != fmt.Sprint(expected[i]) {
+			t.Error("track", i, "expected bounds", expected[i], "!=", bounds)
+		}
+	}
+
+	// the init segment is a fragmented movie without samples
+	movie, boxes, err := readMp4Movie(bytes.NewReader(remux.init), int64(len(remux.init)))
+	if err != nil || !movie.fragmented || len(movie.tracks) != 2 || len(boxes) != 2 {
+		t.Fatal("unexpected init segment", movie, boxes, err)
+	}
+	moov := remux.init[boxes[1].offset+8:]
+	for _, trak := range mp4Children(moov, "trak") {
+		stbl := mp4Find(trak, "mdia", "minf", "stbl")
+		if len(mp4Find(stbl, "stsd")) == 0 || binary.BigEndian.Uint32(mp4Find(stbl, "stsz")[8:]) != 0 {
+			t.Error("expected sample descriptions and empty sample tables", stbl)
+		}
+	}
+
+	// the second segment has video samples 8 to 11 and audio 16 to 23
+	var b bytes.Buffer
+	if err := remux.writeSegment(&b, bytes.NewReader(data), 1); err != nil {
+		t.Fatal(err)
+	}
+	segment := b.Bytes()
+	segmentBoxes, _ := readMp4Boxes(bytes.NewReader(segment), 0, int64(len(segment)))
+	if len(segmentBoxes) != 2 || segmentBoxes[0].typ != "moof" || segmentBoxes[1].typ != "mdat" {
+		t.Fatal("expected moof and mdat", segmentBoxes)
+	}
+	moof := segment[8:segmentBoxes[0].size]
+	if binary.BigEndian.Uint32(mp4Find(moof, "mfhd")[4:]) != 2 {
+		t.Error("expected sequence number 2")
+	}
+	expectedTracks := []struct {
+		decode uint64
+		count  uint32
+		first  byte
+		size   int
+	}{{8000, 4, 'a' + 8, 10}, {800, 8, 'A' + 16, 5}}
+	for i, traf := range mp4Children(moof, "traf") {
+		tfdt := mp4Find(traf, "tfdt")
+		trun := mp4Find(traf, "trun")
+		decode := binary.BigEndian.Uint64(tfdt[4:])
+		count := binary.BigEndian.Uint32(trun[4:])
+		offset := binary.BigEndian.Uint32(trun[8:])
+		want := expectedTracks[i]
+		if decode != want.decode || count != want.count || trunDuration(trun, 0) != uint64(want.decode)/2 {
+			t.Error("track", i, "expected", want, "!=", decode, count, trunDuration(trun, 0))
+		}
+		if !bytes.Equal(segment[offset:int(offset)+want.size], bytes.Repeat([]byte{want.first}, want.size)) {
+			t.Error("track", i, "data offset", offset, "does not point at the first sample")
+		}
+		// key frame flags and the composition offset of the video
+		if i == 0 && (binary.BigEndian.Uint32(trun[20:]) != 0x02000000 || binary.BigEndian.Uint32(trun[24:]) != 500 ||
+			binary.BigEndian.Uint32(trun[36:]) != 0x01010000) {
+			t.Error("unexpected sample flags", trun[12:44])
+		}
+	}
+	if err := remux.writeSegment(&b, bytes.NewReader(data), 2); err == nil {
+		t.Error("expected an error for a missing segment")
+	}
+}
+
+func TestParseMp4SamplesInvalid(t *testing.T) {
+	stbl := func(boxes ...[]byte) []byte { return bytes.Join(boxes, nil) }
+	stts := testBox("stts", testUint32s(0, 1, 2, 100))
+	stsc := testBox("stsc", testUint32s(0, 1, 1, 2, 1))
+	stco := testBox("stco", testUint32s(0, 1, 100))
+	testcases := [][]byte{
+		// no sample sizes
+		stbl(stts, stsc, stco),
+		// sizes of 2 samples missing
+		stbl(testBox("stsz", testUint32s(0, 0, 2)), stts, stsc, stco),
+		// a huge count of constant size samples
+		stbl(testBox("stsz", testUint32s(0, 10, 0xFFFFFFFF)), stts, stsc, stco),
+		// durations of only one sample
+		stbl(testBox("stsz", testUint32s(0, 10, 2)), testBox("stts", testUint32s(0, 1, 1, 100)), stsc, stco),
+		// chunks hold one sample only
+		stbl(testBox("stsz", testUint32s(0, 10, 2)), stts, testBox("stsc", testUint32s(0, 1, 1, 1, 1)), stco),
+	}
+	for tcNumber, testcase := range testcases {
+		if _, err := parseMp4Samples(testcase); err != errNoSamples {
+			t.Error("testcase", tcNumber, "expected errNoSamples !=", err)
+		}
+	}
+}
+
+func TestStreamRestRemux(t *testing.T) {
+	base := t.TempDir()
+	data := testPlainMp4()
+	os.WriteFile(filepath.Join(base, "v.mp4"), data, 0644)
+	defer func(items CacheMap) {
+		Cache.Update(items)
+	}(Cache.Items)
+	Cache.Update(CacheMap{"/v.mp4": &File{Name: "v.mp4", AbsPath: base, RelPath: "/", Size: int64(len(data)), ModDate: 1}})
+
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		streamRest(w, httptest.NewRequest("GET", p, nil))
+		return w
+	}
+	w := get("/stream/v.mp4/")
+	playlist := w.Body.String()
+	if w.Code != 200 || !strings.Contains(playlist, "#EXT-X-MAP:URI=\"/stream/%2Fv.mp4/init.mp4\"") ||
+		!strings.Contains(playlist, "/stream/%2Fv.mp4/seg1.m4s\n#EXT-X-ENDLIST") {
+		t.Fatal("unexpected playlist", w.Code, playlist)
+	}
+
+	testcases := []struct {
+		path     string
+		expected int
+		size     int
+	}{
+		{"/stream/v.mp4/index.m3u8", 200, len(playlist)},
+		{"/stream/v.mp4/init.mp4", 200, 0},
+		{"/stream/v.mp4/seg0.m4s", 200, 0},
+		{"/stream/v.mp4/seg2.m4s", 404, 0},
+		{"/stream/v.mp4/seg-1.m4s", 404, 0},
+		{"/stream/v.mp4/other.ts", 404, 0},
+		{"/stream/missing.mp4/init.mp4", 404, 0},
+	}
+	for tcNumber, testcase := range testcases {
+		w := get(testcase.path)
+		if w.Code != testcase.expected || (testcase.size > 0 && w.Body.Len() != testcase.size) {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, testcase.size, "!=", w.Code, w.Body.Len())
+		}
+	}
+	if init := get("/stream/v.mp4/init.mp4").Body.Bytes(); string(init[4:8]) != "ftyp" {
+		t.Error("expected an init segment", init)
+	}
+	if segment := get("/stream/v.mp4/seg0.m4s").Body.Bytes(); string(segment[4:8]) != "moof" {
+		t.Error("expected a segment", segment)
+	}
+}
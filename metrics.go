@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in the Prometheus text format, served at /metrics.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Label values are joined into the key of a series
+const labelSeparator = "\xff"
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(labelValues, labelSeparator)] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	writeMetricHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		values := strings.Split(key, labelSeparator)
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, values), formatValue(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, found := h.values[key]
+	if !found {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = series
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += v
+	series.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		values := strings.Split(key, labelSeparator)
+		series := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), series.count)
+	}
+}
+
+// Gauge read when scraped
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g gaugeFunc) writeTo(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Set at the end of every sync
+var (
+	lastSyncTime     atomic.Int64
+	lastSyncDuration atomic.Int64
+)
+
+func recordSync(start time.Time) {
+	lastSyncDuration.Store(int64(time.Since(start)))
+	lastSyncTime.Store(time.Now().UnixNano())
+}
+
+var (
+	requestsTotal = newCounter("silo_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	requestDuration = newHistogram("silo_http_request_duration_seconds",
+		"HTTP request latency by route, method and status.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "route", "method", "status")
+	responseBytes = newCounter("silo_http_response_bytes_total",
+		"Bytes served by route.", "route")
+	uploadBytes = newCounter("silo_upload_bytes_total",
+		"Bytes of uploaded files, including extracted archives.")
+	uploadFailures = newCounter("silo_upload_failures_total",
+		"Failed file uploads by error code.", "code")
+	contentTypeSniffs = newCounter("silo_content_type_sniffs_total",
+		"Files read to detect their content type.")
+)
+
+var metrics = []metric{
+	requestsTotal,
+	requestDuration,
+	responseBytes,
+	uploadBytes,
+	uploadFailures,
+	contentTypeSniffs,
+	gaugeFunc{"silo_cache_items", "Files and directories in the cache.", func() float64 {
+		return float64(Cache.Length())
+	}},
+	gaugeFunc{"silo_sync_duration_seconds", "Duration of the last directory sync.", func() float64 {
+		return time.Duration(lastSyncDuration.Load()).Seconds()
+	}},
+	gaugeFunc{"silo_sync_last_timestamp_seconds", "Unix time the last directory sync finished, 0 before the first.", func() float64 {
+		return float64(lastSyncTime.Load()) / 1e9
+	}},
+}
+
+// The route a request is served by, paths themselves would
+// give a series per file.
+func routeLabel(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+	return pattern
+}
+
+func metricsMiddleware(mux *http.ServeMux) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &responseRecorder{ResponseWriter: w}
+			route := routeLabel(mux, r)
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			status := strconv.Itoa(rec.status)
+			requestsTotal.Inc(route, r.Method, status)
+			requestDuration.Observe(time.Since(start).Seconds(), route, r.Method, status)
+			responseBytes.Add(float64(rec.bytes), route)
+		})
+	}
+}
+
+func metricsRest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounter("test_total", "Test counter.", "route")
+	counter.Inc("/list/")
+	counter.Add(2, `/a"b`)
+	histogram := newHistogram("test_seconds", "Test histogram.", []float64{.1, 1}, "route")
+	histogram.Observe(.5, "/list/")
+
+	var out bytes.Buffer
+	counter.writeTo(&out)
+	histogram.writeTo(&out)
+	expected := []string{
+		"# TYPE test_total counter",
+		`test_total{route="/a\"b"} 2`,
+		`test_total{route="/list/"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{route="/list/",le="0.1"} 0`,
+		`test_seconds_bucket{route="/list/",le="1"} 1`,
+		`test_seconds_bucket{route="/list/",le="+Inf"} 1`,
+		`test_seconds_sum{route="/list/"} 0.5`,
+		`test_seconds_count{route="/list/"} 1`,
+	}
+	for tcNumber, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("testcase", tcNumber, "expected", line, "in", out.String())
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/detail/", func(w http.ResponseWriter, r *http.Request) {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+	})
+	handler := metricsMiddleware(mux)(mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/detail/some/file.txt", nil))
+
+	var out bytes.Buffer
+	requestsTotal.writeTo(&out)
+	expected := `silo_http_requests_total{route="/detail/",method="GET",status="404"} `
+	if !strings.Contains(out.String(), expected) {
+		t.Error("expected", expected, "in", out.String())
+	}
+}
+
+// Run with -race, the cache gauge is read while the sync replaces items
+func TestMetricsDuringUpdate(t *testing.T) {
+	oldItems := Cache.Items
+	defer Cache.Update(oldItems)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Cache.Update(CacheMap{"/a.txt": {Name: "a.txt", RelPath: "/", ModDate: int64(i)}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		metricsRest(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "silo_cache_items ") {
+			t.Fatal("expected silo_cache_items in", w.Body.String())
+		}
+	}
+	<-done
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Attumm/silo/client"
+)
+
+// Suffix of partial downloads, the ETag is stored next to it for resuming
+const partialSuffix = ".silo-part"
+
+type mirrorStats struct {
+	mu         sync.Mutex
+	downloaded int
+	skipped    int
+	deleted    int
+	failed     int
+}
+
+func (s *mirrorStats) add(counter *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter++
+}
+
+// Local path for a listed item, false when a segment is unsafe.
+func mirrorPath(localDir string, item client.ListFile) (string, bool) {
+	segments := append(append([]string{}, item.Directories...), item.Name)
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\") {
+			return "", false
+		}
+	}
+	return filepath.Join(append([]string{localDir}, segments...)...), true
+}
+
+// Members of archives are listed when archive-browse is on remote,
+// they are part of the archive file and not mirrored separately.
+func withoutArchiveMembers(items []client.ListFile) []client.ListFile {
+	archives := make(map[string]bool)
+	for _, item := range items {
+		if item.IsArchive {
+			archives[item.Path()] = true
+		}
+	}
+	kept := []client.ListFile{}
+	for _, item := range items {
+		inArchive := false
+		for i := range item.Directories {
+			if archives[strings.Join(item.Directories[:i+1], "/")] {
+				inArchive = true
+				break
+			}
+		}
+		if !inArchive {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// Same size and modification time, the file does not need a download
+func mirrorUpToDate(fp string, item client.ListFile) bool {
+	info, err := os.Stat(fp)
+	if err != nil {
+		return false
+	}
+	size, err := strconv.ParseInt(item.SizeBytes, 10, 64)
+	return err == nil && info.Size() == size && info.ModTime().Unix() == item.ModDate
+}
+
+// Download into a partial file, resuming a previous partial download
+// when the ETag of the remote file did not change.
+func download(ctx context.Context, c *client.Client, item client.ListFile, fp string) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	partial := fp + partialSuffix
+	etagFile := partial + ".etag"
+
+	offset, etag := int64(0), ""
+	if info, err := os.Stat(partial); err == nil && info.Size() > 0 {
+		if data, err := ioutil.ReadFile(etagFile); err == nil && len(data) > 0 {
+			offset, etag = info.Size(), string(data)
+		}
+	}
+	content, err := c.OpenFrom(ctx, item.Path(), offset, etag)
+	if err != nil {
+		return err
+	}
+	defer content.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if content.Offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	if content.ETag != "" {
+		ioutil.WriteFile(etagFile, []byte(content.ETag), 0666)
+	}
+
+	f, err := os.OpenFile(partial, flags, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(partial, fp); err != nil {
+		return err
+	}
+	os.Remove(etagFile)
+	modified := time.Unix(item.ModDate, 0)
+	return os.Chtimes(fp, modified, modified)
+}
+
+// Remove local files and directories that are not on the remote
+func mirrorDeleteExtras(localDir string, keep map[string]bool, dryRun bool, stats *mirrorStats) {
+	extras := []string{}
+	filepath.Walk(localDir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || fp == localDir {
+			return nil
+		}
+		if strings.HasSuffix(fp, partialSuffix) || strings.HasSuffix(fp, partialSuffix+".etag") {
+			return nil
+		}
+		if !keep[fp] {
+			extras = append(extras, fp)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	for _, fp := range extras {
+		fmt.Println("delete", fp)
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(fp); err != nil {
+			fmt.Fprintln(os.Stderr, "delete failed", fp, err)
+			continue
+		}
+		stats.add(&stats.deleted)
+	}
+}
+
+// silo sync [flags] <server-url> <local-dir>
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	deleteExtras := flags.Bool("delete", false, "delete local files that are not on the server, refused while the server is not ready or lists nothing")
+	parallel := flags.Int("parallel", 4, "number of parallel downloads")
+	dirs := flags.String("dirs", "", "only mirror this remote directory, a/b")
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: silo sync [flags] <server-url> <local-dir>")
+		flags.PrintDefaults()
+	}
+	envToken, _, _, tokenErr := LookupEnvSecret("SILO_TOKEN")
+	token := flags.String("token", envToken, "bearer token, or SILO_TOKEN or SILO_TOKEN_FILE")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if tokenErr != nil {
+		fmt.Fprintln(os.Stderr, tokenErr)
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	server := flags.Arg(0)
+	c, err := client.New(server, client.Options{Token: *token})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx := context.Background()
+	localDir, err := filepath.Abs(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+
+	options := client.ListOptions{}
+	mirrorRoot := localDir
+	for _, dir := range removeEmpty(strings.Split(*dirs, "/")) {
+		options.Dirs = append(options.Dirs, dir)
+		mirrorRoot = filepath.Join(mirrorRoot, dir)
+	}
+	if *deleteExtras {
+		// A server that is still syncing lists too little
+		if err := c.Ready(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "not deleting,", server, "is not ready,", err)
+			return 1
+		}
+	}
+	items, err := c.List(ctx, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to list", server, err)
+		return 1
+	}
+	items = withoutArchiveMembers(items)
+	if *deleteExtras && len(items) == 0 {
+		// An empty base or a wrong -dirs would wipe the mirror
+		fmt.Fprintln(os.Stderr, "not deleting, the remote listing is empty")
+		return 1
+	}
+
+	stats := &mirrorStats{}
+	keep := make(map[string]bool)
+	jobs := make(chan client.ListFile)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				fp, _ := mirrorPath(localDir, item)
+				fmt.Println("get", fp)
+				if *dryRun {
+					continue
+				}
+				if err := download(ctx, c, item, fp); err != nil {
+					fmt.Fprintln(os.Stderr, "download failed", fp, err)
+					stats.add(&stats.failed)
+					continue
+				}
+				stats.add(&stats.downloaded)
+			}
+		}()
+	}
+
+	for _, item := range items {
+		fp, ok := mirrorPath(localDir, item)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "skipping unsafe path", item.Directories, item.Name)
+			continue
+		}
+		// Parent directories are kept as well
+		for p := fp; len(p) > len(localDir); p = filepath.Dir(p) {
+			keep[p] = true
+		}
+		if item.IsDir {
+			if !*dryRun {
+				os.MkdirAll(fp, 0777)
+			}
+			continue
+		}
+		if mirrorUpToDate(fp, item) {
+			stats.add(&stats.skipped)
+			continue
+		}
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+
+	if *deleteExtras {
+		// Only below the mirrored directory, the rest is not listed
+		mirrorDeleteExtras(mirrorRoot, keep, *dryRun, stats)
+	}
+	fmt.Printf("downloaded %d, up to date %d, deleted %d, failed %d\n",
+		stats.downloaded, stats.skipped, stats.deleted, stats.failed)
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Attumm/silo/client"
+)
+
+func TestMirrorPath(t *testing.T) {
+	testcases := []struct {
+		item     client.ListFile
+		expected string
+		ok       bool
+	}{
+		{client.ListFile{Name: "a.txt", Directories: []string{}}, "/m/a.txt", true},
+		{client.ListFile{Name: "a.txt", Directories: []string{"x", "y"}}, "/m/x/y/a.txt", true},
+		{client.ListFile{Name: "..", Directories: []string{}}, "", false},
+		{client.ListFile{Name: "a.txt", Directories: []string{"..", "etc"}}, "", false},
+		{client.ListFile{Name: "a/../../b", Directories: []string{}}, "", false},
+	}
+
+	for tcNumber, testcase := range testcases {
+		result, ok := mirrorPath("/m", testcase.item)
+		if result != testcase.expected || ok != testcase.ok {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, testcase.ok, "!=", result, ok)
+		}
+	}
+}
+
+func TestWithoutArchiveMembers(t *testing.T) {
+	items := []client.ListFile{
+		{Name: "a.zip", Directories: []string{"x"}, IsArchive: true},
+		{Name: "member.txt", Directories: []string{"x", "a.zip", "d"}},
+		{Name: "b.txt", Directories: []string{"x"}},
+	}
+	kept := withoutArchiveMembers(items)
+	if len(kept) != 2 || kept[0].Name != "a.zip" || kept[1].Name != "b.txt" {
+		t.Error("unexpected items", kept)
+	}
+}
+
+// Serves content with an ETag so Range and If-Range work,
+// the Range headers received are recorded.
+type fakeMirrorServer struct {
+	items  []ListFile
+	data   map[string]string
+	etag   string
+	ready  int
+	ranges []string
+}
+
+func (f *fakeMirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/readyz":
+		w.WriteHeader(f.ready)
+	case r.URL.Path == "/list/":
+		json.NewEncoder(w).Encode(f.items)
+	case strings.HasPrefix(r.URL.Path, "/content/"):
+		data, found := f.data[strings.TrimPrefix(r.URL.Path, "/content/")]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", f.etag)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRemoteDownload(t *testing.T) {
+	server := &fakeMirrorServer{data: map[string]string{"a.txt": "hello world"}, etag: `"v2"`}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	c, _ := client.New(ts.URL, client.Options{})
+	item := client.ListFile{Name: "a.txt", Directories: []string{}, ModDate: 1000}
+
+	testcases := []struct {
+		partial string
+		etag    string
+		rng     string
+	}{
+		// fresh download
+		{"", "", ""},
+		// resumed where the partial file ends
+		{"hello", `"v2"`, "bytes=5-"},
+		// the remote file changed, If-Range sends it whole
+		{"HELLO", `"v1"`, "bytes=5-"},
+		// no ETag stored, the partial file is not trusted
+		{"HELLO", "", ""},
+	}
+
+	for tcNumber, testcase := range testcases {
+		server.ranges = nil
+		dir := t.TempDir()
+		fp := filepath.Join(dir, "sub", "a.txt")
+		os.MkdirAll(filepath.Dir(fp), 0777)
+		if testcase.partial != "" {
+			os.WriteFile(fp+partialSuffix, []byte(testcase.partial), 0666)
+		}
+		if testcase.etag != "" {
+			os.WriteFile(fp+partialSuffix+".etag", []byte(testcase.etag), 0666)
+		}
+		err := download(context.Background(), c, item, fp)
+		data, _ := os.ReadFile(fp)
+		if err != nil || string(data) != "hello world" {
+			t.Error("testcase", tcNumber, "expected hello world !=", string(data), err)
+		}
+		if len(server.ranges) != 1 || server.ranges[0] != testcase.rng {
+			t.Error("testcase", tcNumber, "expected range", testcase.rng, "!=", server.ranges)
+		}
+		if info, err := os.Stat(fp); err != nil || info.ModTime().Unix() != item.ModDate {
+			t.Error("testcase", tcNumber, "expected modification time", item.ModDate, "!=", info, err)
+		}
+		if files := testFiles(dir); len(files) != 1 {
+			t.Error("testcase", tcNumber, "expected partial files to be removed", files)
+		}
+	}
+}
+
+func TestSyncCommandDelete(t *testing.T) {
+	listed := []ListFile{
+		{Name: "d", IsDir: true, Directories: []string{}},
+		{Name: "keep.txt", Directories: []string{"d"}, ContentURL: "/content/d/keep.txt", SizeBytes: "4", ModDate: 1000},
+	}
+	server := &fakeMirrorServer{data: map[string]string{"d/keep.txt": "keep"}, etag: `"v1"`}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	testcases := []struct {
+		items    []ListFile
+		ready    int
+		args     []string
+		exit     int
+		expected []string
+	}{
+		{listed, http.StatusOK, []string{"-delete"}, 0, []string{"d/keep.txt", "d/x.txt" + partialSuffix}},
+		{listed, http.StatusOK, []string{"-delete", "-dry-run"}, 0, []string{"d/extra/y.txt", "d/x.txt" + partialSuffix, "extra.txt"}},
+		{listed, http.StatusOK, []string{}, 0, []string{"d/extra/y.txt", "d/keep.txt", "d/x.txt" + partialSuffix, "extra.txt"}},
+		// only below the mirrored directory
+		{listed[1:], http.StatusOK, []string{"-delete", "-dirs", "d"}, 0, []string{"d/keep.txt", "d/x.txt" + partialSuffix, "extra.txt"}},
+		// a server that is still syncing or lists nothing does not wipe the mirror
+		{listed, http.StatusServiceUnavailable, []string{"-delete"}, 1, []string{"d/extra/y.txt", "d/x.txt" + partialSuffix, "extra.txt"}},
+		{[]ListFile{}, http.StatusOK, []string{"-delete"}, 1, []string{"d/extra/y.txt", "d/x.txt" + partialSuffix, "extra.txt"}},
+		// servers without /readyz
+		{listed, http.StatusNotFound, []string{"-delete"}, 0, []string{"d/keep.txt", "d/x.txt" + partialSuffix}},
+	}
+
+	for tcNumber, testcase := range testcases {
+		server.items = testcase.items
+		server.ready = testcase.ready
+		local := t.TempDir()
+		os.MkdirAll(filepath.Join(local, "d", "extra"), 0777)
+		os.WriteFile(filepath.Join(local, "extra.txt"), []byte("extra"), 0666)
+		os.WriteFile(filepath.Join(local, "d", "extra", "y.txt"), []byte("extra"), 0666)
+		os.WriteFile(filepath.Join(local, "d", "x.txt"+partialSuffix), []byte("partial"), 0666)
+
+		args := append(append([]string{}, testcase.args...), ts.URL, local)
+		exit := 0
+		captureStdout(t, func() {
+			exit = syncCommand(args)
+		})
+		files := testFiles(local)
+		if exit != testcase.exit || strings.Join(files, ",") != strings.Join(testcase.expected, ",") {
+			t.Error("testcase", tcNumber, "expected", testcase.exit, testcase.expected, "!=", exit, files)
+		}
+	}
+}
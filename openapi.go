@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+// JSON schema of a Go type, as encoded in the v1 responses.
+// Named structs are added to the components and referenced.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, found := b.components[t.Name()]; !found {
+			// Placeholder first, types such as ListFileGrouped refer to themselves
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty, asInt := v1FieldName(field)
+		if name == "" {
+			continue
+		}
+		schema := b.schema(field.Type)
+		if asInt {
+			schema = b.schema(reflect.TypeOf(int64(0)))
+		}
+		if !omitEmpty {
+			required = append(required, name)
+			if field.Type.Kind() == reflect.Slice && schema["type"] == "array" {
+				// nil slices are encoded as null
+				schema["nullable"] = true
+			}
+		}
+		properties[name] = schema
+	}
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (p apiParam) spec() map[string]interface{} {
+	schema := map[string]interface{}{"type": p.Type}
+	if p.Multiple {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	}
+	param := map[string]interface{}{
+		"name":     p.Name,
+		"in":       p.In,
+		"required": p.Required,
+		"schema":   schema,
+	}
+	if p.Description != "" {
+		param["description"] = p.Description
+	}
+	return param
+}
+
+func (o apiOperation) spec(b *schemaBuilder) map[string]interface{} {
+	responses := map[string]interface{}{}
+	for _, response := range o.Responses {
+		description := response.Description
+		if description == "" {
+			description = http.StatusText(response.Status)
+		}
+		spec := map[string]interface{}{"description": description}
+		content := map[string]interface{}{}
+		if response.Body != nil {
+			contentType := response.ContentType
+			if _, isError := response.Body.(ErrorMsg); isError {
+				contentType = "application/problem+json"
+			} else if contentType == "" {
+				contentType = "application/json"
+			}
+			content[contentType] = map[string]interface{}{"schema": b.schema(reflect.TypeOf(response.Body))}
+		}
+		if response.Problem {
+			content["application/problem+json"] = map[string]interface{}{"schema": b.schema(reflect.TypeOf(ErrorMsg{}))}
+		}
+		if len(content) > 0 {
+			spec["content"] = content
+		}
+		responses[strconv.Itoa(response.Status)] = spec
+	}
+	params := []interface{}{}
+	for _, param := range o.Params {
+		params = append(params, param.spec())
+	}
+	operation := map[string]interface{}{
+		"summary":    o.Summary,
+		"parameters": params,
+		"responses":  responses,
+	}
+	if o.RequestBody != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				o.RequestType: map[string]interface{}{"schema": b.schema(reflect.TypeOf(o.RequestBody))},
+			},
+		}
+	}
+	if o.Admin {
+		operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+	}
+	return operation
+}
+
+// OpenAPI 3 document of apiEndpoints
+func openAPISpec() map[string]interface{} {
+	b := &schemaBuilder{components: map[string]interface{}{}}
+	// Errors are documented even when no endpoint would list them
+	b.schema(reflect.TypeOf(ErrorMsg{}))
+
+	paths := map[string]interface{}{}
+	for _, endpoint := range apiEndpoints {
+		operations := map[string]interface{}{}
+		for _, operation := range endpoint.Operations {
+			operations[operation.Method] = operation.spec(b)
+		}
+		paths[endpoint.Path] = operations
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Silo",
+			"version": strings.TrimPrefix(apiPrefix, "/api/"),
+			"description": "Field names are snake_case and sizes are numbers. The paths are also served without " +
+				apiPrefix + " for earlier clients, with the Go style field names of the structs and sizes as strings.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIRest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	setHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(openAPISpec())
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type contractSpec struct {
+	Paths      map[string]map[string]map[string]interface{}
+	Components struct {
+		Schemas map[string]map[string]interface{}
+	}
+}
+
+// Template of the documented path matching a request path,
+// literal paths win over templates.
+func (s contractSpec) match(requestPath string) (string, bool) {
+	best, bestLiteral := "", -1
+	for template := range s.Paths {
+		pattern := regexp.QuoteMeta(template)
+		pattern = strings.Replace(pattern, `\{path\}`, `.*`, -1)
+		pattern = regexp.MustCompile(`\\\{[a-z]+\\\}`).ReplaceAllString(pattern, `[^/]+`)
+		if !regexp.MustCompile("^" + pattern + "$").MatchString(requestPath) {
+			continue
+		}
+		literal := len(regexp.MustCompile(`\{[a-z]+\}`).ReplaceAllString(template, ""))
+		if literal > bestLiteral {
+			best, bestLiteral = template, literal
+		}
+	}
+	return best, bestLiteral >= 0
+}
+
+func (s contractSpec) validate(value interface{}, schema map[string]interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		component, found := s.Components.Schemas[name]
+		if !found {
+			return fmt.Errorf("%s: unknown schema %s", at, ref)
+		}
+		return s.validate(value, component, at)
+	}
+	if schemas, ok := schema["oneOf"].([]interface{}); ok {
+		for _, one := range schemas {
+			if s.validate(value, one.(map[string]interface{}), at) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: matches none of oneOf", at)
+	}
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: null not allowed", at)
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", at)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, found := object[name.(string)]; !found {
+				return fmt.Errorf("%s: missing required %s", at, name)
+			}
+		}
+		for name, v := range object {
+			if property, found := properties[name]; found {
+				if err := s.validate(v, property.(map[string]interface{}), at+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			additional, _ := schema["additionalProperties"].(map[string]interface{})
+			if additional == nil {
+				return fmt.Errorf("%s: undocumented property %s", at, name)
+			}
+			if err := s.validate(v, additional, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", at)
+		}
+		for i, item := range items {
+			if err := s.validate(item, schema["items"].(map[string]interface{}), at+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected string", at)
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: expected integer", at)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected number", at)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", at)
+		}
+	}
+	return nil
+}
+
+// Check a live response against the documented response of its operation
+func (s contractSpec) check(method, requestPath string, resp *http.Response, body []byte) error {
+	template, found := s.match(requestPath)
+	if !found {
+		return fmt.Errorf("undocumented path %s", requestPath)
+	}
+	operation, found := s.Paths[template][strings.ToLower(method)]
+	if !found {
+		return fmt.Errorf("undocumented operation %s %s", method, template)
+	}
+	responses := operation["responses"].(map[string]interface{})
+	response, found := responses[strconv.Itoa(resp.StatusCode)].(map[string]interface{})
+	if !found {
+		return fmt.Errorf("undocumented status %d for %s %s", resp.StatusCode, method, template)
+	}
+	content, _ := response["content"].(map[string]interface{})
+	if content == nil {
+		if len(body) > 0 {
+			return fmt.Errorf("undocumented body for %d %s %s", resp.StatusCode, method, template)
+		}
+		return nil
+	}
+	contentType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	media, found := content[contentType].(map[string]interface{})
+	if !found {
+		if _, binary := content["application/octet-stream"]; binary {
+			return nil
+		}
+		return fmt.Errorf("undocumented content type %s for %s %s", contentType, method, template)
+	}
+	if contentType != "application/json" && !strings.HasSuffix(contentType, "+json") {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("invalid json from %s %s: %s", method, requestPath, err)
+	}
+	return s.validate(value, media["schema"].(map[string]interface{}), "body")
+}
+
+func multipartBody(dir, filename, content string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	if dir != "" {
+		mw.WriteField("dirs[]", dir)
+	}
+	if filename != "" {
+		part, _ := mw.CreateFormFile("uploadfile", filename)
+		io.WriteString(part, content)
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestAPIContract(t *testing.T) {
+	base, err := ioutil.TempDir("", "silo-contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	os.MkdirAll(filepath.Join(base, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "docs", "b.txt"), []byte("world"), 0644)
+
+	defer func(base, token string) {
+		SETTINGS.VarString["base"] = base
+		SETTINGS.VarString["admin-token"] = token
+	}(SETTINGS.Get("base"), SETTINGS.Get("admin-token"))
+	SETTINGS.VarString["base"] = base
+	SETTINGS.VarString["admin-token"] = "secret"
+	// Read again by /admin/reload
+	os.Setenv("SILO_BASE", base)
+	os.Setenv("SILO_ADMIN_TOKEN", "secret")
+	defer os.Unsetenv("SILO_BASE")
+	defer os.Unsetenv("SILO_ADMIN_TOKEN")
+
+	fileChan := make(chan *File, 100)
+	go func() {
+		DirWalk(context.Background(), base, fileChan)
+		close(fileChan)
+	}()
+	items := CacheMap{}
+	for file := range fileChan {
+		items[file.relativePath()] = file
+	}
+	Cache.Update(items)
+	recordSync(time.Now())
+
+	mux := http.NewServeMux()
+	routes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + apiPrefix + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := contractSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatal("unable to decode spec", err)
+	}
+	resp.Body.Close()
+
+	upload, uploadType := multipartBody("docs", "c.txt", "upload")
+	noFile, noFileType := multipartBody("docs", "", "")
+	webhookID := ""
+
+	tests := []struct {
+		method      string
+		path        string
+		body        io.Reader
+		contentType string
+		admin       bool
+		expected    int
+	}{
+		{"GET", "/list/", nil, "", false, 200},
+		{"GET", "/list/?dirs=docs&orderby=-size", nil, "", false, 200},
+		{"GET", "/list/group/", nil, "", false, 200},
+		{"GET", "/list/?taken_after=yesterday", nil, "", false, 400},
+		{"GET", "/list/group/?taken_before=2020-13-01", nil, "", false, 400},
+		{"GET", "/detail/docs/b.txt", nil, "", false, 200},
+		{"GET", "/detail/missing.txt", nil, "", false, 404},
+		{"GET", "/content/a.txt", nil, "", false, 200},
+		{"GET", "/content/missing.txt", nil, "", false, 404},
+		{"GET", "/cycle/", nil, "", false, 200},
+		{"GET", "/changes/", nil, "", false, 400},
+		{"GET", "/changes/?since=1", nil, "", false, 410},
+		{"POST", "/upload/", upload, uploadType, false, 201},
+		{"POST", "/upload/", noFile, noFileType, false, 400},
+		{"GET", "/changes/?since=" + strconv.FormatInt(Cache.LastCycle(), 10), nil, "", false, 200},
+		{"GET", "/changes/?since=" + strconv.Itoa(Cache.LastCycleSec()), nil, "", false, 200},
+		{"POST", "/move/docs/c.txt", strings.NewReader("to=docs/d.txt"), "application/x-www-form-urlencoded", false, 200},
+		{"POST", "/move/missing.txt", strings.NewReader("to=x.txt"), "application/x-www-form-urlencoded", false, 404},
+		{"DELETE", "/delete/docs/d.txt", nil, "", false, 204},
+		{"DELETE", "/delete/missing.txt", nil, "", false, 404},
+		{"GET", "/archive/docs?format=tar", nil, "", false, 200},
+		{"GET", "/archive/docs?format=rar", nil, "", false, 400},
+		{"GET", "/archive/docs?taken_after=soon", nil, "", false, 400},
+		{"POST", "/archive/?format=zip", strings.NewReader(`["/a.txt"]`), "application/json", false, 200},
+		{"GET", "/thumb/a.txt", nil, "", false, 415},
+		{"GET", "/stream/a.txt", nil, "", false, 415},
+		{"GET", "/events/", nil, "", false, 200},
+		{"GET", "/webhooks/", nil, "", false, 401},
+		{"POST", "/webhooks/", strings.NewReader(`{"url":"http://127.0.0.1:1/hook"}`), "application/json", true, 201},
+		{"GET", "/webhooks/", nil, "", true, 200},
+		{"GET", "/webhooks/deliveries/", nil, "", true, 200},
+		{"GET", "/webhooks/{id}/deliveries/", nil, "", true, 200},
+		{"DELETE", "/webhooks/{id}", nil, "", true, 204},
+		{"DELETE", "/webhooks/missing", nil, "", true, 404},
+		{"GET", "/healthz", nil, "", false, 200},
+		{"GET", "/readyz", nil, "", false, 200},
+		{"GET", "/status", nil, "", false, 401},
+		{"GET", "/status", nil, "", true, 200},
+		{"GET", "/metrics", nil, "", false, 200},
+		{"GET", "/problems/", nil, "", false, 200},
+		{"GET", "/problems/no-space", nil, "", false, 200},
+		{"GET", "/problems/missing", nil, "", false, 404},
+		{"POST", "/admin/reload", nil, "", true, 200},
+		{"DELETE", "/content/a.txt", nil, "", false, 204},
+	}
+
+	covered := map[string]bool{}
+	for tcNumber, test := range tests {
+		requestPath := strings.Replace(test.path, "{id}", webhookID, 1)
+		req, _ := http.NewRequest(test.method, server.URL+apiPrefix+requestPath, test.body)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.admin {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("testcase", tcNumber, err)
+		}
+		var body []byte
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			body, _ = ioutil.ReadAll(resp.Body)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expected {
+			t.Error("testcase", tcNumber, test.method, requestPath, "expected", test.expected, "!=", resp.StatusCode, string(body))
+			continue
+		}
+		pathOnly := strings.Split(requestPath, "?")[0]
+		if err := spec.check(test.method, pathOnly, resp, body); err != nil {
+			t.Error("testcase", tcNumber, err)
+		}
+		if template, found := spec.match(pathOnly); found {
+			covered[strings.ToLower(test.method)+" "+template] = true
+		}
+		if test.method == "POST" && test.path == "/webhooks/" {
+			created := Webhook{}
+			json.Unmarshal(body, &created)
+			webhookID = created.ID
+		}
+	}
+
+	// Every documented operation is checked against a live response
+	missing := []string{}
+	for template, operations := range spec.Paths {
+		for method := range operations {
+			if !covered[method+" "+template] {
+				missing = append(missing, method+" "+template)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Error("operations without contract test", missing)
+	}
+
+	// Unversioned routes stay as aliases
+	resp, err = http.Get(server.URL + "/detail/docs/b.txt")
+	if err != nil || resp.StatusCode != 200 {
+		t.Error("expected alias /detail/ to respond 200", err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
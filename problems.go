@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// Errors are answered as RFC 7807 application/problem+json.
+// Code is stable, clients match on it instead of the detail text.
+type errorCode struct {
+	Code   string
+	Status int
+	Title  string
+}
+
+var (
+	codeBadRequest       = errorCode{"bad-request", http.StatusBadRequest, "Bad request"}
+	codeUnauthorized     = errorCode{"unauthorized", http.StatusUnauthorized, "Unauthorized"}
+	codeForbidden        = errorCode{"forbidden", http.StatusForbidden, "Forbidden"}
+	codePermission       = errorCode{"permission-denied", http.StatusForbidden, "Permission denied"}
+	codeNotFound         = errorCode{"not-found", http.StatusNotFound, "Not found"}
+	codeMethodNotAllowed = errorCode{"method-not-allowed", http.StatusMethodNotAllowed, "Method not allowed"}
+	codeExists           = errorCode{"exists", http.StatusConflict, "Path already exists"}
+	codeNotEmpty         = errorCode{"not-empty", http.StatusConflict, "Directory not empty"}
+	codeGone             = errorCode{"gone", http.StatusGone, "No longer available"}
+	codeTooLarge         = errorCode{"too-large", http.StatusRequestEntityTooLarge, "Too large"}
+	codeUnsupportedType  = errorCode{"unsupported-type", http.StatusUnsupportedMediaType, "Unsupported file type"}
+	codeUnprocessable    = errorCode{"unprocessable", http.StatusUnprocessableEntity, "Unable to process file"}
+	codeInvalidSettings  = errorCode{"invalid-settings", http.StatusUnprocessableEntity, "Invalid settings"}
+	codeInternal         = errorCode{"internal", http.StatusInternalServerError, "Internal server error"}
+	codeNoSpace          = errorCode{"no-space", http.StatusInsufficientStorage, "Insufficient storage"}
+)
+
+// Ordered, the first code of a status is its default
+var errorCodes = []errorCode{
+	codeBadRequest, codeUnauthorized, codeForbidden, codePermission, codeNotFound,
+	codeMethodNotAllowed, codeExists, codeNotEmpty, codeGone, codeTooLarge,
+	codeUnsupportedType, codeUnprocessable, codeInvalidSettings, codeInternal, codeNoSpace,
+}
+
+func (c errorCode) Type() string {
+	return apiPrefix + "/problems/" + c.Code
+}
+
+func codeForStatus(status int) errorCode {
+	for _, code := range errorCodes {
+		if code.Status == status {
+			return code
+		}
+	}
+	return errorCode{"error", status, http.StatusText(status)}
+}
+
+// Code of a filesystem error
+func osErrorCode(err error) errorCode {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return codeNotFound
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EROFS):
+		return codePermission
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return codeNotEmpty
+	case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR):
+		return codeExists
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return codeNoSpace
+	}
+	return codeInternal
+}
+
+func problem(code errorCode, detail string) ErrorMsg {
+	return ErrorMsg{
+		Type:       code.Type(),
+		Title:      code.Title,
+		Status:     code.Status,
+		Detail:     detail,
+		Code:       code.Code,
+		Error:      "Error",
+		Reason:     detail,
+		HTTPStatus: code.Status,
+	}
+}
+
+func ProblemResponse(w http.ResponseWriter, code errorCode, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code.Status)
+	writeJSON(w, problem(code, detail))
+}
+
+// Respond to a failed filesystem operation, the detail is given
+// instead of the error so paths on the server are not exposed.
+func OSErrorResponse(w http.ResponseWriter, err error, detail string) {
+	ProblemResponse(w, osErrorCode(err), detail)
+}
+
+// Documentation of the error codes, the type of a problem links here
+// GET /problems/ all codes, /problems/<code> a single code
+func problemsRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	name := strings.Trim(r.URL.Path[len("/problems"):], "/")
+	w.Header().Set("Content-Type", "application/json")
+	if name == "" {
+		writeJSON(w, errorCodes)
+		return
+	}
+	for _, code := range errorCodes {
+		if code.Code == name {
+			writeJSON(w, code)
+			return
+		}
+	}
+	ProblemResponse(w, codeNotFound, "Unknown error code")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestOSErrorCode(t *testing.T) {
+	_, notExist := os.Open("/does/not/exist")
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{notExist, "not-found"},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.EACCES}, "permission-denied"},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, "no-space"},
+		{&os.PathError{Op: "remove", Path: "x", Err: syscall.ENOTEMPTY}, "not-empty"},
+		{&os.LinkError{Op: "rename", Old: "x", New: "y", Err: syscall.EEXIST}, "exists"},
+		{errors.New("unknown"), "internal"},
+	}
+	for tcNumber, test := range tests {
+		result := osErrorCode(test.err).Code
+		if result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+	}
+}
+
+func TestCodeForStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected string
+	}{
+		{400, "bad-request"},
+		{403, "forbidden"},
+		{409, "exists"},
+		{507, "no-space"},
+		{418, "error"},
+	}
+	for tcNumber, test := range tests {
+		result := codeForStatus(test.status).Code
+		if result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type ReloadResult struct {
+	Reloaded []string
+	// Changed, but only applied after a restart
+	RestartRequired []string
+}
+
+// Settings with the same keys as s, at their defaults
+func (s *Settings) fresh() *Settings {
+	f := newSettings()
+	for key, msg := range s.msg {
+		f.msg[key] = msg
+	}
+	for key := range s.VarString {
+		f.VarString[key] = ""
+	}
+	for key := range s.VarInt {
+		f.VarInt[key] = 0
+	}
+	for key := range s.VarBool {
+		f.VarBool[key] = false
+	}
+	for key := range s.VarDuration {
+		f.VarDuration[key] = 0
+	}
+	for key := range s.VarList {
+		f.VarList[key] = nil
+	}
+	for key := range s.VarBytes {
+		f.VarBytes[key] = 0
+	}
+	for key, unit := range s.bytesUnit {
+		f.bytesUnit[key] = unit
+	}
+	for key, value := range s.defaults {
+		f.SetFromString(key, value, "default")
+		f.defaults[key] = value
+	}
+	for key := range s.secret {
+		f.secret[key] = true
+	}
+	for key := range s.reloadable {
+		f.reloadable[key] = true
+	}
+	for key, parser := range s.Parsers {
+		f.Parsers[key] = parser
+	}
+	for key, parser := range s.ParsersInt {
+		f.ParsersInt[key] = parser
+	}
+	for key, check := range s.Validators {
+		f.Validators[key] = check
+	}
+	return f
+}
+
+// Read config file, environment and the original flags again.
+// Changed reloadable settings are applied together, other changes are
+// reported as requiring a restart. Invalid settings change nothing.
+func (s *Settings) Reload() (ReloadResult, error) {
+	result := ReloadResult{Reloaded: []string{}, RestartRequired: []string{}}
+	f := s.fresh()
+	err := f.Parse(s.args)
+	s.mu.Lock()
+	s.warnings = f.warnings
+	s.mu.Unlock()
+	if err != nil {
+		return result, err
+	}
+	for _, key := range s.Keys() {
+		if f.String(key) == s.String(key) {
+			continue
+		}
+		if s.IsReloadable(key) {
+			result.Reloaded = append(result.Reloaded, key)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+
+	s.mu.Lock()
+	for _, key := range result.Reloaded {
+		if _, found := s.VarString[key]; found {
+			s.VarString[key] = f.VarString[key]
+		} else if _, found := s.VarInt[key]; found {
+			s.VarInt[key] = f.VarInt[key]
+		} else if _, found := s.VarBool[key]; found {
+			s.VarBool[key] = f.VarBool[key]
+		} else if _, found := s.VarDuration[key]; found {
+			s.VarDuration[key] = f.VarDuration[key]
+		} else if _, found := s.VarList[key]; found {
+			s.VarList[key] = f.VarList[key]
+		} else if _, found := s.VarBytes[key]; found {
+			s.VarBytes[key] = f.VarBytes[key]
+		}
+		s.source[key] = f.source[key]
+	}
+	s.mu.Unlock()
+
+	if len(result.Reloaded) > 0 {
+		for _, hook := range s.onReload {
+			hook(result.Reloaded)
+		}
+	}
+	return result, nil
+}
+
+func reloadSettings() (ReloadResult, error) {
+	result, err := SETTINGS.Reload()
+	for _, warning := range SETTINGS.Warnings() {
+		log.Println("warning:", warning)
+	}
+	if err != nil {
+		log.Println("reload failed, settings unchanged:", err)
+		return result, err
+	}
+	log.Println("reloaded settings", result.Reloaded, "restart required for", result.RestartRequired)
+	return result, nil
+}
+
+// Reload settings on SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadSettings()
+	}
+}
+
+// Admin API
+// POST /admin/reload reloads the settings
+func reloadRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		ErrorResponse(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := reloadSettings()
+	if err != nil {
+		ProblemResponse(w, codeInvalidSettings, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, result)
+}
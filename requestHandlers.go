@@ -1,26 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func ErrorResponse(w http.ResponseWriter, reason string, httpStatus int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(httpStatus)
-	json.NewEncoder(w).Encode(ErrorMsg{Error: "Error", Reason: reason, HTTPStatus: httpStatus})
+	ProblemResponse(w, codeForStatus(httpStatus), reason)
 }
 
-func handleParameters(w http.ResponseWriter, r *http.Request) []ListFile {
+// Items selected by the query parameters, false when a parameter
+// is invalid and a problem response has been written.
+func handleParameters(w http.ResponseWriter, r *http.Request) ([]ListFile, bool) {
 	filters, filterGiven := r.URL.Query()["filter"]
 	dirs, dirsGiven := r.URL.Query()["dirs"]
 	orderby, orderByGiven := r.URL.Query()["orderby"]
@@ -29,6 +28,25 @@ func handleParameters(w http.ResponseWriter, r *http.Request) []ListFile {
 	pageStr, pageGiven := r.URL.Query()["page"]
 	pageSizeStr, pageSizeGiven := r.URL.Query()["pagesize"]
 	typeAhead, typeAheadGiven := r.URL.Query()["typeahead"]
+	takenAfter, takenAfterGiven := r.URL.Query()["taken_after"]
+	takenBefore, takenBeforeGiven := r.URL.Query()["taken_before"]
+	cameras, camerasGiven := r.URL.Query()["camera"]
+
+	var after, before int64
+	if takenAfterGiven {
+		var err error
+		if after, err = parseTimeParam(takenAfter[0]); err != nil {
+			ProblemResponse(w, codeBadRequest, "taken_after: "+err.Error())
+			return nil, false
+		}
+	}
+	if takenBeforeGiven {
+		var err error
+		if before, err = parseTimeParam(takenBefore[0]); err != nil {
+			ProblemResponse(w, codeBadRequest, "taken_before: "+err.Error())
+			return nil, false
+		}
+	}
 
 	var listItems []ListFile
 	//TODO make generalist filter function that can take many filter option and loops one
@@ -49,12 +67,20 @@ func handleParameters(w http.ResponseWriter, r *http.Request) []ListFile {
 		listItems = filterDirs(listItems, dirs)
 	}
 
+	if takenAfterGiven || takenBeforeGiven {
+		listItems = filterTaken(listItems, after, before)
+	}
+
+	if camerasGiven {
+		listItems = filterCamera(listItems, cameras)
+	}
+
 	if orderByGiven {
 		sortBy(listItems, orderby[0])
 	}
 
 	if !limitGiven && !pageGiven {
-		return listItems
+		return listItems, true
 	}
 
 	limit := len(listItems)
@@ -80,36 +106,48 @@ func handleParameters(w http.ResponseWriter, r *http.Request) []ListFile {
 		end = len(listItems)
 	}
 	if len(listItems) <= limit {
-		return listItems[start:end]
+		return listItems[start:end], true
 	}
 	listItems = listItems[start:end]
 	if len(listItems) < limit {
-		return listItems
+		return listItems, true
 	}
-	return listItems[:limit]
+	return listItems[:limit], true
 }
 
 // REST API functions
 func listRest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	setHeader(w)
-	items := handleParameters(w, r)
+	if checkListConditional(w, r) {
+		return
+	}
+	items, ok := handleParameters(w, r)
+	if !ok {
+		return
+	}
 
 	w.Header().Set("Total-Items", strconv.Itoa(len(items)))
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(items)
+	writeJSON(w, items)
 }
 
 func listGroupedRest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	setHeader(w)
-	items := handleParameters(w, r)
+	if checkListConditional(w, r) {
+		return
+	}
+	items, ok := handleParameters(w, r)
+	if !ok {
+		return
+	}
 
 	w.Header().Set("Total-Items", strconv.Itoa(len(items)))
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(ListFileToGrouped(items))
+	writeJSON(w, ListFileToGrouped(items))
 }
 
 func detailRest(w http.ResponseWriter, r *http.Request) {
@@ -118,13 +156,23 @@ func detailRest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	setHeader(w)
 
-	file, ok := Cache.Get(filename)
+	file, ok := lookupFile(filename)
 	if !ok {
 		ErrorResponse(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if checkConditional(w, r, fileETag(file), time.Unix(file.ModDate, 0)) {
+		return
+	}
+	listFile := file.ListFile()
+	if file.isArchive() {
+		listFile.Members = []ListFile{}
+		for _, member := range archiveMemberFiles(file) {
+			listFile.Members = append(listFile.Members, member.ListFile())
+		}
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(file.ListFile())
+	writeJSON(w, listFile)
 }
 
 func contentRest(w http.ResponseWriter, r *http.Request) {
@@ -139,21 +187,35 @@ func contentRest(w http.ResponseWriter, r *http.Request) {
 	// http.ServeFile(w, r, filepath.Join(SETTINGS.Base, filename))
 	// uncomment the line above, comment out or remove everything below
 
-	file, found := Cache.Get(filename)
+	file, found := lookupFile(filename)
 	if !found {
 		ErrorResponse(w, "File not found", http.StatusNotFound)
 		return
 
 	}
+	if file.Archive != "" {
+		if r.Method == http.MethodDelete {
+			ErrorResponse(w, "Archive members are read only", http.StatusMethodNotAllowed)
+			return
+		}
+		serveArchiveMember(w, r, file)
+		return
+	}
+	if file.ContentType != "" {
+		w.Header().Set("Content-Type", file.ContentType)
+	}
+	// http.ServeFile answers conditional requests using this ETag
+	w.Header().Set("ETag", fileETag(file))
 	switch r.Method {
 	case http.MethodGet:
 		http.ServeFile(w, r, file.fullPath())
 		return
 	case http.MethodDelete:
 		if err := os.Remove(file.fullPath()); err != nil {
-			ErrorResponse(w, "File not found", http.StatusNotFound)
+			OSErrorResponse(w, err, "Unable to delete")
 			return
 		}
+		uncacheDeletedFile(filename)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	default:
@@ -174,63 +236,153 @@ func deleteRest(w http.ResponseWriter, r *http.Request) {
 		ErrorResponse(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if file.Archive != "" {
+		ErrorResponse(w, "Archive members are read only", http.StatusMethodNotAllowed)
+		return
+	}
 	if err := os.Remove(file.fullPath()); err != nil {
-		ErrorResponse(w, "File not found", http.StatusNotFound)
+		OSErrorResponse(w, err, "Unable to delete")
 		return
 	}
+	uncacheDeletedFile(filename)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func uploadRest(w http.ResponseWriter, r *http.Request) {
 	setHeader(w)
-	r.ParseMultipartForm(32 << 20)
-	file, handler, err := r.FormFile("uploadfile")
+	reader, err := r.MultipartReader()
 	if err != nil {
 		ErrorResponse(w, "Unable to handle Multipart form", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	if err := r.ParseForm(); err != nil {
-		ErrorResponse(w, "Unable to handle form", http.StatusBadRequest)
+	// dirs[] fields apply to every uploadfile part that follows them,
+	// clients should send them before the files.
+	// With extract=true every uploadfile is an archive that is
+	// extracted under dirs[] instead of stored as is.
+	extract := r.URL.Query().Get("extract") == "true"
+	dirs := []string{}
+	responses := []UploadSuccesResponse{}
+	failed := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ErrorResponse(w, "Unable to handle Multipart form", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "dirs[]":
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				ErrorResponse(w, "Unable to handle form", http.StatusBadRequest)
+				return
+			}
+			dirs = append(dirs, string(value))
+		case "uploadfile":
+			partResponses := []UploadSuccesResponse{}
+			if extract {
+				partResponses = extractUploadPart(r.Context(), part, dirs)
+			} else {
+				partResponses = append(partResponses, storeUploadPart(part, dirs))
+			}
+			for _, response := range partResponses {
+				if response.Error != "" {
+					failed++
+					uploadFailures.Inc(response.Code)
+				}
+			}
+			responses = append(responses, partResponses...)
+		}
+		part.Close()
+	}
+
+	if len(responses) == 0 {
+		ErrorResponse(w, "No uploadfile given", http.StatusBadRequest)
 		return
 	}
 
-	dirs := []string{}
-	if val, ok := r.PostForm["dirs[]"]; ok {
-		dirs = val
+	// When every file failed the most severe failure is the status
+	status := http.StatusCreated
+	if failed == len(responses) {
+		status = http.StatusBadRequest
+		for _, response := range responses {
+			if response.Status > status {
+				status = response.Status
+			}
+		}
+	} else if failed > 0 {
+		status = http.StatusMultiStatus
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, responses)
+}
 
-	// TODO add validation on cleaned filename
-	clFilename := cleanFilename(handler.Filename)
-	fp := filepath.Join(SETTINGS.Get("base"), strings.Join(dirs, string(filepath.Separator)), clFilename)
-	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE, 0777)
+// Move or rename a file or directory, the new path is given with to=
+// relative to the base directory.
+func moveRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	if r.Method != http.MethodPost {
+		ErrorResponse(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	filename, err := url.PathUnescape(r.URL.Path[len("/move"):])
 	if err != nil {
-		ErrorResponse(w, "Unable to store file", http.StatusBadRequest)
+		ErrorResponse(w, "Unable to parse URL", http.StatusBadRequest)
 		return
 	}
-	defer f.Close()
-	io.Copy(f, file)
-
-	absPath := f.Name()
-	filename := FilenameFromAbsPath(absPath)
-	relativePath := absPath[len(SETTINGS.Get("base")):]
+	file, found := Cache.Get(filename)
+	if !found {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if file.Archive != "" {
+		ErrorResponse(w, "Archive members are read only", http.StatusMethodNotAllowed)
+		return
+	}
+	segments := cleanRelativePath(r.FormValue("to"))
+	if len(segments) == 0 {
+		ErrorResponse(w, "Invalid target, to is required", http.StatusBadRequest)
+		return
+	}
+	target := filepath.Join(SETTINGS.Get("base"), filepath.FromSlash(strings.Join(segments, "/")))
+	if target == file.fullPath() || strings.HasPrefix(target, file.fullPath()+string(filepath.Separator)) {
+		ErrorResponse(w, "Unable to move into itself", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Lstat(target); err == nil {
+		ProblemResponse(w, codeExists, "Target already exists")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		OSErrorResponse(w, err, "Unable to create directory")
+		return
+	}
+	if err := os.Rename(file.fullPath(), target); err != nil {
+		OSErrorResponse(w, err, "Unable to move file")
+		return
+	}
+	cacheMovedFile(filename, target)
 
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(UploadSuccesResponse{
-		Message:     "Upload succeeded",
-		Filename:    filename,
-		ContentURL:  "/" + "content/" + url.PathEscape(relativePath),
-		Directories: removeEmpty(strings.Split(relativePath[:len(relativePath)-len(filename)], "/")),
-	})
+	moved, found := Cache.Get("/" + strings.Join(segments, "/"))
+	if !found {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, moved.ListFile())
 }
 
 func cycleRest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	setHeader(w)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(strconv.Itoa(Cache.LastCycleSec()))
+	writeJSON(w, strconv.Itoa(Cache.LastCycleSec()))
 }
 
 // HTML VIEWS functions
@@ -241,7 +393,10 @@ func indexView(w http.ResponseWriter, r *http.Request) {
 
 func itemsView(w http.ResponseWriter, r *http.Request) {
 	setHeader(w)
-	listItems := handleParameters(w, r)
+	listItems, ok := handleParameters(w, r)
+	if !ok {
+		return
+	}
 	items := []string{}
 	for _, item := range listItems {
 		items = append(items, fmt.Sprintf("<a href=\"%s\">%s</a>", item.ViewURL, item.Name))
@@ -272,11 +427,12 @@ func viewView(w http.ResponseWriter, r *http.Request) {
 		<h1>%s</h1>
 		<p>Video <a href="%s">%s</a></p>
 		<p>Content <a href="%s" download>download</a></p>
-		<p>Image <img src="%s"></p>
+		<p>Image <a href="%s"><img src="%s"></a></p>
 		`,
 			file.Name,
 			("/" + "video" + file.urlEncoded()), file.Name,
-			("/" + "content" + file.urlEncoded()), ("/" + "content" + file.urlEncoded()))
+			("/" + "content" + file.urlEncoded()),
+			("/" + "content" + file.urlEncoded()), ("/" + "thumb" + file.urlEncoded() + "?w=1024&h=1024"))
 
 		response := fmt.Sprintf(`
 	<html>
@@ -293,13 +449,13 @@ func videoView(w http.ResponseWriter, r *http.Request) {
 	filename, err := url.PathUnescape(r.URL.Path[len("/video"):])
 	if err != nil {
 		ErrorResponse(w, "Unable to parse URL", http.StatusBadRequest)
-		log.Fatal("Unable to Parse URL")
+		return
 	}
 	file, found := Cache.Get(filename)
 
 	if !found {
 		ErrorResponse(w, "File not found", http.StatusNotFound)
-		log.Fatal("File not found")
+		return
 	}
 	tmpl := template.New("page")
 	// TODO store templates in a map
@@ -311,7 +467,8 @@ func videoView(w http.ResponseWriter, r *http.Request) {
 	</body>
 	</html>`)
 	if err != nil {
-		log.Fatal(err)
+		ErrorResponse(w, "Unable to render page", http.StatusInternalServerError)
+		return
 	}
 	t.Execute(w, file.ListFile())
 }
@@ -323,8 +480,8 @@ func addView(w http.ResponseWriter, r *http.Request) {
 		<html>
 			<body>
 				<form enctype="multipart/form-data" action="/upload/" method="post">
-				<input type="file" name="uploadfile" />
 				<input type="text" name="dirs[]" value=""/>
+				<input type="file" name="uploadfile" multiple />
 				<input type="submit" value="upload" />
 			</form>
 			</body>
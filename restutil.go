@@ -1,17 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Response structs
+// RFC 7807 problem, Error, Reason and HTTPStatus are kept
+// for clients of the earlier error format, v1 leaves them out.
 type ErrorMsg struct {
-	Error      string
-	Reason     string
-	HTTPStatus int
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Code       string `json:"code"`
+	Error      string `v1:"-"`
+	Reason     string `v1:"-"`
+	HTTPStatus int    `v1:"-"`
 }
 
 type UploadSuccesResponse struct {
@@ -19,6 +28,9 @@ type UploadSuccesResponse struct {
 	Filename    string
 	ContentURL  string
 	Directories []string
+	Error       string `json:",omitempty"`
+	Code        string `json:",omitempty"`
+	Status      int    `json:",omitempty"`
 }
 
 func filter(c *CacheFiles, filters []string) []ListFile {
@@ -105,22 +117,78 @@ func filterDirs(items []ListFile, filters []string) []ListFile {
 	return newItems
 }
 
+// Parse a time from a query parameter,
+// unix seconds, a date 2006-01-02 or RFC3339 are accepted.
+func parseTimeParam(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("%q is not unix seconds, 2006-01-02 or RFC3339", s)
+}
+
+// Keep images taken within after and before, 0 means no bound.
+// Files without a capture date are dropped.
+func filterTaken(items []ListFile, after, before int64) []ListFile {
+	newItems := []ListFile{}
+	for _, item := range items {
+		if item.Image == nil || item.Image.TakenAt == 0 {
+			continue
+		}
+		if after != 0 && item.Image.TakenAt < after {
+			continue
+		}
+		if before != 0 && item.Image.TakenAt > before {
+			continue
+		}
+		newItems = append(newItems, item)
+	}
+	return newItems
+}
+
+// Keep images of which camera make or model contain one of the cameras,
+// case insensitive.
+func filterCamera(items []ListFile, cameras []string) []ListFile {
+	lowered := []string{}
+	for _, camera := range cameras {
+		lowered = append(lowered, strings.ToLower(camera))
+	}
+	newItems := []ListFile{}
+	for _, item := range items {
+		if item.Image != nil && contains(strings.ToLower(item.Image.Camera()), lowered) {
+			newItems = append(newItems, item)
+		}
+	}
+	return newItems
+}
+
+func takenAt(item ListFile) int64 {
+	if item.Image == nil {
+		return 0
+	}
+	return item.Image.TakenAt
+}
+
 func sortBy(items []ListFile, attr string) {
 	sortFuncs := map[string]func(int, int) bool{
-		"name":  func(i, j int) bool { return items[i].Name < items[j].Name },
-		"-name": func(i, j int) bool { return items[i].Name > items[j].Name },
-		"-date": func(i, j int) bool { return items[i].ModDate < items[j].ModDate },
-		"date":  func(i, j int) bool { return items[i].ModDate > items[j].ModDate },
+		"name":   func(i, j int) bool { return items[i].Name < items[j].Name },
+		"-name":  func(i, j int) bool { return items[i].Name > items[j].Name },
+		"-date":  func(i, j int) bool { return items[i].ModDate < items[j].ModDate },
+		"date":   func(i, j int) bool { return items[i].ModDate > items[j].ModDate },
+		"-taken": func(i, j int) bool { return takenAt(items[i]) < takenAt(items[j]) },
+		"taken":  func(i, j int) bool { return takenAt(items[i]) > takenAt(items[j]) },
 	}
 	if sortFunc, found := sortFuncs[attr]; found {
 		sort.Slice(items, sortFunc)
 	}
 }
 
+// CORS headers are set by corsMiddleware
 func setHeader(w http.ResponseWriter) {
-	cors := SETTINGS.Get("cors")
-	if cors == "not-set" {
-		w.Header().Set("Access-Control-Allow-Origin", cors)
-	}
 	w.Header().Set("Last-Update", strconv.Itoa(Cache.LastCycleSec()))
 }
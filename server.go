@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Closed when the server shuts down. Event streams end on it,
+// uploads and downloads in flight are drained.
+var shuttingDown = make(chan struct{})
+
+var closeShuttingDown sync.Once
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              SETTINGS.Get("host"),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       SETTINGS.GetDuration("read-timeout"),
+		WriteTimeout:      SETTINGS.GetDuration("write-timeout"),
+		IdleTimeout:       SETTINGS.GetDuration("idle-timeout"),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	server.RegisterOnShutdown(func() {
+		closeShuttingDown.Do(func() { close(shuttingDown) })
+	})
+	return server
+}
+
+// Serve until ctx is done, then stop accepting connections and wait
+// for requests in flight, at most shutdown-timeout.
+func serve(ctx context.Context, server *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := SETTINGS.GetDuration("shutdown-timeout")
+	logger.Info("shutting down", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := contextReader{ctx, strings.NewReader("hello world")}
+	buf := make([]byte, 5)
+	if n, err := r.Read(buf); n != 5 || err != nil {
+		t.Error("expected read before cancel", n, err)
+	}
+	cancel()
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Error("expected", context.Canceled, "!=", err)
+	}
+}
+
+func TestWaitForSyncCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan bool)
+	go func() {
+		result <- waitForSync(ctx)
+	}()
+	wakeSync()
+	cancel()
+	select {
+	case synced := <-result:
+		if synced {
+			t.Error("expected false when cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Error("waitForSync did not stop on cancel")
+	}
+}
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Settings are read in layers, each overriding the one before:
+//
+//	defaults < config file < environment variables < command line flags
+//
+// The config file is given with -config or the SILO_CONFIG environment variable.
+//
+// Reloadable settings can change while running, see Reload, so they are
+// read through the getters, which are safe for concurrent use.
 type Settings struct {
-	msg        map[string]string
-	VarString  map[string]string
-	VarInt     map[string]int
-	Parsers    map[string]func(string) string
-	ParsersInt map[string]func(int) int
+	mu          sync.RWMutex
+	msg         map[string]string
+	VarString   map[string]string
+	VarInt      map[string]int
+	VarBool     map[string]bool
+	VarDuration map[string]time.Duration
+	VarList     map[string][]string
+	VarBytes    map[string]int64
+	Parsers     map[string]func(string) string
+	ParsersInt  map[string]func(int) int
+	Validators  map[string]func(*Settings) error
+	// Unit of plain numbers given for a byte size
+	bytesUnit  map[string]int64
+	secret     map[string]bool
+	source     map[string]string
+	defaults   map[string]string
+	reloadable map[string]bool
+	onReload   []func(reloaded []string)
+	// Command line arguments, read again on reload
+	args     []string
+	warnings []string
 }
 
 func (s *Settings) Set(flagName, defaultVar, message string) {
 	s.msg[flagName] = message
 	s.VarString[flagName] = defaultVar
+	s.registered(flagName)
+}
+
+func (s *Settings) registered(flagName string) {
+	s.source[flagName] = "default"
+	s.defaults[flagName] = s.String(flagName)
 }
 
 func (s *Settings) SetString(flagName, defaultVar, message string) {
@@ -26,83 +64,540 @@ func (s *Settings) SetString(flagName, defaultVar, message string) {
 func (s *Settings) SetInt(flagName string, defaultVar int, message string) {
 	s.msg[flagName] = message
 	s.VarInt[flagName] = defaultVar
+	s.registered(flagName)
 }
 
 func (s *Settings) SetParsed(flagName, defaultVar, message string, parserFunc func(string) string) {
-	s.msg[flagName] = message
-	s.VarString[flagName] = defaultVar
+	s.Set(flagName, defaultVar, message)
 	s.Parsers[flagName] = parserFunc
 }
 
-func (s *Settings) SetParsedInt(flagName, defaultVar, message string, parserFunc func(int) int) {
-	s.msg[flagName] = message
-	s.VarString[flagName] = defaultVar
+func (s *Settings) SetParsedInt(flagName string, defaultVar int, message string, parserFunc func(int) int) {
+	s.SetInt(flagName, defaultVar, message)
 	s.ParsersInt[flagName] = parserFunc
 }
 
-func (s Settings) Get(flagName string) string {
+// Accepts true, false, 1 and 0
+func (s *Settings) SetBool(flagName string, defaultVar bool, message string) {
+	s.msg[flagName] = message
+	s.VarBool[flagName] = defaultVar
+	s.registered(flagName)
+}
+
+// Accepts durations such as 10m or 1h30m, plain numbers are seconds
+func (s *Settings) SetDuration(flagName string, defaultVar time.Duration, message string) {
+	s.msg[flagName] = message
+	s.VarDuration[flagName] = defaultVar
+	s.registered(flagName)
+}
+
+// Comma separated values
+func (s *Settings) SetList(flagName string, defaultVar []string, message string) {
+	s.msg[flagName] = message
+	s.VarList[flagName] = defaultVar
+	s.registered(flagName)
+}
+
+// Accepts sizes such as 512KB or 1.5GB, plain numbers are in unit
+func (s *Settings) SetBytes(flagName string, defaultVar, unit int64, message string) {
+	s.msg[flagName] = message
+	s.VarBytes[flagName] = defaultVar
+	s.bytesUnit[flagName] = unit
+	s.registered(flagName)
+}
+
+// String setting that is redacted when settings are shown
+func (s *Settings) SetSecret(flagName, defaultVar, message string) {
+	s.Set(flagName, defaultVar, message)
+	s.secret[flagName] = true
+}
+
+// Check run after all layers are read, errors stop the startup
+func (s *Settings) Validate(flagName string, check func(*Settings) error) {
+	s.Validators[flagName] = check
+}
+
+// Settings that Reload may change while running
+func (s *Settings) Reloadable(flagNames ...string) {
+	for _, flagName := range flagNames {
+		s.reloadable[flagName] = true
+	}
+}
+
+func (s *Settings) IsReloadable(flagName string) bool {
+	return s.reloadable[flagName]
+}
+
+// Called after a reload changed settings
+func (s *Settings) OnReload(hook func(reloaded []string)) {
+	s.onReload = append(s.onReload, hook)
+}
+
+func (s *Settings) Get(flagName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.VarString[flagName]
 }
 
-func (s Settings) GetInt(flagName string) int {
+func (s *Settings) GetInt(flagName string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.VarInt[flagName]
 }
 
-func (s *Settings) HandleCMDLineInput() {
-	parsedString := make(map[string]*string)
-	for key, val := range s.VarString {
-		var newV = flag.String(key, val, s.msg[key])
-		parsedString[key] = newV
+func (s *Settings) GetBool(flagName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.VarBool[flagName]
+}
+
+func (s *Settings) GetDuration(flagName string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.VarDuration[flagName]
+}
+
+func (s *Settings) GetList(flagName string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.VarList[flagName]
+}
+
+func (s *Settings) GetBytes(flagName string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.VarBytes[flagName]
+}
+
+// Where the value of a setting came from
+func (s *Settings) Source(flagName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.source[flagName]
+}
+
+func (s *Settings) IsSecret(flagName string) bool {
+	return s.secret[flagName]
+}
+
+func (s *Settings) Keys() []string {
+	keys := []string{}
+	for key := range s.msg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Value of any setting as it would be given on the command line
+func (s *Settings) String(flagName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, found := s.VarString[flagName]; found {
+		return v
+	}
+	if v, found := s.VarInt[flagName]; found {
+		return strconv.Itoa(v)
+	}
+	if v, found := s.VarBool[flagName]; found {
+		return strconv.FormatBool(v)
 	}
-	parsedInt := make(map[string]*int)
-	for key, val := range s.VarInt {
-		var newV = flag.Int(key, val, s.msg[key])
-		parsedInt[key] = newV
+	if v, found := s.VarDuration[flagName]; found {
+		return v.String()
 	}
-	flag.Parse()
+	if v, found := s.VarList[flagName]; found {
+		return strings.Join(v, ",")
+	}
+	if v, found := s.VarBytes[flagName]; found {
+		return formatByteSize(v)
+	}
+	return ""
+}
 
-	for key, val := range parsedString {
-		if parseFunc, found := s.Parsers[key]; found {
-			s.VarString[key] = parseFunc(*val)
-		} else {
-			s.VarString[key] = *val
+// Set a setting from text, the type of the setting decides the parsing
+func (s *Settings) SetFromString(flagName, value, source string) error {
+	if _, found := s.msg[flagName]; !found {
+		return fmt.Errorf("unknown setting %s", flagName)
+	}
+	if _, found := s.VarString[flagName]; found {
+		s.VarString[flagName] = value
+	} else if _, found := s.VarInt[flagName]; found {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not an integer", flagName, source, value)
 		}
+		s.VarInt[flagName] = n
+	} else if _, found := s.VarBool[flagName]; found {
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not true or false", flagName, source, value)
+		}
+		s.VarBool[flagName] = b
+	} else if _, found := s.VarDuration[flagName]; found {
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not a duration, such as 90s or 10m", flagName, source, value)
+		}
+		s.VarDuration[flagName] = d
+	} else if _, found := s.VarList[flagName]; found {
+		s.VarList[flagName] = parseList(value)
+	} else if _, found := s.VarBytes[flagName]; found {
+		n, err := parseByteSize(value, s.bytesUnit[flagName])
+		if err != nil {
+			return fmt.Errorf("%s from %s: %q is not a size, such as 512KB or 2GB", flagName, source, value)
+		}
+		s.VarBytes[flagName] = n
 	}
-	for key, val := range parsedInt {
-		if parseFunc, found := s.ParsersInt[key]; found {
-			s.VarInt[key] = parseFunc(*val)
-		} else {
-			s.VarInt[key] = *val
+	s.source[flagName] = source
+	return nil
+}
+
+func (s *Settings) HandleConfigFile(fp string) error {
+	values, err := readConfigFile(fp)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := []string{}
+	for _, key := range keys {
+		if err := s.SetFromString(key, values[key], "config "+fp); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+const envPrefix = "SILO_"
+
+// Environment variable of a setting, extract-max-size is SILO_EXTRACT_MAX_SIZE
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Value of the environment variable name, or the contents of the file named
+// by name_FILE, for secrets mounted by Docker or Kubernetes. The client
+// commands read SILO_TOKEN with it as well.
+func LookupEnvSecret(name string) (value, source string, found bool, err error) {
+	value, found = os.LookupEnv(name)
+	fp, fileFound := os.LookupEnv(name + "_FILE")
+	switch {
+	case found && fileFound:
+		return "", "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	case found:
+		return value, "env " + name, true, nil
+	case fileFound:
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return "", "", false, fmt.Errorf("from env %s_FILE: %s", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), "file " + fp, true, nil
+	}
+	return "", "", false, nil
+}
+
+// Value of a setting from the environment, SILO_NAME or SILO_NAME_FILE.
+// The bare setting name still works, with a deprecation warning.
+func (s *Settings) lookupEnv(flagName string) (value, source string, found bool, err error) {
+	name := envName(flagName)
+	value, source, found, err = LookupEnvSecret(name)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%s: %s", flagName, err)
+	}
+	if found {
+		return value, source, true, nil
+	}
+	if value, found = os.LookupEnv(flagName); found {
+		s.warnings = append(s.warnings, fmt.Sprintf("environment variable %s is deprecated, use %s", flagName, name))
+		return value, "env " + flagName, true, nil
+	}
+	return "", "", false, nil
+}
+
+func (s *Settings) HandleOSInput() error {
+	s.warnings = nil
+	errs := []string{}
+	for _, key := range s.Keys() {
+		value, source, found, err := s.lookupEnv(key)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !found {
+			continue
+		}
+		if err := s.SetFromString(key, value, source); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Warnings of the last Parse, such as deprecated environment variables
+func (s *Settings) Warnings() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.warnings
+}
+
+// Flag value writing into the settings
+type settingFlag struct {
+	s   *Settings
+	key string
+}
+
+func (f settingFlag) String() string {
+	if f.s == nil {
+		return ""
+	}
+	return f.s.String(f.key)
+}
+
+func (f settingFlag) Set(value string) error {
+	return f.s.SetFromString(f.key, value, "flag")
+}
+
+// Bool settings can be given without a value, -archive-browse
+func (f settingFlag) IsBoolFlag() bool {
+	if f.s == nil {
+		return false
+	}
+	_, found := f.s.VarBool[f.key]
+	return found
+}
+
+func (s *Settings) HandleCMDLineInput(args []string) error {
+	flags := flag.NewFlagSet("silo", flag.ContinueOnError)
+	for _, key := range s.Keys() {
+		flags.Var(settingFlag{s, key}, key, s.msg[key])
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// -archive-browse false would turn it on and skip the flags after it
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q, bool settings are given as -name or -name=false", flags.Arg(0))
+	}
+	return nil
+}
+
+// Config file given by flag or environment, before the flags are parsed
+func configFileArg(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	if fp, found := os.LookupEnv(envName("config")); found {
+		return fp
+	}
+	return os.Getenv("config")
+}
+
+// Read all layers and validate the result, errors name the setting and
+// where the invalid value came from.
+func (s *Settings) Parse(args []string) error {
+	s.args = args
+	if fp := configFileArg(args); fp != "" {
+		if err := s.HandleConfigFile(fp); err != nil {
+			return err
+		}
+	}
+	if err := s.HandleOSInput(); err != nil {
+		return err
+	}
+	if err := s.HandleCMDLineInput(args); err != nil {
+		return err
+	}
+
+	for key, parseFunc := range s.Parsers {
+		s.VarString[key] = parseFunc(s.VarString[key])
+	}
+	for key, parseFunc := range s.ParsersInt {
+		s.VarInt[key] = parseFunc(s.VarInt[key])
+	}
+	errs := []string{}
+	for _, key := range s.Keys() {
+		if check, found := s.Validators[key]; found {
+			if err := check(s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s from %s: %s", key, s.source[key], err))
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// Sizes are 1024 based, plain numbers are in unit
+func parseByteSize(s string, unit int64) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.Replace(s, "IB", "B", 1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+func formatByteSize(n int64) string {
+	for _, u := range byteUnits[:4] {
+		if n >= u.size && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
 		}
 	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// Config files are JSON, any other file is a flat list of key = value or
+// key: value lines. There is no YAML or TOML parser in the standard library,
+// .yaml and .toml files are read as the same flat lines, which covers simple
+// files in both. Sections, nesting and multi-line values are refused instead
+// of being read wrong, lists are comma separated or written as [a, b].
+func readConfigFile(fp string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %s", err)
+	}
+	if strings.HasSuffix(strings.ToLower(fp), ".json") {
+		return parseJSONConfig(data, fp)
+	}
+	return parseFlatConfig(data, fp)
 }
 
-func (s *Settings) HandleOSInput() {
-	for key, _ := range s.VarString {
-		varEnv, found := os.LookupEnv(key)
-		if found {
-			s.VarString[key] = varEnv
+func parseJSONConfig(data []byte, fp string) (map[string]string, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config file %s: %s", fp, err)
+	}
+	values := map[string]string{}
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case []interface{}:
+			items := []string{}
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("config file %s: %s has an unsupported value", fp, key)
 		}
 	}
-	for key, _ := range s.VarInt {
-		varEnv, found := os.LookupEnv(key)
-		if found {
-			if num, err := strconv.Atoi(varEnv); err == nil {
-				s.VarInt[key] = num
+	return values, nil
+}
+
+func parseFlatConfig(data []byte, fp string) (map[string]string, error) {
+	values := map[string]string{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("config file %s line %d: nested values are not supported, only flat key = value lines", fp, i+1)
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "-") {
+			return nil, fmt.Errorf("config file %s line %d: expected key = value", fp, i+1)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:sep]), `"'`)
+		value := strings.TrimSpace(line[sep+1:])
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			items := []string{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				items = append(items, unquote(strings.TrimSpace(item)))
 			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquote(value)
 		}
+		values[key] = value
 	}
+	return values, nil
 }
 
-func (s *Settings) Parse() {
-	s.HandleOSInput()
-	s.HandleCMDLineInput()
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	// Trailing comment
+	if i := strings.Index(s, " #"); i >= 0 {
+		return strings.TrimSpace(s[:i])
+	}
+	return s
 }
 
-var SETTINGS = Settings{
-	msg:        make(map[string]string),
-	VarString:  make(map[string]string),
-	VarInt:     make(map[string]int),
-	Parsers:    make(map[string]func(string) string),
-	ParsersInt: make(map[string]func(int) int),
+var SETTINGS = newSettings()
+
+func newSettings() *Settings {
+	return &Settings{
+		msg:         make(map[string]string),
+		VarString:   make(map[string]string),
+		VarInt:      make(map[string]int),
+		VarBool:     make(map[string]bool),
+		VarDuration: make(map[string]time.Duration),
+		VarList:     make(map[string][]string),
+		VarBytes:    make(map[string]int64),
+		Parsers:     make(map[string]func(string) string),
+		ParsersInt:  make(map[string]func(int) int),
+		Validators:  make(map[string]func(*Settings) error),
+		bytesUnit:   make(map[string]int64),
+		secret:      make(map[string]bool),
+		source:      make(map[string]string),
+		defaults:    make(map[string]string),
+		reloadable:  make(map[string]bool),
+	}
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		unit     int64
+		expected int64
+	}{
+		{"512", 1, 512},
+		{"512", 1 << 20, 512 << 20},
+		{"1KB", 1, 1024},
+		{"1.5GB", 1, 3 << 29},
+		{"2 MiB", 1, 2 << 20},
+		{"10g", 1, 10 << 30},
+	}
+	for tcNumber, test := range tests {
+		result, err := parseByteSize(test.input, test.unit)
+		if err != nil || result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result, err)
+		}
+	}
+	if _, err := parseByteSize("lots", 1); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+	}{
+		{"600", 600 * time.Second},
+		{"10m", 10 * time.Minute},
+		{" 1h30m ", 90 * time.Minute},
+	}
+	for tcNumber, test := range tests {
+		result, err := parseDuration(test.input)
+		if err != nil || result != test.expected {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result, err)
+		}
+	}
+}
+
+func TestParseFlatConfig(t *testing.T) {
+	config := `
+# silo
+host = "127.0.0.1:9000"
+sync: 5m
+webhooks = [http://a/hook, 'http://b/hook']
+archive-browse: true # members too
+`
+	values, err := parseFlatConfig([]byte(config), "silo.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"host":           "127.0.0.1:9000",
+		"sync":           "5m",
+		"webhooks":       "http://a/hook,http://b/hook",
+		"archive-browse": "true",
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Error("expected", key, value, "!=", values[key])
+		}
+	}
+	invalid := []string{
+		"[server]\nhost = x",
+		"server:\n  host: x",
+		"webhooks:\n- http://a/hook",
+		"host",
+	}
+	for tcNumber, config := range invalid {
+		if _, err := parseFlatConfig([]byte(config), "silo.yaml"); err == nil {
+			t.Error("testcase", tcNumber, "expected error for", config)
+		}
+	}
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silo-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "silo.json")
+	ioutil.WriteFile(fp, []byte(`{"host": "file:1", "sync": 30, "limit": "1KB", "debug": true}`), 0644)
+
+	s := newSettings()
+	s.Set("host", "default:1", "")
+	s.SetDuration("sync", time.Minute, "")
+	s.SetBytes("limit", 0, 1, "")
+	s.SetBool("debug", false, "")
+	s.SetInt("workers", 1, "")
+	os.Setenv("SILO_SYNC", "45")
+	defer os.Unsetenv("SILO_SYNC")
+
+	s.Set("config", "", "")
+	if err := s.Parse([]string{"-config", fp, "-workers", "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key    string
+		value  string
+		source string
+	}{
+		{"host", "file:1", "config " + fp},
+		{"sync", "45s", "env SILO_SYNC"},
+		{"limit", "1KB", "config " + fp},
+		{"debug", "true", "config " + fp},
+		{"workers", "4", "flag"},
+	}
+	for tcNumber, test := range tests {
+		if s.String(test.key) != test.value || s.Source(test.key) != test.source {
+			t.Error("testcase", tcNumber, "expected", test.value, test.source, "!=", s.String(test.key), s.Source(test.key))
+		}
+	}
+
+	os.Setenv("SILO_SYNC", "soon")
+	if err := s.Parse(nil); err == nil {
+		t.Error("expected error for invalid env value")
+	}
+}
+
+func TestSettingsReload(t *testing.T) {
+	s := newSettings()
+	s.Set("host", "default:1", "")
+	s.SetDuration("sync", time.Minute, "")
+	s.Reloadable("sync")
+	s.Validate("sync", func(s *Settings) error {
+		if s.GetDuration("sync") <= 0 {
+			return errors.New("must be larger than 0")
+		}
+		return nil
+	})
+	reloads := 0
+	s.OnReload(func([]string) { reloads++ })
+	if err := s.Parse([]string{"-host", "flag:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SILO_SYNC", "5m")
+	os.Setenv("SILO_HOST", "env:1")
+	defer os.Unsetenv("SILO_SYNC")
+	defer os.Unsetenv("SILO_HOST")
+	result, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Reloaded) != 1 || result.Reloaded[0] != "sync" || s.GetDuration("sync") != 5*time.Minute {
+		t.Error("expected sync reloaded to 5m !=", result.Reloaded, s.GetDuration("sync"))
+	}
+	// The flag still wins over the changed env
+	if len(result.RestartRequired) != 0 || s.Get("host") != "flag:1" {
+		t.Error("expected host unchanged !=", result.RestartRequired, s.Get("host"))
+	}
+	if reloads != 1 {
+		t.Error("expected 1 reload hook call !=", reloads)
+	}
+
+	os.Setenv("SILO_SYNC", "-1")
+	if _, err := s.Reload(); err == nil || s.GetDuration("sync") != 5*time.Minute {
+		t.Error("expected invalid reload to change nothing !=", err, s.GetDuration("sync"))
+	}
+
+	os.Setenv("SILO_SYNC", "5m")
+	s.args = nil
+	result, _ = s.Reload()
+	if len(result.RestartRequired) != 1 || result.RestartRequired[0] != "host" || s.Get("host") != "flag:1" {
+		t.Error("expected host to require a restart !=", result.RestartRequired, s.Get("host"))
+	}
+}
+
+func TestSettingsEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silo-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "token")
+	ioutil.WriteFile(fp, []byte("s3cret\n"), 0600)
+
+	s := newSettings()
+	s.SetSecret("admin-token", "", "")
+	s.SetInt("extract-max-files", 1, "")
+	s.Set("host", "", "")
+	os.Setenv("SILO_ADMIN_TOKEN_FILE", fp)
+	os.Setenv("SILO_EXTRACT_MAX_FILES", "7")
+	os.Setenv("host", "legacy:1")
+	defer os.Unsetenv("SILO_ADMIN_TOKEN_FILE")
+	defer os.Unsetenv("SILO_EXTRACT_MAX_FILES")
+	defer os.Unsetenv("host")
+	if err := s.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key    string
+		value  string
+		source string
+	}{
+		{"admin-token", "s3cret", "file " + fp},
+		{"extract-max-files", "7", "env SILO_EXTRACT_MAX_FILES"},
+		{"host", "legacy:1", "env host"},
+	}
+	for tcNumber, test := range tests {
+		if s.String(test.key) != test.value || s.Source(test.key) != test.source {
+			t.Error("testcase", tcNumber, "expected", test.value, test.source, "!=", s.String(test.key), s.Source(test.key))
+		}
+	}
+	if len(s.Warnings()) != 1 {
+		t.Error("expected a deprecation warning for host !=", s.Warnings())
+	}
+
+	os.Setenv("SILO_ADMIN_TOKEN", "other")
+	defer os.Unsetenv("SILO_ADMIN_TOKEN")
+	if err := s.Parse(nil); err == nil {
+		t.Error("expected error when both SILO_ADMIN_TOKEN and SILO_ADMIN_TOKEN_FILE are set")
+	}
+}
+
+func TestBoolFlagWithoutValue(t *testing.T) {
+	s := newSettings()
+	s.SetBool("archive-browse", false, "")
+	s.SetBool("thumb-sync", true, "")
+	s.Set("host", "", "")
+	if err := s.Parse([]string{"-archive-browse", "-thumb-sync=false", "-host", "x:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.GetBool("archive-browse") || s.GetBool("thumb-sync") || s.Get("host") != "x:1" {
+		t.Error("unexpected settings", s.GetBool("archive-browse"), s.GetBool("thumb-sync"), s.Get("host"))
+	}
+	if err := s.Parse([]string{"-archive-browse", "false"}); err == nil {
+		t.Error("expected error for a bool flag with a separate value")
+	}
+	if (settingFlag{s, "host"}).IsBoolFlag() || !(settingFlag{s, "archive-browse"}).IsBoolFlag() {
+		t.Error("only bool settings are bool flags")
+	}
+}
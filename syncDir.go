@@ -1,76 +1,229 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"io/ioutil"
-	"log"
+	"os"
 	"path/filepath"
 	"time"
 )
 
-func syncFiles(path string) {
+// Keep the cache in sync with the base directory until ctx is done
+func syncFiles(ctx context.Context, path string) {
 	var start time.Time
 	var updateCache bool
 	for {
 		start = time.Now()
 		fileChan := make(chan *File, 100)
-		go DirWalk(path, fileChan, true)
+		walkErr := make(chan error, 1)
+		go func() {
+			walkErr <- DirWalk(ctx, path, fileChan)
+			close(fileChan)
+		}()
 		items := make(map[string]*File)
 
 		updateCache = false
 		for file := range fileChan {
 			filePath := file.relativePath()
 			cachedFile, found := Cache.Get(filePath)
-			if !found || cachedFile.ModDate != file.ModDate {
+			if !found || cachedFile.ModNano != file.ModNano {
 				updateCache = true
 				file.SetContentType()
+				file.SetImageMeta()
+				file.SetMediaMeta()
+				if file.thumbnailable() && SETTINGS.GetBool("thumb-sync") {
+					thumbnail(ctx, file, thumbDefaultSize, thumbDefaultSize)
+				}
 				items[filePath] = file
 			} else {
 				items[filePath] = cachedFile
 			}
 		}
-		if updateCache || len(items) != Cache.Length() {
-			fmt.Println("update items", updateCache, len(items), Cache.Length())
-			Cache.Update(items)
+		if ctx.Err() != nil {
+			return
+		}
+		// The cache is kept as it is when base can not be read,
+		// an empty listing would report every file as deleted.
+		if err := <-walkErr; err != nil {
+			logger.Error("sync failed", "error", err.Error())
+		} else {
+			if updateCache || len(items) != Cache.Length() {
+				logger.Debug("update items", "changed", updateCache, "items", len(items), "cached", Cache.Length())
+				Events.Publish(Cache.Update(items))
+			}
+			recordSync(start)
+			logger.Info("sync done", "items", len(items), "duration_ms", time.Since(start).Milliseconds())
+		}
+		if !waitForSync(ctx) {
+			return
 		}
-		fmt.Println("ingestion took:", time.Now().Sub(start))
-		time.Sleep(time.Second * time.Duration(SETTINGS.GetInt("sync")))
 	}
 }
 
-func DirWalk(path string, fileChan chan *File, toplevel bool) {
+var syncIntervalChanged = make(chan struct{}, 1)
+
+// Wait the sync interval, starting over when the interval is reloaded.
+// False when ctx is done.
+func waitForSync(ctx context.Context) bool {
+	for {
+		timer := time.NewTimer(SETTINGS.GetDuration("sync"))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+			return true
+		case <-syncIntervalChanged:
+			timer.Stop()
+		}
+	}
+}
+
+func wakeSync() {
+	select {
+	case syncIntervalChanged <- struct{}{}:
+	default:
+	}
+}
 
-	var absPath string
-	if filepath.IsAbs(path) {
-		absPath = path
-	} else {
-		var err error
-		absPath, err = filepath.Abs(path)
+// Add a file stored by a request to the cache, together with
+// its parent directories, so it is listed before the next sync.
+func cacheStoredFile(fullPath string) {
+	basePath := SETTINGS.Get("base")
+	for p := fullPath; len(p) > len(basePath); p = filepath.Dir(p) {
+		info, err := os.Stat(p)
 		if err != nil {
-			log.Fatal(err)
+			return
+		}
+		absPath := filepath.Dir(p)
+		file := &File{
+			Name:    info.Name(),
+			ModDate: info.ModTime().Unix(),
+			ModNano: info.ModTime().UnixNano(),
+			Size:    info.Size(),
+			AbsPath: absPath,
+			RelPath: absPath[len(basePath):] + string(filepath.Separator),
+			IsDir:   info.IsDir(),
+		}
+		_, found := Cache.Get(file.relativePath())
+		if found && file.IsDir {
+			return
+		}
+		if !file.IsDir {
+			file.SetContentType()
+			file.SetImageMeta()
+			file.SetMediaMeta()
+		}
+		Events.Publish([]Change{Cache.Set(file.relativePath(), file)})
+	}
+}
+
+// Remove a file deleted by a request from the cache
+func uncacheDeletedFile(key string) {
+	if file, found := Cache.Delete(key); found {
+		Events.Publish([]Change{{Type: EventDeleted, File: file}})
+	}
+}
+
+// Update the cache after a file or directory is moved by a request.
+// Files are reported as moved, directories as deleted and created
+// since all their children change path.
+func cacheMovedFile(oldKey, newPath string) {
+	old, found := Cache.Get(oldKey)
+	if !found {
+		return
+	}
+	if old.IsDir {
+		for _, key := range Cache.KeysWithPrefix(oldKey + "/") {
+			uncacheDeletedFile(key)
 		}
+		uncacheDeletedFile(oldKey)
+		filepath.Walk(newPath, func(p string, info os.FileInfo, err error) error {
+			if err == nil {
+				cacheStoredFile(p)
+			}
+			return nil
+		})
+		return
+	}
+
+	cacheStoredFile(filepath.Dir(newPath))
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return
+	}
+	Cache.Delete(oldKey)
+	absPath := filepath.Dir(newPath)
+	file := *old
+	file.Name = info.Name()
+	file.AbsPath = absPath
+	file.RelPath = absPath[len(SETTINGS.Get("base")):] + string(filepath.Separator)
+	Cache.Set(file.relativePath(), &file)
+	Events.Publish([]Change{{Type: EventMoved, File: &file, From: old}})
+}
+
+// Send every file below path to fileChan. Directories below path that
+// can not be read are logged and skipped, the walk stops with an error
+// when path itself can not be read or ctx is done.
+func DirWalk(ctx context.Context, path string, fileChan chan<- *File) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
 	}
 	files, err := ioutil.ReadDir(absPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return walkDir(ctx, path, absPath, files, fileChan)
+}
+
+func walkDir(ctx context.Context, path, absPath string, files []os.FileInfo, fileChan chan<- *File) error {
 	basePath := SETTINGS.Get("base")
+	send := func(f *File) error {
+		select {
+		case fileChan <- f:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 
 	for _, file := range files {
+		if isInternalName(file.Name()) {
+			continue
+		}
 		// TODO check mod time, to skip unchanged files.
-		fileChan <- &File{
+		f := &File{
 			Name:    file.Name(),
 			ModDate: file.ModTime().Unix(),
+			ModNano: file.ModTime().UnixNano(),
 			Size:    file.Size(),
 			AbsPath: absPath,
 			RelPath: path[len(basePath):] + string(filepath.Separator),
 			IsDir:   file.IsDir(),
 		}
-		if file.IsDir() {
-			DirWalk(filepath.Join(path, file.Name()), fileChan, false)
+		if err := send(f); err != nil {
+			return err
+		}
+		if f.isArchive() && SETTINGS.GetBool("archive-browse") {
+			for _, member := range archiveMemberFiles(f) {
+				if err := send(member); err != nil {
+					return err
+				}
+			}
+		}
+		if !file.IsDir() {
+			continue
+		}
+		subAbsPath := filepath.Join(absPath, file.Name())
+		subFiles, err := ioutil.ReadDir(subAbsPath)
+		if err != nil {
+			logger.Warn("skipping unreadable directory", "path", subAbsPath, "error", err.Error())
+			continue
+		}
+		if err := walkDir(ctx, filepath.Join(path, file.Name()), subAbsPath, subFiles, fileChan); err != nil {
+			return err
 		}
 	}
-	if toplevel {
-		close(fileChan)
-	}
+	return nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDirWalk(t *testing.T) {
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(base, "locked"), 0755)
+	os.WriteFile(filepath.Join(base, "a", "b", "c.txt"), []byte("c"), 0644)
+	os.WriteFile(filepath.Join(base, "locked", "d.txt"), []byte("d"), 0644)
+	os.Chmod(filepath.Join(base, "locked"), 0)
+	defer os.Chmod(filepath.Join(base, "locked"), 0755)
+	// root reads the directory regardless of its mode
+	locked := os.Geteuid() != 0
+
+	oldBase := SETTINGS.Get("base")
+	SETTINGS.VarString["base"] = base
+	defer func() {
+		SETTINGS.VarString["base"] = oldBase
+	}()
+
+	fileChan := make(chan *File, 100)
+	err := DirWalk(context.Background(), base, fileChan)
+	close(fileChan)
+	result := []string{}
+	for f := range fileChan {
+		result = append(result, f.relativePath())
+	}
+	sort.Strings(result)
+	expected := []string{"/a", "/a/b", "/a/b/c.txt", "/locked", "/locked/d.txt"}
+	if locked {
+		expected = []string{"/a", "/a/b", "/a/b/c.txt", "/locked"}
+	}
+	if err != nil || strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Error("expected", expected, "!=", result, err)
+	}
+
+	// an unreadable base is an error instead of an empty listing
+	fileChan = make(chan *File, 100)
+	if err := DirWalk(context.Background(), filepath.Join(base, "missing"), fileChan); err == nil {
+		t.Error("expected an error for a missing base")
+	}
+
+	// a cancelled walk stops while nobody reads the files
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := DirWalk(ctx, base, make(chan *File)); err != context.Canceled {
+		t.Error("expected", context.Canceled, "!=", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+const (
+	thumbDefaultSize = 256
+	thumbMaxSize     = 2048
+)
+
+// Images above this are not decoded, a small file can declare huge
+// dimensions and make the decoder allocate gigabytes.
+const thumbMaxPixels = 40 * 1000 * 1000
+
+var errThumbTooLarge = errors.New("Image too large for a thumbnail")
+
+// Limits the number of thumbnails decoded at the same time,
+// decoding large images takes a lot of memory.
+var thumbSemaphore = make(chan struct{}, runtime.NumCPU())
+
+// Images that can be decoded with the standard library.
+func (f File) thumbnailable() bool {
+	if f.IsDir || f.Archive != "" {
+		return false
+	}
+	switch f.ContentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+func thumbDir() string {
+	if dir := SETTINGS.Get("thumb-dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), ".silo-thumbs")
+}
+
+// Thumbnails are keyed on path and ModDate, a changed file gets a new thumbnail.
+// Stale thumbnails are left behind, the directory can be emptied at any time.
+func thumbPath(f *File, width, height int) string {
+	ext := ".jpg"
+	if f.ContentType != "image/jpeg" {
+		ext = ".png"
+	}
+	key := f.relativePath() + "|" + strconv.FormatInt(f.ModDate, 10) + "|" +
+		strconv.Itoa(width) + "x" + strconv.Itoa(height)
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(thumbDir(), hex.EncodeToString(sum[:])+ext)
+}
+
+// Width and height that fit within maxWidth and maxHeight, keeping the aspect ratio.
+// Images are never enlarged.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	if width*maxHeight > height*maxWidth {
+		h := height * maxWidth / width
+		if h < 1 {
+			h = 1
+		}
+		return maxWidth, h
+	}
+	w := width * maxHeight / height
+	if w < 1 {
+		w = 1
+	}
+	return w, maxHeight
+}
+
+// The size is read from the header only, before anything is allocated
+func checkImageSize(r io.ReadSeeker) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > thumbMaxPixels {
+		return errThumbTooLarge
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// Downscale with a box filter, every destination pixel is the average
+// of the source pixels it covers.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := (y + 1) * srcH / height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := (x + 1) * srcW / width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					b += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Return the path of the thumbnail, generating it when not cached yet.
+// Generating stops when ctx is done before the image is decoded.
+func thumbnail(ctx context.Context, f *File, maxWidth, maxHeight int) (string, error) {
+	fp := thumbPath(f, maxWidth, maxHeight)
+	if _, err := os.Stat(fp); err == nil {
+		return fp, nil
+	}
+
+	select {
+	case thumbSemaphore <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-thumbSemaphore }()
+
+	osFile, err := os.Open(f.fullPath())
+	if err != nil {
+		return "", err
+	}
+	defer osFile.Close()
+	if err := checkImageSize(osFile); err != nil {
+		return "", err
+	}
+	var src image.Image
+	switch f.ContentType {
+	case "image/gif":
+		// First frame only
+		src, err = gif.Decode(contextReader{ctx, osFile})
+	default:
+		src, _, err = image.Decode(contextReader{ctx, osFile})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), maxWidth, maxHeight)
+	dst := resizeImage(src, width, height)
+
+	if err := os.MkdirAll(thumbDir(), 0777); err != nil {
+		return "", err
+	}
+	// Write to a temporary file first, concurrent requests for the
+	// same thumbnail never see a partial file.
+	tmp, err := ioutil.TempFile(thumbDir(), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if filepath.Ext(fp) == ".jpg" {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tmp, dst)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return fp, os.Rename(tmp.Name(), fp)
+}
+
+// Parse a thumbnail dimension from the query, default when missing.
+func thumbSize(s string) int {
+	if s == "" {
+		return thumbDefaultSize
+	}
+	n := intMoreDefault(s, 1)
+	if n < 1 {
+		return thumbDefaultSize
+	}
+	if n > thumbMaxSize {
+		return thumbMaxSize
+	}
+	return n
+}
+
+func thumbRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	filename, err := url.PathUnescape(r.URL.Path[len("/thumb"):])
+	if err != nil {
+		ErrorResponse(w, "Unable to parse URL", http.StatusBadRequest)
+		return
+	}
+	file, found := Cache.Get(filename)
+	if !found {
+		ErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !file.thumbnailable() {
+		ErrorResponse(w, "No thumbnail available for this file type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	query := r.URL.Query()
+	fp, err := thumbnail(r.Context(), file, thumbSize(query.Get("w")), thumbSize(query.Get("h")))
+	if errors.Is(err, errThumbTooLarge) {
+		ProblemResponse(w, codeTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, "Unable to create thumbnail", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, fp)
+}
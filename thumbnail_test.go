@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	testcases := []struct {
+		width, height, maxWidth, maxHeight int
+		expectedWidth, expectedHeight      int
+	}{
+		{100, 100, 256, 256, 100, 100},
+		{1000, 500, 256, 256, 256, 128},
+		{500, 1000, 256, 256, 128, 256},
+		{1000, 1000, 200, 100, 100, 100},
+		{10000, 1, 100, 100, 100, 1},
+	}
+
+	for tcNumber, testcase := range testcases {
+		w, h := fitSize(testcase.width, testcase.height, testcase.maxWidth, testcase.maxHeight)
+		if w != testcase.expectedWidth || h != testcase.expectedHeight {
+			t.Error("testcase", tcNumber, "expected", testcase.expectedWidth, testcase.expectedHeight, "!=", w, h)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		src.Set(x, 0, color.RGBA{255, 0, 0, 255})
+		src.Set(x, 1, color.RGBA{0, 0, 255, 255})
+	}
+
+	dst := resizeImage(src, 2, 1)
+	if dst.Bounds().Dx() != 2 || dst.Bounds().Dy() != 1 {
+		t.Fatal("expected 2x1 image, got", dst.Bounds())
+	}
+	expected := color.RGBA{127, 0, 127, 255}
+	if got := dst.RGBAAt(0, 0); got != expected {
+		t.Error("expected", expected, "!=", got)
+	}
+}
+
+func TestCheckImageSize(t *testing.T) {
+	small := &bytes.Buffer{}
+	png.Encode(small, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	// A 1x1 frame on a declared 60000x60000 screen, a few bytes on disk
+	huge := &bytes.Buffer{}
+	gif.EncodeAll(huge, &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black})},
+		Delay:  []int{0},
+		Config: image.Config{Width: 60000, Height: 60000, ColorModel: color.Palette{color.Black}},
+	})
+
+	testcases := []struct {
+		data     []byte
+		expected error
+		invalid  bool
+	}{
+		{small.Bytes(), nil, false},
+		{huge.Bytes(), errThumbTooLarge, false},
+		{[]byte("not an image"), nil, true},
+	}
+	for tcNumber, testcase := range testcases {
+		r := bytes.NewReader(testcase.data)
+		err := checkImageSize(r)
+		if (testcase.invalid && err == nil) || (!testcase.invalid && err != testcase.expected) {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", err)
+		}
+		if err == nil && r.Len() != len(testcase.data) {
+			t.Error("testcase", tcNumber, "expected reader at the start")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filename as send by the client, including the relative path
+// browsers add when a folder is uploaded.
+// multipart.Part.FileName strips the path, so parse the header ourself.
+func partFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// Store a single uploadfile part under base/dirs/relative path.
+// Errors are reported in the response, so other files can still succeed.
+func storeUploadPart(part *multipart.Part, dirs []string) UploadSuccesResponse {
+	rawFilename := partFilename(part)
+	fileSegments := cleanRelativePath(rawFilename)
+	if len(fileSegments) == 0 {
+		return uploadFailed(rawFilename, codeBadRequest, "Invalid filename")
+	}
+	segments := append(cleanRelativePath(strings.Join(dirs, "/")), fileSegments...)
+
+	relativePath := "/" + strings.Join(segments, "/")
+	fp := filepath.Join(SETTINGS.Get("base"), filepath.FromSlash(relativePath))
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return uploadFailed(rawFilename, osErrorCode(err), "Unable to create directory")
+	}
+
+	// Written next to the target and renamed over it once complete,
+	// a failed upload leaves an existing file with the same name intact.
+	f, err := os.CreateTemp(filepath.Dir(fp), internalPrefix+"upload-*")
+	if err != nil {
+		return uploadFailed(rawFilename, osErrorCode(err), "Unable to store file")
+	}
+	n, err := io.Copy(f, part)
+	uploadBytes.Add(float64(n))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return uploadFailed(rawFilename, osErrorCode(err), "Unable to write file")
+	}
+	cacheStoredFile(fp)
+
+	filename := segments[len(segments)-1]
+	return UploadSuccesResponse{
+		Message:     "Upload succeeded",
+		Filename:    filename,
+		ContentURL:  "/" + "content/" + url.PathEscape(relativePath),
+		Directories: segments[:len(segments)-1],
+	}
+}
+
+func uploadFailed(filename string, code errorCode, reason string) UploadSuccesResponse {
+	return UploadSuccesResponse{
+		Message:     "Upload failed",
+		Filename:    filename,
+		Directories: []string{},
+		Error:       reason,
+		Code:        code.Code,
+		Status:      code.Status,
+	}
+}
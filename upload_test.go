@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testUpload struct {
+	field string
+	name  string
+	data  string
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestUploadRest(t *testing.T) {
+	defer func(base string) { SETTINGS.VarString["base"] = base }(SETTINGS.Get("base"))
+
+	tests := []struct {
+		parts []testUpload
+		// cut the body halfway through the last part
+		broken   bool
+		status   int
+		expected map[string]string
+	}{
+		{[]testUpload{{"uploadfile", "new.txt", "new"}}, false, 201,
+			map[string]string{"new.txt": "new", "keep.txt": "original"}},
+		{[]testUpload{{"dirs[]", "", "docs"}, {"uploadfile", "photos/a.jpg", "a"}, {"uploadfile", "b.txt", "b"}}, false, 201,
+			map[string]string{"docs/photos/a.jpg": "a", "docs/b.txt": "b", "keep.txt": "original"}},
+		{[]testUpload{{"uploadfile", "keep.txt", "replaced"}}, false, 201,
+			map[string]string{"keep.txt": "replaced"}},
+		{[]testUpload{{"uploadfile", "dir", "x"}, {"uploadfile", "c.txt", "c"}}, false, 207,
+			map[string]string{"c.txt": "c", "keep.txt": "original"}},
+		{[]testUpload{{"uploadfile", "../../../evil.txt", "x"}}, false, 201,
+			map[string]string{"evil.txt": "x", "keep.txt": "original"}},
+		{[]testUpload{{"uploadfile", "keep.txt", strings.Repeat("x", 10000)}}, true, 400,
+			map[string]string{"keep.txt": "original"}},
+		{[]testUpload{}, false, 400, map[string]string{"keep.txt": "original"}},
+	}
+	for tcNumber, test := range tests {
+		base, err := ioutil.TempDir("", "silo-upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		SETTINGS.VarString["base"] = base
+		ioutil.WriteFile(filepath.Join(base, "keep.txt"), []byte("original"), 0644)
+		os.Mkdir(filepath.Join(base, "dir"), 0755)
+
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for _, part := range test.parts {
+			if part.field == "dirs[]" {
+				mw.WriteField(part.field, part.data)
+				continue
+			}
+			w, _ := mw.CreateFormFile(part.field, part.name)
+			io.WriteString(w, part.data)
+		}
+		mw.Close()
+		var reader io.Reader = body
+		if test.broken {
+			reader = io.MultiReader(io.LimitReader(body, int64(body.Len()/2)), failingReader{})
+		}
+		r := httptest.NewRequest("POST", "/upload/", reader)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		uploadRest(w, r)
+
+		if w.Code != test.status {
+			t.Error("testcase", tcNumber, "expected", test.status, "!=", w.Code, w.Body.String())
+		}
+		if w.Code == 201 || w.Code == 207 {
+			responses := []UploadSuccesResponse{}
+			json.NewDecoder(w.Body).Decode(&responses)
+			files := 0
+			for _, part := range test.parts {
+				if part.field == "uploadfile" {
+					files++
+				}
+			}
+			if len(responses) != files {
+				t.Error("testcase", tcNumber, "expected a response per file", responses)
+			}
+		}
+		result := map[string]string{}
+		for _, file := range testFiles(base) {
+			content, _ := ioutil.ReadFile(filepath.Join(base, file))
+			result[file] = string(content)
+		}
+		if len(result) != len(test.expected) {
+			t.Error("testcase", tcNumber, "expected", test.expected, "!=", result)
+		}
+		for file, content := range test.expected {
+			if result[file] != content {
+				t.Error("testcase", tcNumber, "expected", file, content, "!=", result[file])
+			}
+		}
+		os.RemoveAll(base)
+	}
+}
@@ -3,6 +3,8 @@ package main
 // utils
 
 import (
+	"context"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -53,6 +55,31 @@ func removeEmpty(l []string) []string {
 	return nonEmpty
 }
 
+// Split a relative path send by a client, on both slash types,
+// and clean every segment. Segments that are empty after cleaning
+// such as "." and ".." are dropped, preventing path traversal.
+func cleanRelativePath(s string) []string {
+	s = strings.Replace(s, "\\", "/", -1)
+	return cleanPathSegments(strings.Split(s, "/"))
+}
+
+// Clean each segment with cleanFilename and drop the empty ones
+func cleanPathSegments(segments []string) []string {
+	cleaned := []string{}
+	for _, segment := range segments {
+		segment = cleanFilename(segment)
+		if segment == "" || segment == "." {
+			continue
+		}
+		// Requests never reach the files of silo itself
+		if isInternalName(segment) {
+			segment = strings.TrimPrefix(segment, ".")
+		}
+		cleaned = append(cleaned, segment)
+	}
+	return cleaned
+}
+
 // Remove the path, and return the filename
 func FilenameFromAbsPath(absPath string) string {
 	items := strings.Split(absPath, string(filepath.Separator))
@@ -90,3 +117,25 @@ func stripTrailingSlash(s string) string {
 	}
 	return s
 }
+
+// Temporary files and directories of silo in base start with this,
+// they are not synced into the cache.
+const internalPrefix = ".silo-"
+
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalPrefix)
+}
+
+// Reader that fails once ctx is done, disk work for a request
+// stops when its client is gone or the server shuts down.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -47,3 +47,49 @@ func TestStripTrailingSlash(t *testing.T) {
 		}
 	}
 }
+
+func TestCleanRelativePath(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected []string
+	}{
+		{"", []string{}},
+		{"a.txt", []string{"a.txt"}},
+		{"dir/a.txt", []string{"dir", "a.txt"}},
+		{"dir\\sub\\a.txt", []string{"dir", "sub", "a.txt"}},
+		{"../../etc/passwd", []string{"etc", "passwd"}},
+		{"/abs//path/./a b.txt", []string{"abs", "path", "ab.txt"}},
+		{"..", []string{}},
+		{".silo-webhooks/webhooks.json", []string{"silo-webhooks", "webhooks.json"}},
+	}
+
+	for tcNumber, testcase := range testcases {
+		result := cleanRelativePath(testcase.input)
+		if !reflect.DeepEqual(result, testcase.expected) {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected int64
+		valid    bool
+	}{
+		{"1600000000", 1600000000, true},
+		{"2020-01-02", 1577923200, true},
+		{"2020-01-02T03:04:05Z", 1577934245, true},
+		{"2020-01-02T03:04:05+01:00", 1577930645, true},
+		{"", 0, false},
+		{"yesterday", 0, false},
+		{"2020-13-01", 0, false},
+	}
+
+	for tcNumber, testcase := range testcases {
+		result, err := parseTimeParam(testcase.input)
+		if result != testcase.expected || (err == nil) != testcase.valid {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, testcase.valid, "!=", result, err)
+		}
+	}
+}
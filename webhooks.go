@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registered webhook, empty filters match everything.
+// ContentTypes match on prefix, "image/" matches all images.
+type Webhook struct {
+	ID           string
+	URL          string
+	Secret       string `json:",omitempty"`
+	Events       []string
+	Dirs         []string
+	ContentTypes []string
+	// Webhooks from settings can't be removed through the API
+	FromSettings bool
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type Delivery struct {
+	ID          string
+	WebhookID   string
+	Event       FileEvent
+	Status      string
+	Attempts    int
+	NextAttempt int64
+	LastStatus  int
+	LastError   string
+	Updated     int64
+}
+
+const (
+	webhookMaxAttempts = 10
+	webhookLogSize     = 500
+	webhookMaxBackoff  = time.Hour
+	// Deliveries sent at the same time
+	webhookConcurrency = 8
+	// Pending deliveries kept, the oldest fail past it. The queue is
+	// saved as a whole, a receiver that is down should not grow it forever.
+	webhookQueueSize = 10000
+)
+
+type WebhookManager struct {
+	mu       sync.Mutex
+	hooks    map[string]*Webhook
+	queue    []*Delivery
+	log      []*Delivery
+	storeDir string
+	// Queue or log changed since the last save
+	dirty  bool
+	client *http.Client
+	// Base delay of the exponential backoff
+	backoff time.Duration
+}
+
+var Webhooks = &WebhookManager{
+	hooks:   make(map[string]*Webhook),
+	client:  &http.Client{Timeout: 10 * time.Second},
+	backoff: time.Second,
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Signature of the body, send as X-Silo-Signature: sha256=<hex>
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Webhook) Matches(event FileEvent) bool {
+	if len(h.Events) > 0 && !containsString(h.Events, event.Type) {
+		return false
+	}
+	if len(h.Dirs) > 0 && !eventInDirs(event, h.Dirs) {
+		return false
+	}
+	if len(h.ContentTypes) > 0 {
+		for _, prefix := range h.ContentTypes {
+			if strings.HasPrefix(event.File.ContentType, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Load webhooks from settings and the store, webhooks setting is a comma
+// separated list of urls, signed with webhook-secret.
+func (m *WebhookManager) Load(storeDir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeDir = storeDir
+	m.loadSettings()
+	if storeDir == "" {
+		return
+	}
+	stored := []*Webhook{}
+	readJSONFile(filepath.Join(storeDir, "webhooks.json"), &stored)
+	for _, hook := range stored {
+		m.hooks[hook.ID] = hook
+	}
+	readJSONFile(filepath.Join(storeDir, "queue.json"), &m.queue)
+	readJSONFile(filepath.Join(storeDir, "deliveries.json"), &m.log)
+	m.trimQueue()
+}
+
+// Fail the oldest deliveries past webhookQueueSize, caller holds the lock
+func (m *WebhookManager) trimQueue() {
+	over := len(m.queue) - webhookQueueSize
+	if over <= 0 {
+		return
+	}
+	log.Println("webhooks, queue full, failing", over, "oldest deliveries")
+	for _, delivery := range m.queue[:over] {
+		delivery.Status = DeliveryFailed
+		delivery.LastError = "Queue full"
+		delivery.Updated = time.Now().Unix()
+	}
+	m.log = append(m.log, m.queue[:over]...)
+	if len(m.log) > webhookLogSize {
+		m.log = m.log[len(m.log)-webhookLogSize:]
+	}
+	m.queue = append([]*Delivery{}, m.queue[over:]...)
+	m.dirty = true
+}
+
+// Replace the webhooks from settings, after the settings are reloaded
+func (m *WebhookManager) LoadSettings() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loadSettings()
+}
+
+func (m *WebhookManager) loadSettings() {
+	for id, hook := range m.hooks {
+		if hook.FromSettings {
+			delete(m.hooks, id)
+		}
+	}
+	for i, u := range SETTINGS.GetList("webhooks") {
+		id := "settings-" + strconv.Itoa(i)
+		m.hooks[id] = &Webhook{
+			ID:           id,
+			URL:          strings.TrimSpace(u),
+			Secret:       SETTINGS.Get("webhook-secret"),
+			FromSettings: true,
+		}
+	}
+}
+
+func readJSONFile(fp string, v interface{}) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Println("webhooks, unable to read", fp, err)
+	}
+}
+
+// Write to a temporary file and rename, a crash never leaves a partial file.
+func writeJSONFile(fp string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+		return err
+	}
+	tmp := fp + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+// Persist hooks, queue and log, caller holds the lock
+func (m *WebhookManager) save() {
+	m.dirty = false
+	if m.storeDir == "" {
+		return
+	}
+	stored := []*Webhook{}
+	for _, hook := range m.hooks {
+		if !hook.FromSettings {
+			stored = append(stored, hook)
+		}
+	}
+	for name, v := range map[string]interface{}{
+		"webhooks.json":   stored,
+		"queue.json":      m.queue,
+		"deliveries.json": m.log,
+	} {
+		if err := writeJSONFile(filepath.Join(m.storeDir, name), v); err != nil {
+			log.Println("webhooks, unable to store", name, err)
+		}
+	}
+}
+
+func (m *WebhookManager) Add(hook *Webhook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks[hook.ID] = hook
+	m.save()
+}
+
+func (m *WebhookManager) Remove(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hook, found := m.hooks[id]
+	if !found || hook.FromSettings {
+		return false
+	}
+	delete(m.hooks, id)
+	m.save()
+	return true
+}
+
+// Webhooks without their secrets
+func (m *WebhookManager) List() []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hooks := []Webhook{}
+	for _, hook := range m.hooks {
+		h := *hook
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// Delivery log, newest first, optionally for a single webhook
+func (m *WebhookManager) Deliveries(webhookID string) []Delivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deliveries := []Delivery{}
+	for _, list := range [][]*Delivery{m.queue, m.log} {
+		for i := len(list) - 1; i >= 0; i-- {
+			if webhookID == "" || list[i].WebhookID == webhookID {
+				deliveries = append(deliveries, *list[i])
+			}
+		}
+	}
+	return deliveries
+}
+
+// Queue a delivery for every webhook that matches the event
+func (m *WebhookManager) Enqueue(event FileEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queued := false
+	for _, hook := range m.hooks {
+		if !hook.Matches(event) {
+			continue
+		}
+		m.queue = append(m.queue, &Delivery{
+			ID:          randomID(),
+			WebhookID:   hook.ID,
+			Event:       event,
+			Status:      DeliveryPending,
+			NextAttempt: time.Now().UnixNano(),
+			Updated:     time.Now().Unix(),
+		})
+		queued = true
+	}
+	// Saved in batches by ProcessQueue, a sync can queue thousands of events
+	if queued {
+		m.dirty = true
+		m.trimQueue()
+	}
+}
+
+// Save queued deliveries that are not stored yet, on shutdown
+func (m *WebhookManager) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirty {
+		m.save()
+	}
+}
+
+func (m *WebhookManager) send(hook Webhook, delivery Delivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "silo-webhook")
+	req.Header.Set("X-Silo-Event", delivery.Event.Type)
+	req.Header.Set("X-Silo-Delivery", delivery.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Silo-Signature", webhookSignature(hook.Secret, body))
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Try all deliveries that are due, webhookConcurrency at a time.
+// Changes to the queue and log are saved once per run.
+func (m *WebhookManager) ProcessQueue() {
+	now := time.Now()
+	m.mu.Lock()
+	type job struct {
+		hook     Webhook
+		delivery Delivery
+	}
+	jobs := []job{}
+	for _, delivery := range m.queue {
+		hook, found := m.hooks[delivery.WebhookID]
+		if !found {
+			delivery.Status = DeliveryFailed
+			delivery.LastError = "Webhook removed"
+			continue
+		}
+		if delivery.NextAttempt <= now.UnixNano() {
+			jobs = append(jobs, job{*hook, *delivery})
+		}
+	}
+	m.mu.Unlock()
+
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]Delivery)
+	semaphore := make(chan struct{}, webhookConcurrency)
+	for _, j := range jobs {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(d Delivery, hook Webhook) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			d = m.attempt(hook, d)
+			resultsMu.Lock()
+			results[d.ID] = d
+			resultsMu.Unlock()
+		}(j.delivery, j.hook)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queue := []*Delivery{}
+	for _, delivery := range m.queue {
+		if result, found := results[delivery.ID]; found {
+			*delivery = result
+		}
+		if delivery.Status == DeliveryPending {
+			queue = append(queue, delivery)
+		} else {
+			m.log = append(m.log, delivery)
+		}
+	}
+	if len(m.log) > webhookLogSize {
+		m.log = m.log[len(m.log)-webhookLogSize:]
+	}
+	changed := len(queue) != len(m.queue) || len(results) > 0
+	m.queue = queue
+	if changed || m.dirty {
+		m.save()
+	}
+}
+
+// Send a delivery once, failed attempts are retried with exponential
+// backoff until webhookMaxAttempts.
+func (m *WebhookManager) attempt(hook Webhook, d Delivery) Delivery {
+	d.Attempts++
+	d.Updated = time.Now().Unix()
+	status, err := m.send(hook, d)
+	d.LastStatus = status
+	d.LastError = ""
+	switch {
+	case err != nil:
+		d.LastError = err.Error()
+	case status < 200 || status > 299:
+		d.LastError = http.StatusText(status)
+	default:
+		d.Status = DeliveryDelivered
+	}
+	if d.Status == DeliveryPending {
+		if d.Attempts >= webhookMaxAttempts {
+			d.Status = DeliveryFailed
+		}
+		backoff := m.backoff << uint(d.Attempts-1)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff).UnixNano()
+	}
+	return d
+}
+
+// Queue events from the broker, runs forever. Deliveries are sent from
+// their own goroutine, so slow receivers don't hold up reading events.
+func (m *WebhookManager) Run() {
+	go m.deliver()
+	var lastID int64
+	for {
+		sub, backlog, complete := Events.Subscribe(lastID)
+		if !complete {
+			log.Println("webhooks, events after", lastID, "are no longer in the history and are not delivered")
+		}
+		for _, event := range backlog {
+			m.Enqueue(event)
+			lastID = event.ID
+		}
+		// Closed when dropped as slow subscriber, resubscribe and catch up
+		for event := range sub {
+			m.Enqueue(event)
+			lastID = event.ID
+		}
+	}
+}
+
+func (m *WebhookManager) deliver() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.ProcessQueue()
+	}
+}
+
+func webhookStoreDir() string {
+	if dir := SETTINGS.Get("webhook-store"); dir != "" {
+		return dir
+	}
+	// Under base so the queue survives a restart, not synced or served
+	return filepath.Join(SETTINGS.Get("base"), internalPrefix+"webhooks")
+}
+
+// Admin API
+// GET /webhooks/ list, POST /webhooks/ register, DELETE /webhooks/<id>
+// GET /webhooks/deliveries/ and /webhooks/<id>/deliveries/ delivery log
+func webhooksRest(w http.ResponseWriter, r *http.Request) {
+	setHeader(w)
+	if !requireAdmin(w, r) {
+		return
+	}
+	parts := removeEmpty(strings.Split(r.URL.Path[len("/webhooks"):], "/"))
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, Webhooks.List())
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		hook := &Webhook{}
+		if err := readJSON(w, r.Body, hook); err != nil || !strings.HasPrefix(hook.URL, "http") {
+			ErrorResponse(w, "Invalid webhook, URL is required", http.StatusBadRequest)
+			return
+		}
+		hook.ID = randomID()
+		hook.FromSettings = false
+		Webhooks.Add(hook)
+		created := *hook
+		created.Secret = ""
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, created)
+	case len(parts) == 1 && parts[0] == "deliveries":
+		writeJSON(w, Webhooks.Deliveries(""))
+	case len(parts) == 2 && parts[1] == "deliveries":
+		writeJSON(w, Webhooks.Deliveries(parts[0]))
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !Webhooks.Remove(parts[0]) {
+			ErrorResponse(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testWebhookManager(storeDir string) *WebhookManager {
+	m := &WebhookManager{
+		hooks:   make(map[string]*Webhook),
+		client:  &http.Client{Timeout: time.Second},
+		backoff: time.Millisecond,
+	}
+	m.Load(storeDir)
+	return m
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	received := []*http.Request{}
+	bodies := [][]byte{}
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		// First attempt fails, the retry succeeds
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	storeDir, err := ioutil.TempDir("", "silo-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testWebhookManager(storeDir)
+	m.Add(&Webhook{ID: "images", URL: receiver.URL, Secret: "secret", ContentTypes: []string{"image/"}})
+
+	m.Enqueue(FileEvent{ID: 1, Type: EventCreated, File: ListFile{Name: "a.txt", ContentType: "text/plain"}})
+	m.Enqueue(FileEvent{ID: 2, Type: EventCreated, File: ListFile{Name: "a.jpg", ContentType: "image/jpeg"}})
+
+	m.ProcessQueue()
+	time.Sleep(5 * time.Millisecond)
+	m.ProcessQueue()
+
+	if len(received) != 2 {
+		t.Fatal("expected 2 attempts !=", len(received))
+	}
+	if received[1].Header.Get("X-Silo-Signature") != webhookSignature("secret", bodies[1]) {
+		t.Error("invalid signature")
+	}
+	if received[1].Header.Get("X-Silo-Event") != EventCreated {
+		t.Error("expected event header created !=", received[1].Header.Get("X-Silo-Event"))
+	}
+
+	deliveries := m.Deliveries("images")
+	if len(deliveries) != 1 || deliveries[0].Status != DeliveryDelivered || deliveries[0].Attempts != 2 {
+		t.Error("unexpected deliveries", deliveries)
+	}
+
+	// Webhooks and the delivery log survive a restart
+	restarted := testWebhookManager(storeDir)
+	if len(restarted.List()) != 1 || len(restarted.Deliveries("")) != 1 {
+		t.Error("store not loaded", restarted.List(), restarted.Deliveries(""))
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	event := FileEvent{Type: EventDeleted, File: ListFile{Directories: []string{"photos", "2020"}, ContentType: "image/png"}}
+	testcases := []struct {
+		hook     Webhook
+		expected bool
+	}{
+		{Webhook{}, true},
+		{Webhook{Events: []string{EventDeleted}}, true},
+		{Webhook{Events: []string{EventCreated}}, false},
+		{Webhook{Dirs: []string{"photos"}}, true},
+		{Webhook{Dirs: []string{"videos"}}, false},
+		{Webhook{ContentTypes: []string{"video/", "image/"}}, true},
+		{Webhook{ContentTypes: []string{"video/"}}, false},
+	}
+
+	for tcNumber, testcase := range testcases {
+		if result := testcase.hook.Matches(event); result != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", result)
+		}
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	// A slow receiver, deliveries are sent concurrently
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		received++
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	storeDir, err := ioutil.TempDir("", "silo-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	m := testWebhookManager(storeDir)
+	m.Add(&Webhook{ID: "all", URL: receiver.URL})
+
+	for i := 1; i <= webhookConcurrency; i++ {
+		m.Enqueue(FileEvent{ID: int64(i), Type: EventCreated, File: ListFile{Name: "a.txt"}})
+	}
+	// Queued events are saved in batches, not on every event
+	stored := []*Delivery{}
+	readJSONFile(filepath.Join(storeDir, "queue.json"), &stored)
+	if len(stored) != 0 {
+		t.Error("expected queue to be saved in a batch, found", len(stored))
+	}
+	m.Flush()
+	readJSONFile(filepath.Join(storeDir, "queue.json"), &stored)
+	if len(stored) != webhookConcurrency {
+		t.Error("expected", webhookConcurrency, "queued deliveries stored !=", len(stored))
+	}
+
+	start := time.Now()
+	m.ProcessQueue()
+	if received != webhookConcurrency || time.Since(start) > time.Second {
+		t.Error("expected concurrent deliveries", received, time.Since(start))
+	}
+}
+
+func TestWebhookQueueSize(t *testing.T) {
+	m := testWebhookManager("")
+	m.Add(&Webhook{ID: "down", URL: "http://127.0.0.1:1/hook"})
+	for i := 1; i <= webhookQueueSize+3; i++ {
+		m.Enqueue(FileEvent{ID: int64(i), Type: EventCreated, File: ListFile{Name: "a.txt"}})
+	}
+	if len(m.queue) != webhookQueueSize || m.queue[0].Event.ID != 4 {
+		t.Error("expected", webhookQueueSize, "queued from event 4 !=", len(m.queue), m.queue[0].Event.ID)
+	}
+	if len(m.log) != 3 {
+		t.Fatal("expected the 3 oldest deliveries in the log !=", len(m.log))
+	}
+	for i, delivery := range m.log {
+		if delivery.Event.ID != int64(i+1) || delivery.Status != DeliveryFailed || delivery.LastError != "Queue full" {
+			t.Error("expected failed delivery of event", i+1, "!=", delivery.Event.ID, delivery.Status, delivery.LastError)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal server side WebSocket (RFC 6455), only what the event stream
+// needs, sending text frames and answering ping and close.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+var errUnmaskedFrame = errors.New("websocket: unmasked client frame")
+
+// Close status send when the client breaks the protocol
+var wsProtocolError = []byte{0x03, 0xEA}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// Comma separated header values, such as Connection: keep-alive, Upgrade
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The key is 16 random bytes in base64
+func validWebSocketKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 16
+}
+
+// Browsers send the Origin of the page, WebSockets are not limited by
+// the same-origin policy so other origins need to be allowed in cors.
+// Clients that are not browsers send no Origin.
+func webSocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return originAllowed(origin, SETTINGS.GetList("cors"))
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Read a single client frame, client frames are always masked and
+// an unmasked frame ends the connection.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	// Clients only send control frames and small messages
+	if length > 1<<16 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errUnmaskedFrame
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func eventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	hijacker, ok := w.(http.Hijacker)
+	if r.Method != http.MethodGet || !validWebSocketKey(key) || !ok {
+		ErrorResponse(w, "Invalid WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		ErrorResponse(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !webSocketOriginAllowed(r) {
+		ErrorResponse(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// The read-timeout of the server would end the connection
+	conn.SetReadDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	dirs := r.URL.Query()["dirs"]
+	sub, backlog, complete := Events.Subscribe(lastEventID(r))
+	defer Events.Unsubscribe(sub)
+
+	// Frames from the client are handled by the reader,
+	// writes are serialized through the outgoing channel.
+	outgoing := make(chan wsFrame, 16)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer close(stopped)
+	// Set by the reader before done is closed
+	var closePayload []byte
+	go func() {
+		defer close(done)
+		for {
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err == errUnmaskedFrame {
+				closePayload = wsProtocolError
+			}
+			if err != nil || opcode == wsOpClose {
+				return
+			}
+			if opcode == wsOpPing {
+				select {
+				case outgoing <- wsFrame{wsOpPong, payload}:
+				case <-stopped:
+					return
+				}
+			}
+		}
+	}()
+
+	send := func(opcode byte, payload []byte) bool {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return writeWebSocketFrame(conn, opcode, payload) == nil
+	}
+	sendEvent := func(event FileEvent) bool {
+		if !eventInDirs(event, dirs) {
+			return true
+		}
+		data, err := apiJSON(w, event)
+		return err != nil || send(wsOpText, data)
+	}
+
+	reset, _ := apiJSON(w, struct{ Type string }{"reset"})
+	if !complete && !send(wsOpText, reset) {
+		return
+	}
+	for _, event := range backlog {
+		if !sendEvent(event) {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-done:
+			send(wsOpClose, closePayload)
+			return
+		case <-shuttingDown:
+			send(wsOpClose, nil)
+			return
+		case frame := <-outgoing:
+			if !send(frame.opcode, frame.payload) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send(wsOpPing, nil) {
+				return
+			}
+		case event, open := <-sub:
+			if !open || !sendEvent(event) {
+				return
+			}
+		}
+	}
+}
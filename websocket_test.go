@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestReadWebSocketFrame(t *testing.T) {
+	long := append([]byte{0x81, 0x80 | 127}, 0, 0, 0, 0, 0, 2, 0, 0)
+	testcases := []struct {
+		frame   []byte
+		opcode  byte
+		payload string
+		err     error
+	}{
+		{maskedFrame(wsOpText, []byte("hello")), wsOpText, "hello", nil},
+		{maskedFrame(wsOpPing, nil), wsOpPing, "", nil},
+		{[]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}, 0, "", errUnmaskedFrame},
+		{long, 0, "", io.ErrUnexpectedEOF},
+		{[]byte{0x81}, 0, "", io.ErrUnexpectedEOF},
+	}
+	for tcNumber, testcase := range testcases {
+		opcode, payload, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(testcase.frame)))
+		if opcode != testcase.opcode || string(payload) != testcase.payload || err != testcase.err {
+			t.Error("testcase", tcNumber, "expected", testcase.opcode, testcase.payload, testcase.err, "!=", opcode, string(payload), err)
+		}
+	}
+}
+
+// Send a raw handshake, returns the status and the connection
+func webSocketHandshake(t *testing.T, addr string, headers map[string]string) (int, net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "GET /events/ HTTP/1.1\r\nHost: " + addr + "\r\n"
+	for name, value := range headers {
+		if value != "" {
+			request += name + ": " + value + "\r\n"
+		}
+	}
+	conn.Write([]byte(request + "\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, conn, br
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	defer func(cors []string) {
+		SETTINGS.VarList["cors"] = cors
+	}(SETTINGS.GetList("cors"))
+	SETTINGS.VarList["cors"] = []string{"https://*.example.com"}
+
+	server := httptest.NewServer(http.HandlerFunc(eventsRest))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+
+	testcases := []struct {
+		connection string
+		version    string
+		key        string
+		origin     string
+		expected   int
+	}{
+		{"Upgrade", "13", key, "", 101},
+		{"keep-alive, Upgrade", "13", key, "", 101},
+		{"Upgrade", "13", key, "http://" + addr, 101},
+		{"Upgrade", "13", key, "https://app.example.com", 101},
+		{"Upgrade", "13", key, "https://evil.com", 403},
+		{"Upgrade", "8", key, "", 426},
+		{"Upgrade", "", key, "", 426},
+		{"Upgrade", "13", "", "", 400},
+		{"Upgrade", "13", "short", "", 400},
+		// not an upgrade, the event stream is served instead
+		{"keep-alive, upgraded", "13", key, "", 200},
+	}
+	for tcNumber, testcase := range testcases {
+		status, conn, _ := webSocketHandshake(t, addr, map[string]string{
+			"Upgrade":               "websocket",
+			"Connection":            testcase.connection,
+			"Sec-WebSocket-Version": testcase.version,
+			"Sec-WebSocket-Key":     testcase.key,
+			"Origin":                testcase.origin,
+		})
+		conn.Close()
+		if status != testcase.expected {
+			t.Error("testcase", tcNumber, "expected", testcase.expected, "!=", status)
+		}
+	}
+}
+
+func TestWebSocketUnmaskedFrame(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(eventsRest))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	status, conn, br := webSocketHandshake(t, addr, map[string]string{
+		"Upgrade":               "websocket",
+		"Connection":            "Upgrade",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	})
+	defer conn.Close()
+	if status != 101 {
+		t.Fatal("expected 101 !=", status)
+	}
+	// a ping is answered, the unmasked frame closes the connection
+	conn.Write(maskedFrame(wsOpPing, []byte("x")))
+	conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	frames := [][]byte{}
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			break
+		}
+		payload := make([]byte, header[1]&0x7F)
+		io.ReadFull(br, payload)
+		frames = append(frames, append([]byte{header[0] & 0x0F}, payload...))
+	}
+	if len(frames) == 0 {
+		t.Fatal("expected frames")
+	}
+	if last := frames[len(frames)-1]; last[0] != wsOpClose || !bytes.Equal(last[1:], wsProtocolError) {
+		t.Error("expected a close frame with status 1002", frames)
+	}
+}
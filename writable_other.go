@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// The directory can be written, only the permission bits are checked
+func dirWritable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir() && info.Mode().Perm()&0200 != 0
+}
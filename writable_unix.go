@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+const accessWrite = 0x2
+
+// The directory can be written, checked without creating a file
+func dirWritable(path string) bool {
+	return syscall.Access(path, accessWrite) == nil
+}